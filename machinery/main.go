@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/kerberos-io/agent/machinery/src/capture"
+	"github.com/kerberos-io/agent/machinery/src/catalog"
 	"github.com/kerberos-io/agent/machinery/src/components"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
@@ -51,6 +52,15 @@ func main() {
 			// Open this configuration either from Kerberos Agent or Kerberos Factory.
 			components.OpenConfig(&configuration)
 
+			// Open the recording catalog, and make sure it matches the recordings
+			// which are stored on disk (they might have been changed while the agent was down).
+			if err := catalog.Open("./data/catalog/catalog.db"); err != nil {
+				log.Log.Error("Could not open the catalog: " + err.Error())
+			} else {
+				catalog.Synchronise("./data/recordings/", "./data/cloud/", configuration.Config.Cloud)
+				defer catalog.Close()
+			}
+
 			// Bootstrapping the agent
 			communication := models.Communication{
 				HandleBootstrap: make(chan string, 1),
@@ -0,0 +1,103 @@
+package capture
+
+import (
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/joy4/av"
+	"github.com/kerberos-io/joy4/cgo/ffmpeg"
+)
+
+// Sample rate of Opus, which is used for WebRTC.
+const opusSampleRate = 48000
+
+// IsG711 returns true if the codec is G.711 (PCM μ-law or A-law).
+func IsG711(codec av.CodecData) bool {
+	return codec != nil && (codec.Type() == av.PCM_MULAW || codec.Type() == av.PCM_ALAW)
+}
+
+// HasG711 returns true if one of the streams is G.711.
+func HasG711(streams []av.CodecData) bool {
+	for _, stream := range streams {
+		if IsG711(stream) {
+			return true
+		}
+	}
+	return false
+}
+
+// G711ToAAC is used by the joy4 transcoder, G.711 can't be stored in an mp4 (and isn't
+// playable by browsers), so it's transcoded to AAC. Other codecs are kept as they are.
+func G711ToAAC(codec av.AudioCodecData, i int) (need bool, dec av.AudioDecoder, enc av.AudioEncoder, err error) {
+	if !IsG711(codec) {
+		return false, nil, nil, nil
+	}
+	decoder, err := ffmpeg.NewAudioDecoder(codec)
+	if err != nil {
+		log.Log.Error("G711ToAAC: could not create a decoder, audio is not recorded, " + err.Error())
+		return false, nil, nil, nil
+	}
+	encoder, err := ffmpeg.NewAudioEncoderByCodecType(av.AAC)
+	if err != nil {
+		decoder.Close()
+		log.Log.Error("G711ToAAC: could not create an encoder, audio is not recorded, " + err.Error())
+		return false, nil, nil, nil
+	}
+	encoder.SetSampleRate(codec.SampleRate())
+	encoder.SetChannelLayout(codec.ChannelLayout())
+	encoder.SetSampleFormat(av.FLTP)
+	encoder.SetBitrate(32000)
+	return true, decoder, encoder, nil
+}
+
+// AudioTranscoder transcodes audio to Opus, so it can be sent over WebRTC.
+type AudioTranscoder struct {
+	decoder *ffmpeg.AudioDecoder
+	encoder *ffmpeg.AudioEncoder
+}
+
+// NewAudioTranscoder creates a transcoder from the codec of the camera (e.g. AAC) to Opus.
+func NewAudioTranscoder(codec av.AudioCodecData) (*AudioTranscoder, error) {
+	decoder, err := ffmpeg.NewAudioDecoder(codec)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := ffmpeg.NewAudioEncoderByName("libopus")
+	if err != nil {
+		decoder.Close()
+		return nil, err
+	}
+	encoder.SetSampleRate(opusSampleRate)
+	encoder.SetChannelLayout(codec.ChannelLayout())
+	encoder.SetSampleFormat(av.S16)
+	encoder.SetBitrate(32000)
+	if err := encoder.Setup(); err != nil {
+		decoder.Close()
+		encoder.Close()
+		return nil, err
+	}
+	return &AudioTranscoder{
+		decoder: decoder,
+		encoder: encoder,
+	}, nil
+}
+
+// Transcode decodes the data of a packet, and returns the Opus packets which are ready.
+// The duration of a packet is the same for all packets.
+func (t *AudioTranscoder) Transcode(data []byte) (packets [][]byte, duration time.Duration, err error) {
+	ok, frame, err := t.decoder.Decode(data)
+	if err != nil || !ok {
+		return nil, 0, err
+	}
+	if packets, err = t.encoder.Encode(frame); err != nil {
+		return nil, 0, err
+	}
+	duration = time.Duration(t.encoder.FrameSampleCount) * time.Second / opusSampleRate
+	return packets, duration, nil
+}
+
+// Close releases the decoder and encoder.
+func (t *AudioTranscoder) Close() {
+	t.decoder.Close()
+	t.encoder.Close()
+}
@@ -0,0 +1,198 @@
+package capture
+
+import (
+	"errors"
+	"image"
+	"io"
+	"sync"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/joy4/av"
+	"github.com/kerberos-io/joy4/cgo/ffmpeg"
+	"github.com/kerberos-io/joy4/codec/h264parser"
+	"github.com/kerberos-io/joy4/codec/h265parser"
+)
+
+// The frame rate of the transcoded stream, it has a keyframe every second.
+const transcoderFramerate = 30
+
+// Transcoded frames which are not yet read by the live view.
+const transcoderQueueSize = 30
+
+// VideoDecoder decodes the video stream of a camera. H264 is decoded with the ffmpeg
+// bindings, these don't support H265 which is decoded with libav directly.
+type VideoDecoder struct {
+	codec   av.CodecData
+	decoder *ffmpeg.VideoDecoder
+	libav   *libavDecoder
+}
+
+// Frame is a decoded image, Free should be called once the image is no longer used.
+type Frame struct {
+	Image image.YCbCr
+	frame *ffmpeg.VideoFrame
+}
+
+// Width of the image.
+func (f *Frame) Width() int {
+	return f.Image.Rect.Dx()
+}
+
+// Height of the image.
+func (f *Frame) Height() int {
+	return f.Image.Rect.Dy()
+}
+
+// VideoFrame returns the frame of the ffmpeg bindings, so it can be encoded. This is
+// nil for frames which are decoded with libav directly (H265).
+func (f *Frame) VideoFrame() *ffmpeg.VideoFrame {
+	return f.frame
+}
+
+// Free releases the memory of the frame.
+func (f *Frame) Free() {
+	if f.frame != nil {
+		f.frame.Free()
+		f.frame = nil
+	}
+}
+
+func GetVideoDecoder(streams []av.CodecData) *VideoDecoder {
+	// Load video codec, the H265 codec data of joy4 isn't an av.VideoCodecData.
+	var vstream av.CodecData
+	for _, stream := range streams {
+		if stream.Type().IsAudio() {
+			//astream := stream.(av.AudioCodecData)
+		} else if stream.Type().IsVideo() {
+			vstream = stream
+		}
+	}
+	decoder := &VideoDecoder{codec: vstream}
+	if IsH265(vstream) {
+		var err error
+		decoder.libav, err = newLibavDecoder("hevc", 0, 0, "")
+		if err != nil {
+			log.Log.Error("GetVideoDecoder: " + err.Error())
+		}
+	} else if videoCodec, ok := vstream.(av.VideoCodecData); ok {
+		decoder.decoder, _ = ffmpeg.NewVideoDecoder(videoCodec)
+	}
+	return decoder
+}
+
+// SetFramerate sets the framerate of the decoder.
+func (d *VideoDecoder) SetFramerate(num int, den int) {
+	if d.decoder != nil {
+		d.decoder.SetFramerate(num, den)
+	}
+}
+
+// Decode decodes the data of a packet.
+func (d *VideoDecoder) Decode(pkt av.Packet) (*Frame, error) {
+	if d.decoder != nil {
+		img, err := d.decoder.Decode(pkt.Data)
+		if err != nil || img == nil {
+			return nil, err
+		}
+		return &Frame{Image: img.Image, frame: img}, nil
+	}
+	if d.libav != nil {
+		// The parameter sets are prepended to keyframes, so decoding can start at any keyframe.
+		img, err := d.libav.Decode(H265ToAnnexB(d.codec.(h265parser.CodecData), pkt))
+		if err != nil || img == nil {
+			return nil, err
+		}
+		return &Frame{Image: *img}, nil
+	}
+	return nil, errors.New("Decode: no video decoder available")
+}
+
+// DecodesEveryFrame returns true if all frames can be decoded, and not only keyframes.
+func (d *VideoDecoder) DecodesEveryFrame() bool {
+	return d.decoder != nil || d.libav != nil
+}
+
+// Close releases the decoder.
+func (d *VideoDecoder) Close() {
+	if d.decoder != nil {
+		d.decoder.Close()
+		d.decoder = nil
+	}
+	if d.libav != nil {
+		d.libav.Close()
+		d.libav = nil
+	}
+}
+
+func DecodeImage(pkt av.Packet, decoder *VideoDecoder, decoderMutex *sync.Mutex) (*Frame, error) {
+	decoderMutex.Lock()
+	img, err := decoder.Decode(pkt)
+	decoderMutex.Unlock()
+	return img, err
+}
+
+// Transcoder transcodes an H265 stream to H264 with libav, so it can be played
+// by browsers which don't support H265 (live view).
+type Transcoder struct {
+	codec   h265parser.CodecData
+	decoder *libavDecoder
+	encoder *libavEncoder
+	frames  chan []byte
+}
+
+// NewTranscoder creates a transcoder, the resolution is scaled down to a percentage (1-100).
+func NewTranscoder(codec h265parser.CodecData, resolution int) (*Transcoder, error) {
+	width, height := codec.Width(), codec.Height()
+	if resolution > 0 && resolution < 100 {
+		width, height = width*resolution/100, height*resolution/100
+	}
+	decoder, err := newLibavDecoder("hevc", 0, 0, "")
+	if err != nil {
+		return nil, errors.New("NewTranscoder: " + err.Error())
+	}
+	encoder, err := newLibavEncoder(width, height, transcoderFramerate)
+	if err != nil {
+		decoder.Close()
+		return nil, errors.New("NewTranscoder: " + err.Error())
+	}
+	return &Transcoder{
+		codec:   codec,
+		decoder: decoder,
+		encoder: encoder,
+		frames:  make(chan []byte, transcoderQueueSize),
+	}, nil
+}
+
+// WritePacket transcodes an H265 packet, the H264 frames are read with ReadAccessUnit.
+func (t *Transcoder) WritePacket(pkt av.Packet) error {
+	img, err := t.decoder.Decode(H265ToAnnexB(t.codec, pkt))
+	if err != nil || img == nil {
+		return err
+	}
+	frames, err := t.encoder.Encode(img)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		t.frames <- frame
+	}
+	return nil
+}
+
+// ReadAccessUnit returns the NALUs of the next transcoded H264 frame.
+func (t *Transcoder) ReadAccessUnit() ([][]byte, error) {
+	frame, ok := <-t.frames
+	if !ok {
+		return nil, io.EOF
+	}
+	nalus, _ := h264parser.SplitNALUs(frame)
+	return nalus, nil
+}
+
+// Close stops the transcoder, it should be called by the writer of the packets.
+func (t *Transcoder) Close() error {
+	close(t.frames)
+	t.decoder.Close()
+	t.encoder.Close()
+	return nil
+}
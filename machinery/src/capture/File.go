@@ -0,0 +1,158 @@
+package capture
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/joy4/av"
+	"github.com/kerberos-io/joy4/av/avutil"
+	"github.com/kerberos-io/joy4/format"
+)
+
+// IsFileURL returns true if the url points to a local file (file://).
+func IsFileURL(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.Scheme == "file"
+}
+
+// FileSource plays a local recording as if it was a camera. The packets are paced
+// at real time (realtime=true, the default), and the file can be played in a loop
+// (loop=true). The timestamps keep increasing when the file is looped. The mutex guards
+// the demuxer, which is reopened by ReadPacket and closed by Close.
+type FileSource struct {
+	mutex    sync.Mutex
+	path     string
+	loop     bool
+	realtime bool
+	demuxer  av.DemuxCloser
+	streams  []av.CodecData
+	started  time.Time     // wall clock time of the first packet
+	offset   time.Duration // duration of the previous loops
+	last     time.Duration // time of the last packet of the current loop
+	interval time.Duration // time between the last two packets
+	closed   chan bool
+}
+
+// OpenFile opens a file url, e.g. file:///clip.mp4?loop=true&realtime=true.
+func OpenFile(uri string) (av.DemuxCloser, []av.CodecData, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, []av.CodecData{}, err
+	}
+	if u.Scheme != "file" {
+		return nil, []av.CodecData{}, errors.New("OpenFile: not a file url: " + uri)
+	}
+
+	// Relative paths are parsed as a host, e.g. file://./data/clip.mp4
+	path := u.Host + u.Path
+	query := u.Query()
+	source := &FileSource{
+		path:     path,
+		loop:     query.Get("loop") == "true",
+		realtime: query.Get("realtime") != "false",
+		closed:   make(chan bool),
+	}
+
+	format.RegisterAll()
+	if err := source.open(); err != nil {
+		return nil, []av.CodecData{}, err
+	}
+	log.Log.Info("OpenFile: playing " + path)
+	return source, source.streams, nil
+}
+
+func (f *FileSource) open() error {
+	demuxer, err := avutil.Open(f.path)
+	if err != nil {
+		return err
+	}
+	streams, err := demuxer.Streams()
+	if err != nil {
+		demuxer.Close()
+		return err
+	}
+	f.demuxer = demuxer
+	f.streams = streams
+	return nil
+}
+
+// Streams returns the codec data of the file.
+func (f *FileSource) Streams() ([]av.CodecData, error) {
+	return f.streams, nil
+}
+
+// ReadPacket returns the next packet of the file. When the end of the file is reached
+// and the file is looped, it starts over again.
+func (f *FileSource) ReadPacket() (pkt av.Packet, err error) {
+	f.mutex.Lock()
+	pkt, err = f.readPacket()
+	f.mutex.Unlock()
+	if err != nil {
+		return pkt, err
+	}
+
+	if f.realtime {
+		if f.started.IsZero() {
+			f.started = time.Now().Add(-pkt.Time)
+		}
+		wait := time.Until(f.started.Add(pkt.Time))
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-f.closed:
+				return pkt, io.EOF
+			}
+		}
+	}
+	return pkt, nil
+}
+
+func (f *FileSource) readPacket() (pkt av.Packet, err error) {
+	if f.demuxer == nil {
+		return pkt, io.EOF
+	}
+	pkt, err = f.demuxer.ReadPacket()
+	if err == io.EOF && f.loop {
+		f.demuxer.Close()
+		f.demuxer = nil
+		if err = f.open(); err != nil {
+			return pkt, err
+		}
+		f.offset += f.last + f.interval
+		f.last, f.interval = 0, 0
+		log.Log.Debug("ReadPacket: looping " + f.path)
+		pkt, err = f.demuxer.ReadPacket()
+	}
+	if err != nil {
+		return pkt, err
+	}
+
+	if pkt.Time > f.last {
+		f.interval = pkt.Time - f.last
+		f.last = pkt.Time
+	}
+	pkt.Time += f.offset
+	return pkt, nil
+}
+
+// Close closes the file, it waits for a packet which is being read.
+func (f *FileSource) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	select {
+	case <-f.closed:
+		return nil
+	default:
+		close(f.closed)
+	}
+	if f.demuxer == nil {
+		return nil
+	}
+	err := f.demuxer.Close()
+	f.demuxer = nil
+	return err
+}
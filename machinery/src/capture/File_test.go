@@ -0,0 +1,141 @@
+package capture
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kerberos-io/joy4/av"
+	"github.com/kerberos-io/joy4/codec/h264parser"
+	"github.com/kerberos-io/joy4/format/mp4"
+)
+
+// The packets of the test recording.
+const (
+	filePackets  = 10
+	fileInterval = 40 * time.Millisecond
+)
+
+// writeTestFile writes a recording with a keyframe followed by P frames, and returns
+// its file url.
+func writeTestFile(t *testing.T, query string) string {
+	t.Helper()
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c8f162d96")
+	pps, _ := hex.DecodeString("68ebe3cb22c0")
+	codec, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "clip.mp4")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	muxer := mp4.NewMuxer(file)
+	if err := muxer.WriteHeader([]av.CodecData{codec}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < filePackets; i++ {
+		nalu := byte(0x41)
+		if i == 0 {
+			nalu = 0x65
+		}
+		pkt := av.Packet{
+			IsKeyFrame: i == 0,
+			Time:       time.Duration(i) * fileInterval,
+			Data:       []byte{0, 0, 0, 2, nalu, byte(i)},
+		}
+		if err := muxer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	return "file://" + path + query
+}
+
+func TestFileSource(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		reads int
+	}{
+		{name: "played once", query: "?realtime=false", reads: filePackets},
+		{name: "looped", query: "?loop=true&realtime=false", reads: 3 * filePackets},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, streams, err := OpenFile(writeTestFile(t, test.query))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer source.Close()
+			if len(streams) != 1 || streams[0].Type() != av.H264 {
+				t.Fatalf("expected a single H264 stream")
+			}
+
+			// The timestamps keep increasing at the same interval, also when the file is looped.
+			for i := 0; i < test.reads; i++ {
+				pkt, err := source.ReadPacket()
+				if err != nil {
+					t.Fatalf("packet %d: %s", i, err)
+				}
+				if pkt.Time != time.Duration(i)*fileInterval {
+					t.Errorf("packet %d: time %s, expected %s", i, pkt.Time, time.Duration(i)*fileInterval)
+				}
+				if pkt.IsKeyFrame != (i%filePackets == 0) || pkt.Data[len(pkt.Data)-1] != byte(i%filePackets) {
+					t.Errorf("packet %d: wrong packet", i)
+				}
+			}
+			if test.query == "?realtime=false" {
+				if _, err := source.ReadPacket(); err != io.EOF {
+					t.Errorf("expected the end of the file, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFileSourceClose(t *testing.T) {
+	source, _, err := OpenFile(writeTestFile(t, "?loop=true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is closed while it's played, the reader should stop without reading
+	// from the closed demuxer.
+	done := make(chan error)
+	go func() {
+		for {
+			if _, err := source.ReadPacket(); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(3 * fileInterval)
+	if err := source.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Errorf("expected io.EOF after closing, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadPacket didn't return after closing")
+	}
+
+	if err := source.Close(); err != nil {
+		t.Errorf("closing twice: %s", err)
+	}
+	if _, err := source.ReadPacket(); err != io.EOF {
+		t.Errorf("expected io.EOF after closing, got %v", err)
+	}
+}
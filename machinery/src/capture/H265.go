@@ -0,0 +1,367 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/joy4/av"
+	"github.com/kerberos-io/joy4/codec"
+	"github.com/kerberos-io/joy4/codec/aacparser"
+	"github.com/kerberos-io/joy4/codec/h265parser"
+
+	vdkav "github.com/deepch/vdk/av"
+	vdkaacparser "github.com/deepch/vdk/codec/aacparser"
+	vdkh265parser "github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+	"github.com/deepch/vdk/format/rtspv2"
+)
+
+// The RTSP client of joy4 only supports H264, H265 cameras are read with the RTSP client
+// of vdk. Its packets and codec data are converted, so the rest of the agent (recording,
+// motion and live view) doesn't need to know which client is used.
+
+// Time we wait for the parameter sets (VPS, SPS and PPS) of the camera.
+const h265CodecTimeout = 10 * time.Second
+
+// IsH265 returns true if the codec is H265 (HEVC).
+func IsH265(codec av.CodecData) bool {
+	return codec != nil && codec.Type() == av.H265
+}
+
+// HasH265 returns true if one of the streams is H265 (HEVC).
+func HasH265(streams []av.CodecData) bool {
+	for _, stream := range streams {
+		if IsH265(stream) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsH265KeyFrame returns true if the NALU is a random access point (IDR, CRA or BLA),
+// which can be decoded without any other frame.
+func IsH265KeyFrame(nalu []byte) bool {
+	if len(nalu) == 0 {
+		return false
+	}
+	typ := (nalu[0] >> 1) & 0x3f
+	return typ >= 16 && typ <= 21
+}
+
+// The NALU types of RTP payloads (RFC 7798), and the types which aren't part of a packet.
+const (
+	h265NALUVPS           = 32
+	h265NALUAUD           = 35
+	h265NALUAggregation   = 48
+	h265NALUFragmentation = 49
+	h265NALUPACI          = 50
+)
+
+// The clock rate of H265 RTP timestamps.
+const h265ClockRate = 90000
+
+// RTSPH265 is a demuxer for H265 cameras. The vdk client sends every NALU as a packet of
+// its own, and drops the NALUs it doesn't know (e.g. an IDR or CRA frame which fits in a
+// single RTP packet). Therefore the RTP packets of the video track are read from the proxy
+// queue of the client, and depacketized into access units here. The audio packets (AAC
+// or G.711) of the client are used as they are.
+type RTSPH265 struct {
+	client       *rtspv2.RTSPClient
+	streams      []av.CodecData
+	depacketizer h265Depacketizer
+	audioIdx     int8 // the index of the audio track in the codec data of vdk, or -1
+}
+
+// OpenRTSPH265 opens an RTSP stream with the vdk client, it fails if the stream isn't H265.
+func OpenRTSPH265(url string) (av.DemuxCloser, []av.CodecData, error) {
+	client, err := rtspv2.Dial(rtspv2.RTSPClientOptions{
+		URL:              url,
+		DialTimeout:      3 * time.Second,
+		ReadWriteTimeout: 5 * time.Second,
+		OutgoingProxy:    true,
+	})
+	if err != nil {
+		return nil, []av.CodecData{}, err
+	}
+	demuxer := &RTSPH265{client: client, audioIdx: -1}
+	demuxer.depacketizer.channel = h265VideoChannel(client.SDPRaw)
+
+	// The parameter sets are not always part of the SDP, in that case we
+	// wait until they are received in band.
+	timeout := time.After(h265CodecTimeout)
+	for {
+		codec, isH265, err := h265CodecData(client.CodecData)
+		if !isH265 {
+			client.Close()
+			return nil, []av.CodecData{}, errors.New("OpenRTSPH265: the stream isn't H265")
+		}
+		if err == nil {
+			demuxer.streams = []av.CodecData{codec}
+			break
+		}
+		select {
+		case signal := <-client.Signals:
+			if signal == rtspv2.SignalStreamRTPStop {
+				client.Close()
+				return nil, []av.CodecData{}, errors.New("OpenRTSPH265: the stream stopped")
+			}
+		case <-client.OutgoingPacketQueue:
+		case <-client.OutgoingProxyQueue:
+		case <-timeout:
+			client.Close()
+			return nil, []av.CodecData{}, errors.New("OpenRTSPH265: no VPS, SPS and PPS received")
+		}
+	}
+
+	audio, audioIdx, err := h265AudioCodecData(client.CodecData)
+	if err != nil {
+		log.Log.Info("OpenRTSPH265: audio is dropped, " + err.Error())
+	} else if audio != nil {
+		demuxer.streams = append(demuxer.streams, audio)
+		demuxer.audioIdx = audioIdx
+	}
+
+	log.Log.Info("OpenRTSPH265: opened H265 stream (" + demuxer.streams[0].(h265parser.CodecData).Resolution() + ")")
+	return demuxer, demuxer.streams, nil
+}
+
+// h265VideoChannel returns the interleaved channel of the video track. The client sets up
+// the tracks in the order of the SDP, every track has two channels (RTP and RTCP).
+func h265VideoChannel(sdpRaw []byte) byte {
+	_, medias := sdp.Parse(string(sdpRaw))
+	channel := 0
+	for i, media := range medias {
+		if media.AVType == "video" {
+			channel = 2 * i
+		}
+	}
+	return byte(channel)
+}
+
+// h265AudioCodecData converts the audio codec data of vdk to the codec data of joy4, and
+// returns its index. Only AAC and G.711 are supported.
+func h265AudioCodecData(codecs []vdkav.CodecData) (audio av.CodecData, idx int8, err error) {
+	for i, c := range codecs {
+		switch c.Type() {
+		case vdkav.AAC:
+			aac, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes(c.(vdkaacparser.CodecData).MPEG4AudioConfigBytes())
+			if err != nil {
+				return nil, -1, errors.New("h265AudioCodecData: invalid AAC config, " + err.Error())
+			}
+			return aac, int8(i), nil
+		case vdkav.PCM_ALAW:
+			return codec.NewPCMAlawCodecData(), int8(i), nil
+		case vdkav.PCM_MULAW:
+			return codec.NewPCMMulawCodecData(), int8(i), nil
+		default:
+			if c.Type().IsAudio() {
+				return nil, -1, errors.New("h265AudioCodecData: the audio codec " + c.Type().String() + " isn't supported")
+			}
+		}
+	}
+	return nil, -1, nil
+}
+
+// h265CodecData converts the H265 codec data of vdk to the codec data of joy4.
+func h265CodecData(codecs []vdkav.CodecData) (codec h265parser.CodecData, isH265 bool, err error) {
+	for _, c := range codecs {
+		if c.Type() != vdkav.H265 {
+			continue
+		}
+		vdkCodec := c.(vdkh265parser.CodecData)
+		if len(vdkCodec.RecordInfo.VPS) == 0 || len(vdkCodec.RecordInfo.SPS) == 0 || len(vdkCodec.RecordInfo.PPS) == 0 {
+			return codec, true, errors.New("h265CodecData: missing VPS, SPS or PPS")
+		}
+		codec, err = h265parser.NewCodecDataFromVPSAndSPSAndPPS(vdkCodec.VPS(), vdkCodec.SPS(), vdkCodec.PPS())
+		return codec, true, err
+	}
+	return codec, false, nil
+}
+
+// Streams returns the codec data of the camera.
+func (r *RTSPH265) Streams() ([]av.CodecData, error) {
+	return r.streams, nil
+}
+
+// ReadPacket returns the next packet of the camera. A packet contains the NALUs of a
+// single picture, which are prefixed with their length (AVCC).
+func (r *RTSPH265) ReadPacket() (pkt av.Packet, err error) {
+	for {
+		if pkt, ok := r.depacketizer.next(); ok {
+			return pkt, nil
+		}
+		select {
+		case signal := <-r.client.Signals:
+			if signal == rtspv2.SignalStreamRTPStop {
+				return pkt, io.EOF
+			}
+		case packet := <-r.client.OutgoingPacketQueue:
+			// The video packets of vdk aren't used, but the queue should not fill up.
+			if packet != nil && r.audioIdx >= 0 && packet.Idx == r.audioIdx {
+				return av.Packet{Idx: 1, Time: packet.Time, Data: packet.Data}, nil
+			}
+		case content := <-r.client.OutgoingProxyQueue:
+			if content != nil {
+				r.depacketizer.write(*content)
+			}
+		}
+	}
+}
+
+// Close closes the RTSP session.
+func (r *RTSPH265) Close() error {
+	r.client.Close()
+	return nil
+}
+
+// H265ToAnnexB converts the data of a packet to an Annex B stream, for keyframes the
+// parameter sets are prepended so it can be decoded on its own.
+func H265ToAnnexB(codec h265parser.CodecData, pkt av.Packet) []byte {
+	var data []byte
+	if pkt.IsKeyFrame {
+		for _, nalu := range [][]byte{codec.VPS(), codec.SPS(), codec.PPS()} {
+			data = append(data, 0, 0, 0, 1)
+			data = append(data, nalu...)
+		}
+	}
+	nalus, _ := h265parser.SplitNALUs(pkt.Data)
+	for _, nalu := range nalus {
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, nalu...)
+	}
+	return data
+}
+
+// h265Depacketizer converts RTP packets (RFC 7798) to access units. The NALUs with the
+// same timestamp belong to the same picture, and are written as a single packet.
+type h265Depacketizer struct {
+	channel   byte // the interleaved channel of the video track
+	started   bool
+	sequence  uint16
+	timestamp uint32
+	time      time.Duration
+	fragment  []byte
+	nalus     [][]byte
+	packets   []av.Packet
+}
+
+// write adds an interleaved RTP packet ('$', channel, length and the RTP packet). An
+// access unit is complete when the marker bit is set, or when the timestamp changes.
+func (d *h265Depacketizer) write(content []byte) {
+	// RTCP is sent on the odd channels, the other even channels are audio.
+	if len(content) < 4+12 || content[0] != '$' || content[1] != d.channel {
+		return
+	}
+	rtp := content[4:]
+	if rtp[0]>>6 != 2 {
+		return
+	}
+	padding := rtp[0]&0x20 != 0
+	extension := rtp[0]&0x10 != 0
+	marker := rtp[1]&0x80 != 0
+	sequence := binary.BigEndian.Uint16(rtp[2:])
+	timestamp := binary.BigEndian.Uint32(rtp[4:])
+	payload := rtp[12:]
+	if csrc := 4 * int(rtp[0]&0x0f); len(payload) >= csrc {
+		payload = payload[csrc:]
+	} else {
+		return
+	}
+	if extension {
+		if len(payload) < 4 || len(payload) < 4+4*int(binary.BigEndian.Uint16(payload[2:])) {
+			return
+		}
+		payload = payload[4+4*int(binary.BigEndian.Uint16(payload[2:])):]
+	}
+	if padding {
+		if len(payload) == 0 || int(payload[len(payload)-1]) > len(payload) {
+			return
+		}
+		payload = payload[:len(payload)-int(payload[len(payload)-1])]
+	}
+
+	if d.started {
+		// A fragmented NALU can't be completed if a packet is lost.
+		if sequence != d.sequence+1 {
+			d.fragment = nil
+		}
+		if timestamp != d.timestamp {
+			d.flush()
+			d.time += time.Duration(int32(timestamp-d.timestamp)) * time.Second / h265ClockRate
+		}
+	}
+	d.started = true
+	d.sequence = sequence
+	d.timestamp = timestamp
+	d.depacketize(payload)
+	if marker {
+		d.flush()
+	}
+}
+
+// depacketize adds the NALUs of a payload: a single NALU, an aggregation packet or a
+// fragmentation unit.
+func (d *h265Depacketizer) depacketize(payload []byte) {
+	if len(payload) < 3 {
+		return
+	}
+	switch (payload[0] >> 1) & 0x3f {
+	case h265NALUAggregation:
+		for units := payload[2:]; len(units) > 2; {
+			size := int(binary.BigEndian.Uint16(units))
+			units = units[2:]
+			if size < 2 || size > len(units) {
+				break
+			}
+			d.nalus = append(d.nalus, units[:size])
+			units = units[size:]
+		}
+	case h265NALUFragmentation:
+		header := payload[2]
+		if header&0x80 != 0 {
+			// The NALU header is rebuilt from the payload header and the type of the FU header.
+			d.fragment = append([]byte{payload[0]&0x81 | (header&0x3f)<<1, payload[1]}, payload[3:]...)
+		} else if d.fragment != nil {
+			d.fragment = append(d.fragment, payload[3:]...)
+		}
+		if header&0x40 != 0 && d.fragment != nil {
+			d.nalus = append(d.nalus, d.fragment)
+			d.fragment = nil
+		}
+	case h265NALUPACI:
+	default:
+		d.nalus = append(d.nalus, payload)
+	}
+}
+
+// flush writes the NALUs of the current access unit as a packet. The parameter sets are
+// part of the codec data, so these (and delimiters) are left out.
+func (d *h265Depacketizer) flush() {
+	pkt := av.Packet{Idx: 0, Time: d.time}
+	for _, nalu := range d.nalus {
+		if typ := (nalu[0] >> 1) & 0x3f; typ >= h265NALUVPS && typ <= h265NALUAUD {
+			continue
+		}
+		pkt.IsKeyFrame = pkt.IsKeyFrame || IsH265KeyFrame(nalu)
+		size := len(nalu)
+		pkt.Data = append(pkt.Data, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+		pkt.Data = append(pkt.Data, nalu...)
+	}
+	d.nalus = nil
+	if len(pkt.Data) > 0 {
+		d.packets = append(d.packets, pkt)
+	}
+}
+
+// next returns the next access unit which is complete.
+func (d *h265Depacketizer) next() (av.Packet, bool) {
+	if len(d.packets) == 0 {
+		return av.Packet{}, false
+	}
+	pkt := d.packets[0]
+	d.packets = d.packets[1:]
+	return pkt, true
+}
@@ -0,0 +1,197 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// rtpPacket returns an interleaved RTP packet on channel 0.
+func rtpPacket(sequence uint16, timestamp uint32, marker bool, payload []byte) []byte {
+	rtp := make([]byte, 12, 12+len(payload))
+	rtp[0] = 0x80
+	rtp[1] = 96
+	if marker {
+		rtp[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(rtp[2:], sequence)
+	binary.BigEndian.PutUint32(rtp[4:], timestamp)
+	rtp = append(rtp, payload...)
+	content := []byte{'$', 0, 0, 0}
+	binary.BigEndian.PutUint16(content[2:], uint16(len(rtp)))
+	return append(content, rtp...)
+}
+
+// nalu returns a NALU of a type, followed by some data.
+func nalu(typ byte, data ...byte) []byte {
+	return append([]byte{typ << 1, 1}, data...)
+}
+
+// avcc prefixes NALUs with their length.
+func avcc(nalus ...[]byte) []byte {
+	var data []byte
+	for _, n := range nalus {
+		data = append(data, 0, 0, 0, byte(len(n)))
+		data = append(data, n...)
+	}
+	return data
+}
+
+func TestH265Depacketizer(t *testing.T) {
+	const (
+		trail = 1
+		idr   = 19
+		cra   = 21
+		sps   = 33
+	)
+	idrNALU := nalu(idr, 1, 2, 3, 4, 5, 6)
+	fragment := func(start bool, end bool, data ...byte) []byte {
+		header := byte(idr)
+		if start {
+			header |= 0x80
+		}
+		if end {
+			header |= 0x40
+		}
+		return append([]byte{h265NALUFragmentation << 1, 1, header}, data...)
+	}
+	aggregation := func(nalus ...[]byte) []byte {
+		payload := []byte{h265NALUAggregation << 1, 1}
+		for _, n := range nalus {
+			payload = append(payload, 0, byte(len(n)))
+			payload = append(payload, n...)
+		}
+		return payload
+	}
+
+	type expected struct {
+		data     []byte
+		keyFrame bool
+		time     time.Duration
+	}
+	tests := []struct {
+		name     string
+		packets  [][]byte
+		expected []expected
+	}{
+		{
+			name: "single IDR and CRA NALUs",
+			packets: [][]byte{
+				rtpPacket(1, 0, true, nalu(idr, 1)),
+				rtpPacket(2, 9000, true, nalu(trail, 2)),
+				rtpPacket(3, 18000, true, nalu(cra, 3)),
+			},
+			expected: []expected{
+				{avcc(nalu(idr, 1)), true, 0},
+				{avcc(nalu(trail, 2)), false, 100 * time.Millisecond},
+				{avcc(nalu(cra, 3)), true, 200 * time.Millisecond},
+			},
+		},
+		{
+			name: "slices are grouped by timestamp",
+			packets: [][]byte{
+				rtpPacket(1, 0, false, nalu(trail, 1)),
+				rtpPacket(2, 0, false, nalu(trail, 2)),
+				rtpPacket(3, 3000, false, nalu(trail, 3)),
+				rtpPacket(4, 6000, true, nalu(trail, 4)),
+			},
+			expected: []expected{
+				{avcc(nalu(trail, 1), nalu(trail, 2)), false, 0},
+				{avcc(nalu(trail, 3)), false, time.Second / 30},
+				{avcc(nalu(trail, 4)), false, 2 * time.Second / 30},
+			},
+		},
+		{
+			name: "aggregation packet without parameter sets",
+			packets: [][]byte{
+				rtpPacket(1, 0, true, aggregation(nalu(sps, 9), nalu(idr, 1), nalu(idr, 2))),
+			},
+			expected: []expected{
+				{avcc(nalu(idr, 1), nalu(idr, 2)), true, 0},
+			},
+		},
+		{
+			name: "fragmentation units",
+			packets: [][]byte{
+				rtpPacket(1, 0, false, fragment(true, false, 1, 2)),
+				rtpPacket(2, 0, false, fragment(false, false, 3, 4)),
+				rtpPacket(3, 0, true, fragment(false, true, 5, 6)),
+			},
+			expected: []expected{
+				{avcc(idrNALU), true, 0},
+			},
+		},
+		{
+			name: "fragmentation units with a lost packet",
+			packets: [][]byte{
+				rtpPacket(1, 0, false, fragment(true, false, 1, 2)),
+				rtpPacket(3, 0, true, fragment(false, true, 5, 6)),
+				rtpPacket(4, 3000, true, nalu(trail, 1)),
+			},
+			expected: []expected{
+				{avcc(nalu(trail, 1)), false, time.Second / 30},
+			},
+		},
+		{
+			name: "RTCP is ignored",
+			packets: [][]byte{
+				append([]byte{'$', 1}, rtpPacket(1, 0, true, nalu(idr, 1))[2:]...),
+			},
+		},
+		{
+			name: "other tracks are ignored",
+			packets: [][]byte{
+				append([]byte{'$', 2}, rtpPacket(1, 0, true, nalu(idr, 1))[2:]...),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var d h265Depacketizer
+			for _, packet := range test.packets {
+				d.write(packet)
+			}
+			for i, e := range test.expected {
+				pkt, ok := d.next()
+				if !ok {
+					t.Fatalf("packet %d: missing", i)
+				}
+				if !bytes.Equal(pkt.Data, e.data) {
+					t.Errorf("packet %d: data %x, expected %x", i, pkt.Data, e.data)
+				}
+				if pkt.IsKeyFrame != e.keyFrame {
+					t.Errorf("packet %d: keyframe %t, expected %t", i, pkt.IsKeyFrame, e.keyFrame)
+				}
+				if pkt.Time != e.time {
+					t.Errorf("packet %d: time %s, expected %s", i, pkt.Time, e.time)
+				}
+			}
+			if pkt, ok := d.next(); ok {
+				t.Errorf("unexpected packet %x", pkt.Data)
+			}
+		})
+	}
+}
+
+func TestH265VideoChannel(t *testing.T) {
+	video := "m=video 0 RTP/AVP 96\r\na=rtpmap:96 H265/90000\r\na=control:trackID=1\r\n"
+	audio := "m=audio 0 RTP/AVP 8\r\na=rtpmap:8 PCMA/8000\r\na=control:trackID=2\r\n"
+	session := "v=0\r\ns=Camera\r\n"
+	tests := []struct {
+		name    string
+		sdp     string
+		channel byte
+	}{
+		{name: "video only", sdp: session + video, channel: 0},
+		{name: "video first", sdp: session + video + audio, channel: 0},
+		{name: "audio first", sdp: session + audio + video, channel: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if channel := h265VideoChannel([]byte(test.sdp)); channel != test.channel {
+				t.Errorf("channel %d, expected %d", channel, test.channel)
+			}
+		})
+	}
+}
@@ -2,7 +2,7 @@ package capture
 
 import (
 	"strconv"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kerberos-io/agent/machinery/src/log"
@@ -11,7 +11,6 @@ import (
 
 	"github.com/kerberos-io/joy4/av"
 	"github.com/kerberos-io/joy4/av/avutil"
-	"github.com/kerberos-io/joy4/cgo/ffmpeg"
 	"github.com/kerberos-io/joy4/format"
 )
 
@@ -22,33 +21,34 @@ func OpenRTSP(url string) (av.DemuxCloser, []av.CodecData, error) {
 		streams, errstreams := infile.Streams()
 		return infile, streams, errstreams
 	}
-	return nil, []av.CodecData{}, err
-}
 
-func GetVideoDecoder(streams []av.CodecData) *ffmpeg.VideoDecoder {
-	// Load video codec
-	var vstream av.VideoCodecData
-	for _, stream := range streams {
-		if stream.Type().IsAudio() {
-			//astream := stream.(av.AudioCodecData)
-		} else if stream.Type().IsVideo() {
-			vstream = stream.(av.VideoCodecData)
-		}
+	// The RTSP client of joy4 doesn't support H265, so we try again
+	// with the H265 client.
+	h265file, h265streams, h265err := OpenRTSPH265(url)
+	if h265err == nil {
+		return h265file, h265streams, nil
 	}
-	dec, _ := ffmpeg.NewVideoDecoder(vstream)
-	return dec
+	log.Log.Debug("OpenRTSP: " + h265err.Error())
+	return nil, []av.CodecData{}, err
 }
 
-func DecodeImage(pkt av.Packet, decoder *ffmpeg.VideoDecoder, decoderMutex *sync.Mutex) (*ffmpeg.VideoFrame, error) {
-	decoderMutex.Lock()
-	img, err := decoder.Decode(pkt.Data)
-	decoderMutex.Unlock()
-	return img, err
+func HandleStream(infile av.DemuxCloser, queue *pubsub.Queue, communication *models.Communication) { //, wg *sync.WaitGroup) {
+	log.Log.Debug("HandleStream: started")
+	readStream(infile, queue, communication.HandleStream, communication.PackageCounter)
+	log.Log.Debug("HandleStream: finished")
 }
 
-func HandleStream(infile av.DemuxCloser, queue *pubsub.Queue, communication *models.Communication) { //, wg *sync.WaitGroup) {
+// HandleSubStream reads the substream of a camera into its own queue, the substream
+// isn't used to check if the camera is still operational.
+func HandleSubStream(infile av.DemuxCloser, queue *pubsub.Queue, communication *models.Communication) {
+	log.Log.Debug("HandleSubStream: started")
+	readStream(infile, queue, communication.HandleSubStream, nil)
+	log.Log.Debug("HandleSubStream: finished")
+}
 
-	log.Log.Debug("HandleStream: started")
+// readStream writes the packets of a stream into a queue, until it's stopped. For every
+// keyframe the package counter (if any) is incremented.
+func readStream(infile av.DemuxCloser, queue *pubsub.Queue, stop chan string, packageCounter *atomic.Value) {
 	var err error
 loop:
 	for {
@@ -56,7 +56,7 @@ loop:
 		// This will check if we need to stop the thread,
 		// because of a reconfiguration.
 		select {
-		case <-communication.HandleStream:
+		case <-stop:
 			break loop
 		default:
 		}
@@ -77,22 +77,21 @@ loop:
 			// This will check if we need to stop the thread,
 			// because of a reconfiguration.
 			select {
-			case <-communication.HandleStream:
+			case <-stop:
 				break loop
 			default:
 			}
 
-			if pkt.IsKeyFrame {
+			if pkt.IsKeyFrame && packageCounter != nil {
 
 				// Increment packets, so we know the device
 				// is not blocking.
-				r := communication.PackageCounter.Load().(int64)
+				r := packageCounter.Load().(int64)
 				log.Log.Info("HandleStream: packet size " + strconv.Itoa(len(pkt.Data)))
-				communication.PackageCounter.Store((r + 1) % 1000)
+				packageCounter.Store((r + 1) % 1000)
 			}
 		}
 	}
 
 	queue.Close()
-	log.Log.Debug("HandleStream: finished")
 }
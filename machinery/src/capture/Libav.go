@@ -0,0 +1,314 @@
+package capture
+
+/*
+#cgo LDFLAGS: -lavcodec -lavutil -lswscale
+#include <stdlib.h>
+#include <libavcodec/avcodec.h>
+#include <libavutil/imgutils.h>
+#include <libavutil/opt.h>
+#include <libswscale/swscale.h>
+
+static int libav_again(int err) {
+	return err == AVERROR(EAGAIN) || err == AVERROR_EOF;
+}
+*/
+import "C"
+import (
+	"errors"
+	"image"
+	"strconv"
+	"unsafe"
+)
+
+// The ffmpeg bindings of joy4 only decode H264, and their encoder only accepts frames
+// which are decoded by the bindings. This is a small binding of the same (linked) libav
+// libraries, to decode other codecs (H265, MJPEG and raw frames) and to encode images
+// to H264.
+
+// The decoder may read beyond the data of a packet.
+const libavPadding = C.AV_INPUT_BUFFER_PADDING_SIZE
+
+// libavDecoder decodes frames to YUV420 images.
+type libavDecoder struct {
+	context *C.AVCodecContext
+	frame   *C.AVFrame
+	packet  *C.AVPacket
+	yuv     *C.AVFrame
+	scaler  *C.struct_SwsContext
+}
+
+// newLibavDecoder opens a decoder by its name (e.g. hevc, mjpeg or rawvideo). Raw frames
+// don't describe themselves, for those the resolution and pixel format (e.g. yuyv422)
+// are required.
+func newLibavDecoder(codec string, width int, height int, pixelFormat string) (*libavDecoder, error) {
+	name := C.CString(codec)
+	defer C.free(unsafe.Pointer(name))
+	decoder := C.avcodec_find_decoder_by_name(name)
+	if decoder == nil {
+		return nil, errors.New("newLibavDecoder: no " + codec + " decoder available")
+	}
+	d := &libavDecoder{
+		context: C.avcodec_alloc_context3(decoder),
+		frame:   C.av_frame_alloc(),
+		packet:  C.av_packet_alloc(),
+	}
+	if d.context == nil || d.frame == nil || d.packet == nil {
+		d.Close()
+		return nil, errors.New("newLibavDecoder: could not allocate the " + codec + " decoder")
+	}
+	d.context.width = C.int(width)
+	d.context.height = C.int(height)
+	if pixelFormat != "" {
+		format := C.CString(pixelFormat)
+		defer C.free(unsafe.Pointer(format))
+		d.context.pix_fmt = C.av_get_pix_fmt(format)
+	}
+	// A frame should be returned as soon as its packet is decoded.
+	d.context.thread_count = 1
+	d.context.flags |= C.AV_CODEC_FLAG_LOW_DELAY
+	if C.avcodec_open2(d.context, decoder, nil) < 0 {
+		d.Close()
+		return nil, errors.New("newLibavDecoder: could not open the " + codec + " decoder")
+	}
+	return d, nil
+}
+
+// Decode decodes the data of a frame, the image is nil if the decoder needs more data.
+func (d *libavDecoder) Decode(data []byte) (*image.YCbCr, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	buffer := C.av_mallocz(C.size_t(len(data) + libavPadding))
+	if buffer == nil {
+		return nil, errors.New("Decode: could not allocate a packet")
+	}
+	defer C.av_free(buffer)
+	copy(unsafe.Slice((*byte)(buffer), len(data)), data)
+
+	// The packet isn't reference counted, so the decoder makes a copy of the data.
+	d.packet.data = (*C.uint8_t)(buffer)
+	d.packet.size = C.int(len(data))
+	ret := C.avcodec_send_packet(d.context, d.packet)
+	d.packet.data = nil
+	d.packet.size = 0
+	if ret < 0 && C.libav_again(ret) == 0 {
+		return nil, errors.New("Decode: could not decode the frame (" + strconv.Itoa(int(ret)) + ")")
+	}
+
+	var img *image.YCbCr
+	for {
+		ret := C.avcodec_receive_frame(d.context, d.frame)
+		if C.libav_again(ret) != 0 {
+			return img, nil
+		} else if ret < 0 {
+			return nil, errors.New("Decode: could not decode the frame (" + strconv.Itoa(int(ret)) + ")")
+		}
+		var err error
+		img, err = d.convert(d.frame)
+		C.av_frame_unref(d.frame)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// convert copies a decoded frame to an image, frames which aren't YUV420 are converted.
+func (d *libavDecoder) convert(frame *C.AVFrame) (*image.YCbCr, error) {
+	src := frame
+	if frame.format != C.AV_PIX_FMT_YUV420P {
+		if d.yuv == nil || d.yuv.width != frame.width || d.yuv.height != frame.height {
+			C.av_frame_free(&d.yuv)
+			d.yuv = newLibavFrame(int(frame.width), int(frame.height))
+			if d.yuv == nil {
+				return nil, errors.New("convert: could not allocate a frame")
+			}
+		}
+		d.scaler = C.sws_getCachedContext(d.scaler,
+			frame.width, frame.height, C.enum_AVPixelFormat(frame.format),
+			d.yuv.width, d.yuv.height, C.AV_PIX_FMT_YUV420P,
+			C.SWS_BILINEAR, nil, nil, nil)
+		if d.scaler == nil {
+			return nil, errors.New("convert: unsupported pixel format " + strconv.Itoa(int(frame.format)))
+		}
+		C.sws_scale(d.scaler, &frame.data[0], &frame.linesize[0], 0, frame.height, &d.yuv.data[0], &d.yuv.linesize[0])
+		src = d.yuv
+	}
+
+	width, height := int(frame.width), int(frame.height)
+	img := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	copyFromPlane(img.Y, img.YStride, src.data[0], src.linesize[0], width, height)
+	copyFromPlane(img.Cb, img.CStride, src.data[1], src.linesize[1], (width+1)/2, (height+1)/2)
+	copyFromPlane(img.Cr, img.CStride, src.data[2], src.linesize[2], (width+1)/2, (height+1)/2)
+	return img, nil
+}
+
+// Close releases the decoder.
+func (d *libavDecoder) Close() {
+	C.avcodec_free_context(&d.context)
+	C.av_frame_free(&d.frame)
+	C.av_frame_free(&d.yuv)
+	C.av_packet_free(&d.packet)
+	C.sws_freeContext(d.scaler)
+	d.scaler = nil
+}
+
+// libavEncoder encodes YUV420 images to H264. The parameter sets are repeated before
+// every keyframe, so a stream can be joined at any keyframe.
+type libavEncoder struct {
+	context *C.AVCodecContext
+	frame   *C.AVFrame
+	input   *C.AVFrame
+	packet  *C.AVPacket
+	scaler  *C.struct_SwsContext
+	pts     int64
+}
+
+// newLibavEncoder opens an H264 encoder, with a keyframe every second. Images of another
+// resolution are scaled to the resolution of the encoder.
+func newLibavEncoder(width int, height int, fps int) (*libavEncoder, error) {
+	name := C.CString("libx264")
+	defer C.free(unsafe.Pointer(name))
+	encoder := C.avcodec_find_encoder_by_name(name)
+	if encoder == nil {
+		encoder = C.avcodec_find_encoder(C.AV_CODEC_ID_H264)
+	}
+	if encoder == nil {
+		return nil, errors.New("newLibavEncoder: no H264 encoder available")
+	}
+	// H264 requires an even resolution.
+	width, height = width&^1, height&^1
+	if width <= 0 || height <= 0 || fps <= 0 {
+		return nil, errors.New("newLibavEncoder: invalid resolution or frame rate")
+	}
+	e := &libavEncoder{
+		context: C.avcodec_alloc_context3(encoder),
+		packet:  C.av_packet_alloc(),
+		frame:   newLibavFrame(width, height),
+	}
+	if e.context == nil || e.frame == nil || e.packet == nil {
+		e.Close()
+		return nil, errors.New("newLibavEncoder: could not allocate the encoder")
+	}
+	e.context.width = C.int(width)
+	e.context.height = C.int(height)
+	e.context.pix_fmt = C.AV_PIX_FMT_YUV420P
+	e.context.time_base = C.AVRational{num: 1, den: C.int(fps)}
+	e.context.framerate = C.AVRational{num: C.int(fps), den: 1}
+	e.context.gop_size = C.int(fps)
+	e.context.max_b_frames = 0
+	for key, value := range map[string]string{"preset": "ultrafast", "tune": "zerolatency"} {
+		k, v := C.CString(key), C.CString(value)
+		C.av_opt_set(e.context.priv_data, k, v, 0)
+		C.free(unsafe.Pointer(k))
+		C.free(unsafe.Pointer(v))
+	}
+	if C.avcodec_open2(e.context, encoder, nil) < 0 {
+		e.Close()
+		return nil, errors.New("newLibavEncoder: could not open the H264 encoder")
+	}
+	return e, nil
+}
+
+// Encode encodes an image, and returns the encoded frames as Annex B streams. The
+// encoder can return zero or more frames for an image.
+func (e *libavEncoder) Encode(img *image.YCbCr) ([][]byte, error) {
+	if img.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return nil, errors.New("Encode: only YUV420 images can be encoded")
+	}
+	if C.av_frame_make_writable(e.frame) < 0 {
+		return nil, errors.New("Encode: frame isn't writable")
+	}
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	if width == int(e.frame.width) && height == int(e.frame.height) {
+		copyToFrame(e.frame, img)
+	} else {
+		if e.input == nil || int(e.input.width) != width || int(e.input.height) != height {
+			C.av_frame_free(&e.input)
+			e.input = newLibavFrame(width, height)
+			if e.input == nil {
+				return nil, errors.New("Encode: could not allocate a frame")
+			}
+		}
+		if C.av_frame_make_writable(e.input) < 0 {
+			return nil, errors.New("Encode: frame isn't writable")
+		}
+		copyToFrame(e.input, img)
+		e.scaler = C.sws_getCachedContext(e.scaler,
+			e.input.width, e.input.height, C.AV_PIX_FMT_YUV420P,
+			e.frame.width, e.frame.height, C.AV_PIX_FMT_YUV420P,
+			C.SWS_BILINEAR, nil, nil, nil)
+		if e.scaler == nil {
+			return nil, errors.New("Encode: could not scale the image")
+		}
+		C.sws_scale(e.scaler, &e.input.data[0], &e.input.linesize[0], 0, e.input.height, &e.frame.data[0], &e.frame.linesize[0])
+	}
+	e.frame.pts = C.int64_t(e.pts)
+	e.pts++
+
+	if ret := C.avcodec_send_frame(e.context, e.frame); ret < 0 {
+		return nil, errors.New("Encode: could not encode the frame (" + strconv.Itoa(int(ret)) + ")")
+	}
+	var frames [][]byte
+	for {
+		ret := C.avcodec_receive_packet(e.context, e.packet)
+		if C.libav_again(ret) != 0 {
+			return frames, nil
+		} else if ret < 0 {
+			return nil, errors.New("Encode: could not encode the frame (" + strconv.Itoa(int(ret)) + ")")
+		}
+		frames = append(frames, C.GoBytes(unsafe.Pointer(e.packet.data), e.packet.size))
+		C.av_packet_unref(e.packet)
+	}
+}
+
+// Close releases the encoder.
+func (e *libavEncoder) Close() {
+	C.avcodec_free_context(&e.context)
+	C.av_frame_free(&e.frame)
+	C.av_frame_free(&e.input)
+	C.av_packet_free(&e.packet)
+	C.sws_freeContext(e.scaler)
+	e.scaler = nil
+}
+
+// newLibavFrame allocates a YUV420 frame, nil is returned if it can't be allocated.
+func newLibavFrame(width int, height int) *C.AVFrame {
+	frame := C.av_frame_alloc()
+	if frame == nil {
+		return nil
+	}
+	frame.format = C.AV_PIX_FMT_YUV420P
+	frame.width = C.int(width)
+	frame.height = C.int(height)
+	if C.av_frame_get_buffer(frame, 32) < 0 {
+		C.av_frame_free(&frame)
+		return nil
+	}
+	return frame
+}
+
+// copyToFrame copies the planes of an image to a YUV420 frame of the same resolution.
+func copyToFrame(frame *C.AVFrame, img *image.YCbCr) {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	y := img.Y[img.YOffset(img.Rect.Min.X, img.Rect.Min.Y):]
+	c := img.COffset(img.Rect.Min.X, img.Rect.Min.Y)
+	copyToPlane(frame.data[0], frame.linesize[0], y, img.YStride, width, height)
+	copyToPlane(frame.data[1], frame.linesize[1], img.Cb[c:], img.CStride, (width+1)/2, (height+1)/2)
+	copyToPlane(frame.data[2], frame.linesize[2], img.Cr[c:], img.CStride, (width+1)/2, (height+1)/2)
+}
+
+// copyFromPlane copies the rows of a plane of a frame, the strides can differ.
+func copyFromPlane(dst []byte, dstStride int, src *C.uint8_t, srcStride C.int, width int, height int) {
+	for row := 0; row < height; row++ {
+		line := unsafe.Add(unsafe.Pointer(src), row*int(srcStride))
+		copy(dst[row*dstStride:row*dstStride+width], unsafe.Slice((*byte)(line), width))
+	}
+}
+
+// copyToPlane copies rows to a plane of a frame, the strides can differ.
+func copyToPlane(dst *C.uint8_t, dstStride C.int, src []byte, srcStride int, width int, height int) {
+	for row := 0; row < height; row++ {
+		line := unsafe.Add(unsafe.Pointer(dst), row*int(dstStride))
+		copy(unsafe.Slice((*byte)(line), width), src[row*srcStride:row*srcStride+width])
+	}
+}
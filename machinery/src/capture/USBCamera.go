@@ -1,55 +1,301 @@
 package capture
 
 import (
+	"errors"
+	"image"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/kerberos-io/agent/machinery/src/log"
-	"gocv.io/x/gocv"
+	"github.com/kerberos-io/joy4/av"
+	"github.com/kerberos-io/joy4/codec/h264parser"
+	"github.com/kerberos-io/joy4/format/mp4"
 )
 
-func TestUSBCamera(deviceID string) {
-	webcam, err := gocv.OpenVideoCapture(deviceID)
+// The NALU types we need, note that the SPS and PPS constants of h264parser are swapped.
+const (
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+)
+
+// Time we wait for the first keyframe of the device.
+const usbCameraStartTimeout = 10 * time.Second
+
+// The frame rate of the encoder, if the frame rate of the device isn't configured.
+const usbCameraFramerate = 25
+
+// USBCamera is a demuxer for a USB (or Raspberry Pi) camera. The frames are read through
+// V4L2, if the camera can't deliver H264 itself the MJPEG or raw frames are encoded with
+// libav. The H264 access units are converted to packets, so the camera can be used as any
+// other stream.
+type USBCamera struct {
+	readAccessUnit func() ([][]byte, error)
+	close          func() error
+	closeOnce      sync.Once
+	streams        []av.CodecData
+	start          time.Time
+	pending        []av.Packet
+	sps            []byte
+	pps            []byte
+}
+
+// OpenUSBCamera opens a video device (/dev/video*), the width, height and fps are
+// optional (0), in that case the defaults of the device are used.
+func OpenUSBCamera(device string, width int, height int, fps int) (av.DemuxCloser, []av.CodecData, error) {
+	camera := &USBCamera{}
+
+	pixelFormat, err := V4L2PixelFormat(device)
 	if err != nil {
-		log.Log.Error("Error opening video capture device: " + deviceID)
-		return
+		return nil, []av.CodecData{}, err
+	}
+	v4l2, err := OpenV4L2(device, pixelFormat, width, height, fps)
+	if err != nil {
+		return nil, []av.CodecData{}, err
+	}
+	if pixelFormat == "H264" {
+		log.Log.Info("OpenUSBCamera: " + device + " supports H264, reading it through V4L2.")
+		camera.readAccessUnit = func() ([][]byte, error) {
+			frame, err := v4l2.ReadFrame()
+			if err != nil {
+				return nil, err
+			}
+			nalus, _ := h264parser.SplitNALUs(frame)
+			return nalus, nil
+		}
+		camera.close = v4l2.Close
+	} else {
+		log.Log.Info("OpenUSBCamera: " + device + " doesn't support H264, encoding " + pixelFormat + " with libav.")
+		encoder, err := newUSBEncoder(v4l2, pixelFormat, fps)
+		if err != nil {
+			v4l2.Close()
+			return nil, []av.CodecData{}, err
+		}
+		camera.readAccessUnit = encoder.ReadAccessUnit
+		camera.close = encoder.Close
 	}
-	defer webcam.Close()
-	buf := gocv.NewMat()
-	defer buf.Close()
 
-	ok := webcam.Read(&buf)
+	// We need the SPS and PPS to create the codec data, and the first packet should
+	// be a keyframe. If the device doesn't deliver within time, the device is closed.
+	timer := time.AfterFunc(usbCameraStartTimeout, func() {
+		camera.Close()
+	})
+	defer timer.Stop()
+	camera.start = time.Now()
+	for {
+		pkt, ok, err := camera.readPacket()
+		if err != nil {
+			camera.Close()
+			return nil, []av.CodecData{}, errors.New("OpenUSBCamera: no keyframe received from " + device + ", " + err.Error())
+		}
+		if ok && pkt.IsKeyFrame && camera.sps != nil && camera.pps != nil {
+			camera.pending = append(camera.pending, pkt)
+			break
+		}
+	}
 
-	if ok {
+	codec, err := h264parser.NewCodecDataFromSPSAndPPS(camera.sps, camera.pps)
+	if err != nil {
+		camera.Close()
+		return nil, []av.CodecData{}, err
+	}
+	camera.streams = []av.CodecData{codec}
+	log.Log.Info("OpenUSBCamera: opened " + device + " (" + strconv.Itoa(codec.Width()) + "x" + strconv.Itoa(codec.Height()) + ")")
+	return camera, camera.streams, nil
+}
 
-		now := time.Now().Unix()
-		saveFile := "./data/capture-test/" + strconv.FormatInt(now, 10) + ".mp4"
-		fps := 20.0 // webcam.Get(gocv.VideoCaptureFPS)
-		writer, err := gocv.VideoWriterFile(saveFile, "X264", fps, buf.Cols(), buf.Rows(), true)
-		if err != nil {
-			log.Log.Error("error opening video writer device: " + saveFile)
-			return
+// usbEncoder encodes the MJPEG or raw (YUYV) frames of a device to H264.
+type usbEncoder struct {
+	mutex   sync.Mutex
+	device  *V4L2Device
+	decoder *libavDecoder
+	encoder *libavEncoder
+	frames  [][]byte
+}
+
+func newUSBEncoder(device *V4L2Device, pixelFormat string, fps int) (*usbEncoder, error) {
+	if fps <= 0 {
+		fps = usbCameraFramerate
+	}
+	var decoder *libavDecoder
+	var err error
+	if pixelFormat == "MJPG" {
+		decoder, err = newLibavDecoder("mjpeg", device.Width, device.Height, "")
+	} else {
+		decoder, err = newLibavDecoder("rawvideo", device.Width, device.Height, "yuyv422")
+	}
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := newLibavEncoder(device.Width, device.Height, fps)
+	if err != nil {
+		decoder.Close()
+		return nil, err
+	}
+	return &usbEncoder{device: device, decoder: decoder, encoder: encoder}, nil
+}
+
+// ReadAccessUnit returns the NALUs of the next encoded frame.
+func (e *usbEncoder) ReadAccessUnit() ([][]byte, error) {
+	for {
+		e.mutex.Lock()
+		if e.decoder == nil {
+			e.mutex.Unlock()
+			return nil, errors.New("ReadAccessUnit: encoder closed")
+		}
+		if len(e.frames) > 0 {
+			frame := e.frames[0]
+			e.frames = e.frames[1:]
+			e.mutex.Unlock()
+			nalus, _ := h264parser.SplitNALUs(frame)
+			return nalus, nil
 		}
-		defer writer.Close()
+		e.mutex.Unlock()
 
-		//window := gocv.NewWindow("Hello")
-		log.Log.Info("Start reading device: " + deviceID)
-		for i := 0; i < 100; i++ {
-			if ok := webcam.Read(&buf); !ok {
-				log.Log.Error("Device closed: " + deviceID)
-				return
+		raw, err := e.device.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		e.mutex.Lock()
+		if e.decoder != nil {
+			var img *image.YCbCr
+			img, err = e.decoder.Decode(raw)
+			if err == nil && img != nil {
+				var frames [][]byte
+				frames, err = e.encoder.Encode(img)
+				e.frames = append(e.frames, frames...)
 			}
-			if buf.Empty() {
-				continue
+		}
+		e.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close releases the device, and waits until a frame which is encoded is done.
+func (e *usbEncoder) Close() error {
+	err := e.device.Close()
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.decoder != nil {
+		e.decoder.Close()
+		e.encoder.Close()
+		e.decoder, e.encoder = nil, nil
+	}
+	return err
+}
+
+// readPacket reads the next access unit, and converts it to a packet. The parameter sets
+// are kept, as the packets only contain the slices. If the access unit doesn't contain
+// a slice, ok is false.
+func (c *USBCamera) readPacket() (pkt av.Packet, ok bool, err error) {
+	nalus, err := c.readAccessUnit()
+	if err != nil {
+		return pkt, false, err
+	}
+	var data []byte
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch typ := nalu[0] & 0x1f; {
+		case typ == naluTypeSPS:
+			c.sps = append([]byte{}, nalu...)
+		case typ == naluTypePPS:
+			c.pps = append([]byte{}, nalu...)
+		case typ >= 1 && typ <= naluTypeIDR:
+			if typ == naluTypeIDR {
+				pkt.IsKeyFrame = true
 			}
+			size := len(nalu)
+			data = append(data, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+			data = append(data, nalu...)
+		}
+	}
+	if len(data) == 0 {
+		return pkt, false, nil
+	}
+	pkt.Data = data
+	pkt.Time = time.Since(c.start)
+	return pkt, true, nil
+}
 
-			writer.Write(buf)
-			//window.IMShow(buf)
-			//window.WaitKey(1)
+// Streams returns the codec data of the camera.
+func (c *USBCamera) Streams() ([]av.CodecData, error) {
+	return c.streams, nil
+}
 
-			log.Log.Info("Read frame")
+// ReadPacket returns the next packet of the camera.
+func (c *USBCamera) ReadPacket() (av.Packet, error) {
+	if len(c.pending) > 0 {
+		pkt := c.pending[0]
+		c.pending = c.pending[1:]
+		return pkt, nil
+	}
+	for {
+		pkt, ok, err := c.readPacket()
+		if err != nil {
+			return pkt, err
+		}
+		if ok {
+			return pkt, nil
 		}
+	}
+}
+
+// Close releases the device, and the encoder.
+func (c *USBCamera) Close() (err error) {
+	c.closeOnce.Do(func() {
+		err = c.close()
+	})
+	return err
+}
+
+// TestUSBCamera reads 100 packets of a video device, and writes them to a recording,
+// so a device can be tested (for example a v4l2loopback device in CI).
+func TestUSBCamera(deviceID string) {
+	infile, streams, err := OpenUSBCamera(deviceID, 0, 0, 0)
+	if err != nil {
+		log.Log.Error("Error opening video capture device: " + deviceID + ", " + err.Error())
+		return
+	}
+	defer infile.Close()
+
+	now := time.Now().Unix()
+	os.MkdirAll("./data/capture-test/", 0755)
+	saveFile := "./data/capture-test/" + strconv.FormatInt(now, 10) + ".mp4"
+	file, err := os.Create(saveFile)
+	if err != nil {
+		log.Log.Error("error opening recording file: " + saveFile)
+		return
+	}
+	defer file.Close()
+
+	myMuxer := mp4.NewMuxer(file)
+	if err := myMuxer.WriteHeader(streams); err != nil {
+		log.Log.Error("error writing header: " + err.Error())
+		return
+	}
+
+	log.Log.Info("Start reading device: " + deviceID)
+	for i := 0; i < 100; i++ {
+		pkt, err := infile.ReadPacket()
+		if err != nil {
+			log.Log.Error("Device closed: " + deviceID + ", " + err.Error())
+			break
+		}
+		if err := myMuxer.WritePacket(pkt); err != nil {
+			log.Log.Error("error writing packet: " + err.Error())
+			break
+		}
+		log.Log.Info("Read frame")
+	}
 
+	if err := myMuxer.WriteTrailer(); err != nil {
+		log.Log.Error("error writing trailer: " + err.Error())
 	}
-	log.Log.Info("Done. Close videocapture and recording file.")
+	log.Log.Info("Done. Close videocapture and recording file: " + saveFile)
 }
@@ -0,0 +1,353 @@
+package capture
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// A minimal V4L2 client, which captures frames from a video device using memory mapped
+// buffers. Only the structures and ioctls we need are defined, see linux/videodev2.h.
+
+const (
+	v4l2BufTypeVideoCapture = 1
+	v4l2MemoryMmap          = 1
+	v4l2FieldAny            = 0
+	v4l2CapVideoCapture     = 0x00000001
+	v4l2CapStreaming        = 0x04000000
+	v4l2CapDeviceCaps       = 0x80000000
+	v4l2NumberOfBuffers     = 4
+)
+
+// The pixel formats we can read, in order of preference. MJPEG and YUYV are encoded
+// to H264 with libav.
+var v4l2PixelFormats = []string{"H264", "MJPG", "YUYV"}
+
+type v4l2Capability struct {
+	Driver       [16]uint8
+	Card         [32]uint8
+	BusInfo      [32]uint8
+	Version      uint32
+	Capabilities uint32
+	DeviceCaps   uint32
+	Reserved     [3]uint32
+}
+
+type v4l2FmtDesc struct {
+	Index       uint32
+	Type        uint32
+	Flags       uint32
+	Description [32]uint8
+	PixelFormat uint32
+	MbusCode    uint32
+	Reserved    [3]uint32
+}
+
+type v4l2PixFormat struct {
+	Width        uint32
+	Height       uint32
+	PixelFormat  uint32
+	Field        uint32
+	BytesPerLine uint32
+	SizeImage    uint32
+	Colorspace   uint32
+	Priv         uint32
+	Flags        uint32
+	YcbcrEnc     uint32
+	Quantization uint32
+	XferFunc     uint32
+}
+
+// The format union contains pointers, so it's aligned on the size of a pointer.
+type v4l2Format struct {
+	Type uint32
+	_    [unsafe.Sizeof(uintptr(0)) - 4]uint8
+	Pix  v4l2PixFormat
+	_    [200 - unsafe.Sizeof(v4l2PixFormat{})]uint8
+}
+
+type v4l2Fract struct {
+	Numerator   uint32
+	Denominator uint32
+}
+
+type v4l2CaptureParm struct {
+	Capability   uint32
+	CaptureMode  uint32
+	TimePerFrame v4l2Fract
+	ExtendedMode uint32
+	ReadBuffers  uint32
+	Reserved     [4]uint32
+}
+
+type v4l2StreamParm struct {
+	Type    uint32
+	Capture v4l2CaptureParm
+	_       [200 - unsafe.Sizeof(v4l2CaptureParm{})]uint8
+}
+
+type v4l2RequestBuffers struct {
+	Count    uint32
+	Type     uint32
+	Memory   uint32
+	Reserved [2]uint32
+}
+
+type v4l2Timecode struct {
+	Type     uint32
+	Flags    uint32
+	Frames   uint8
+	Seconds  uint8
+	Minutes  uint8
+	Hours    uint8
+	UserBits [4]uint8
+}
+
+type v4l2Buffer struct {
+	Index     uint32
+	Type      uint32
+	BytesUsed uint32
+	Flags     uint32
+	Field     uint32
+	Timestamp syscall.Timeval
+	Timecode  v4l2Timecode
+	Sequence  uint32
+	Memory    uint32
+	Offset    uintptr // union of offset, userptr, planes and fd.
+	Length    uint32
+	Reserved2 uint32
+	RequestFD uint32
+}
+
+func ioc(dir uintptr, nr uintptr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | uintptr('V')<<8 | nr
+}
+
+var (
+	vidiocQueryCap  = ioc(2, 0, unsafe.Sizeof(v4l2Capability{}))
+	vidiocEnumFmt   = ioc(3, 2, unsafe.Sizeof(v4l2FmtDesc{}))
+	vidiocSetFmt    = ioc(3, 5, unsafe.Sizeof(v4l2Format{}))
+	vidiocReqBufs   = ioc(3, 8, unsafe.Sizeof(v4l2RequestBuffers{}))
+	vidiocQueryBuf  = ioc(3, 9, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocQBuf      = ioc(3, 15, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocDQBuf     = ioc(3, 17, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocStreamOn  = ioc(1, 18, unsafe.Sizeof(int32(0)))
+	vidiocStreamOff = ioc(1, 19, unsafe.Sizeof(int32(0)))
+	vidiocSetParm   = ioc(3, 22, unsafe.Sizeof(v4l2StreamParm{}))
+)
+
+func fourcc(code string) uint32 {
+	return uint32(code[0]) | uint32(code[1])<<8 | uint32(code[2])<<16 | uint32(code[3])<<24
+}
+
+func ioctl(fd int, request uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg))
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// V4L2Device is a video device which is streaming, frames are read with ReadFrame.
+// The mutex is held while a frame is read, so Close can wait for the reader before
+// the buffers are unmapped. The wakeup pipe interrupts a reader waiting for a frame.
+type V4L2Device struct {
+	Width   int
+	Height  int
+	mutex   sync.Mutex
+	fd      int
+	wakeup  [2]int
+	buffers [][]byte
+	closed  int32
+}
+
+// V4L2PixelFormat returns the preferred pixel format (H264, MJPG or YUYV) of the device.
+func V4L2PixelFormat(device string) (string, error) {
+	fd, err := syscall.Open(device, syscall.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(fd)
+	supported := map[uint32]bool{}
+	for i := uint32(0); ; i++ {
+		desc := v4l2FmtDesc{Index: i, Type: v4l2BufTypeVideoCapture}
+		if err := ioctl(fd, vidiocEnumFmt, unsafe.Pointer(&desc)); err != nil {
+			break
+		}
+		supported[desc.PixelFormat] = true
+	}
+	for _, format := range v4l2PixelFormats {
+		if supported[fourcc(format)] {
+			return format, nil
+		}
+	}
+	return "", errors.New("V4L2PixelFormat: " + device + " doesn't support H264, MJPG or YUYV")
+}
+
+// OpenV4L2 opens a video device and starts streaming frames of a pixel format. The width,
+// height and fps are optional (0), in that case the defaults of the device are used.
+func OpenV4L2(device string, pixelFormat string, width int, height int, fps int) (*V4L2Device, error) {
+	fd, err := syscall.Open(device, syscall.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := &V4L2Device{fd: fd}
+	if err := syscall.Pipe2(d.wakeup[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(fd)
+		return nil, errors.New("OpenV4L2: " + device + ", " + err.Error())
+	}
+	if err := d.setup(fourcc(pixelFormat), width, height, fps); err != nil {
+		d.Close()
+		return nil, errors.New("OpenV4L2: " + device + ", " + err.Error())
+	}
+	return d, nil
+}
+
+func (d *V4L2Device) setup(pixelFormat uint32, width int, height int, fps int) error {
+	var capability v4l2Capability
+	if err := ioctl(d.fd, vidiocQueryCap, unsafe.Pointer(&capability)); err != nil {
+		return errors.New("not a V4L2 device, " + err.Error())
+	}
+	caps := capability.Capabilities
+	if caps&v4l2CapDeviceCaps != 0 {
+		caps = capability.DeviceCaps
+	}
+	if caps&v4l2CapVideoCapture == 0 || caps&v4l2CapStreaming == 0 {
+		return errors.New("device doesn't support video capture streaming")
+	}
+
+	format := v4l2Format{Type: v4l2BufTypeVideoCapture}
+	format.Pix.Width = uint32(width)
+	format.Pix.Height = uint32(height)
+	format.Pix.PixelFormat = pixelFormat
+	format.Pix.Field = v4l2FieldAny
+	if err := ioctl(d.fd, vidiocSetFmt, unsafe.Pointer(&format)); err != nil {
+		return errors.New("could not set the pixel format, " + err.Error())
+	}
+	if format.Pix.PixelFormat != pixelFormat {
+		return errors.New("device doesn't support the pixel format")
+	}
+	// The device can adjust the resolution to the one which is closest.
+	d.Width, d.Height = int(format.Pix.Width), int(format.Pix.Height)
+
+	if fps > 0 {
+		parm := v4l2StreamParm{Type: v4l2BufTypeVideoCapture}
+		parm.Capture.TimePerFrame = v4l2Fract{Numerator: 1, Denominator: uint32(fps)}
+		// Not all devices support setting the framerate, so we ignore the error.
+		ioctl(d.fd, vidiocSetParm, unsafe.Pointer(&parm))
+	}
+
+	request := v4l2RequestBuffers{
+		Count:  v4l2NumberOfBuffers,
+		Type:   v4l2BufTypeVideoCapture,
+		Memory: v4l2MemoryMmap,
+	}
+	if err := ioctl(d.fd, vidiocReqBufs, unsafe.Pointer(&request)); err != nil {
+		return errors.New("could not request buffers, " + err.Error())
+	}
+	if request.Count == 0 {
+		return errors.New("no buffers available")
+	}
+
+	for i := uint32(0); i < request.Count; i++ {
+		buffer := v4l2Buffer{Index: i, Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+		if err := ioctl(d.fd, vidiocQueryBuf, unsafe.Pointer(&buffer)); err != nil {
+			return errors.New("could not query buffer, " + err.Error())
+		}
+		data, err := syscall.Mmap(d.fd, int64(uint32(buffer.Offset)), int(buffer.Length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			return errors.New("could not map buffer, " + err.Error())
+		}
+		d.buffers = append(d.buffers, data)
+		if err := ioctl(d.fd, vidiocQBuf, unsafe.Pointer(&buffer)); err != nil {
+			return errors.New("could not queue buffer, " + err.Error())
+		}
+	}
+
+	bufferType := int32(v4l2BufTypeVideoCapture)
+	if err := ioctl(d.fd, vidiocStreamOn, unsafe.Pointer(&bufferType)); err != nil {
+		return errors.New("could not start streaming, " + err.Error())
+	}
+	return nil
+}
+
+// ReadFrame waits for the next frame of the device, and returns a copy of it.
+func (d *V4L2Device) ReadFrame() ([]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for atomic.LoadInt32(&d.closed) == 0 {
+		// Wait until a frame is available, or until the device is closed.
+		var fds syscall.FdSet
+		fdSet(&fds, d.fd)
+		fdSet(&fds, d.wakeup[0])
+		nfd := d.fd
+		if d.wakeup[0] > nfd {
+			nfd = d.wakeup[0]
+		}
+		n, err := syscall.Select(nfd+1, &fds, nil, nil, nil)
+		if err == syscall.EINTR || n == 0 {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if fdIsSet(&fds, d.wakeup[0]) {
+			break
+		}
+
+		buffer := v4l2Buffer{Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+		if err := ioctl(d.fd, vidiocDQBuf, unsafe.Pointer(&buffer)); err == syscall.EAGAIN {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if int(buffer.Index) >= len(d.buffers) {
+			return nil, errors.New("ReadFrame: invalid buffer index " + strconv.Itoa(int(buffer.Index)))
+		}
+		frame := make([]byte, buffer.BytesUsed)
+		copy(frame, d.buffers[buffer.Index][:buffer.BytesUsed])
+		if err := ioctl(d.fd, vidiocQBuf, unsafe.Pointer(&buffer)); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+	return nil, errors.New("ReadFrame: device closed")
+}
+
+// Close stops streaming and releases the device. A ReadFrame which is in progress is
+// interrupted, and Close waits until it returned before the buffers are unmapped.
+func (d *V4L2Device) Close() error {
+	if !atomic.CompareAndSwapInt32(&d.closed, 0, 1) {
+		return nil
+	}
+	syscall.Write(d.wakeup[1], []byte{0})
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	bufferType := int32(v4l2BufTypeVideoCapture)
+	ioctl(d.fd, vidiocStreamOff, unsafe.Pointer(&bufferType))
+	for _, buffer := range d.buffers {
+		syscall.Munmap(buffer)
+	}
+	d.buffers = nil
+	syscall.Close(d.wakeup[0])
+	syscall.Close(d.wakeup[1])
+	return syscall.Close(d.fd)
+}
+
+func fdSet(fds *syscall.FdSet, fd int) {
+	bits := int(unsafe.Sizeof(fds.Bits[0])) * 8
+	fds.Bits[fd/bits] |= 1 << (uint(fd) % uint(bits))
+}
+
+func fdIsSet(fds *syscall.FdSet, fd int) bool {
+	bits := int(unsafe.Sizeof(fds.Bits[0])) * 8
+	return fds.Bits[fd/bits]&(1<<(uint(fd)%uint(bits))) != 0
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package capture
+
+import "errors"
+
+// V4L2 is only available on Linux.
+
+// V4L2Device is a video device which is streaming, frames are read with ReadFrame.
+type V4L2Device struct {
+	Width  int
+	Height int
+}
+
+// V4L2PixelFormat returns the preferred pixel format (H264, MJPG or YUYV) of the device.
+func V4L2PixelFormat(device string) (string, error) {
+	return "", errors.New("V4L2PixelFormat: V4L2 is only supported on Linux")
+}
+
+// OpenV4L2 opens a video device and starts streaming frames of a pixel format.
+func OpenV4L2(device string, pixelFormat string, width int, height int, fps int) (*V4L2Device, error) {
+	return nil, errors.New("OpenV4L2: V4L2 is only supported on Linux")
+}
+
+// ReadFrame waits for the next frame of the device, and returns a copy of it.
+func (d *V4L2Device) ReadFrame() ([]byte, error) {
+	return nil, errors.New("ReadFrame: V4L2 is only supported on Linux")
+}
+
+// Close stops streaming and releases the device.
+func (d *V4L2Device) Close() error {
+	return nil
+}
@@ -2,16 +2,25 @@
 package capture
 
 import (
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/kerberos-io/agent/machinery/src/catalog"
+	"github.com/kerberos-io/agent/machinery/src/fmp4"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
 	"github.com/kerberos-io/agent/machinery/src/utils"
 	"github.com/kerberos-io/joy4/av/pubsub"
+	"github.com/kerberos-io/joy4/av/transcode"
 	"github.com/kerberos-io/joy4/format/mp4"
 
 	"github.com/kerberos-io/joy4/av"
@@ -40,7 +49,7 @@ func HandleRecordStream(recordingCursor *pubsub.QueueCursor, configuration *mode
 		timestamp = now
 		start := false
 		var name string
-		var myMuxer *mp4.Muxer
+		var myMuxer av.Muxer
 		var file *os.File
 		var err error
 
@@ -48,6 +57,8 @@ func HandleRecordStream(recordingCursor *pubsub.QueueCursor, configuration *mode
 		recordingPeriod = maxRecordingPeriod
 		// Recording file name
 		fullName := ""
+		var recording models.Recording
+		var firstPacketTime, lastPacketTime time.Duration
 
 		// Get as much packets we need.
 		//for pkt := range packets {
@@ -65,21 +76,7 @@ func HandleRecordStream(recordingCursor *pubsub.QueueCursor, configuration *mode
 				pkt.IsKeyFrame && (timestamp+recordingPeriod-now <= 0 || now-startRecording >= maxRecordingPeriod) {
 
 				// This will write the trailer a well.
-				if err := myMuxer.WriteTrailer(); err != nil {
-					log.Log.Error(err.Error())
-				}
-
-				log.Log.Info("HandleRecordStream: Recording finished: file save: " + name)
-				file.Close()
-
-				// Check if need to convert to fragmented using bento
-				if config.Capture.Fragmented == "true" && config.Capture.FragmentedDuration > 0 {
-					utils.CreateFragmentedMP4(fullName, config.Capture.FragmentedDuration)
-				}
-
-				// Create a symbol link.
-				fc, _ := os.Create("./data/cloud/" + name)
-				fc.Close()
+				CloseRecording(myMuxer, file, recording, firstPacketTime, lastPacketTime, config)
 
 				// Cleanup muxer
 				start = false
@@ -121,26 +118,30 @@ func HandleRecordStream(recordingCursor *pubsub.QueueCursor, configuration *mode
 				start = true
 				timestamp = now
 
-				// timestamp_microseconds_instanceName_regionCoordinates_numberOfChanges_token
-				// 1564859471_6-474162_oprit_577-283-727-375_1153_27.mp4
-				// - Timestamp
-				// - Size + - + microseconds
-				// - device
-				// - Region
-				// - Number of changes
-				// - Token
-
-				startRecording = time.Now().Unix() // we mark the current time when the record started.ss
-				s := strconv.FormatInt(startRecording, 10) + "_" + "6" + "-" + "967003" + "_" + config.Name + "_" + "200-200-400-400" + "_" + "24" + "_" + "769"
-				name = s + ".mp4"
+				// A continuous recording has no motion event, so there is
+				// no region or number of changes to add to its name.
+				startTime := time.Now()
+				startRecording = startTime.Unix() // we mark the current time when the record started.ss
+				name = CreateRecordingName(config.Name, models.MotionDataPartial{
+					Timestamp:    startRecording,
+					Microseconds: int64(startTime.Nanosecond() / 1000),
+				})
 				fullName = "./data/recordings/" + name
+				recording = models.Recording{
+					Name:      name,
+					Camera:    configuration.Camera,
+					Trigger:   models.TriggerContinuous,
+					Thumbnail: CreateThumbnail(name, configuration.Camera),
+				}
+				firstPacketTime = pkt.Time
+				lastPacketTime = pkt.Time
 
 				// Running...
 				log.Log.Info("Recording started")
 
 				file, err = os.Create(fullName)
 				if err == nil {
-					myMuxer = mp4.NewMuxer(file)
+					myMuxer = NewRecordingMuxer(file, config, streams)
 				}
 
 				log.Log.Info("HandleRecordStream: composing recording")
@@ -161,6 +162,7 @@ func HandleRecordStream(recordingCursor *pubsub.QueueCursor, configuration *mode
 				if err := myMuxer.WritePacket(pkt); err != nil {
 					log.Log.Error(err.Error())
 				}
+				lastPacketTime = pkt.Time
 			}
 		}
 
@@ -169,21 +171,7 @@ func HandleRecordStream(recordingCursor *pubsub.QueueCursor, configuration *mode
 		if cursorError != nil {
 			if recordingStatus == "started" {
 				// This will write the trailer a well.
-				if err := myMuxer.WriteTrailer(); err != nil {
-					log.Log.Error(err.Error())
-				}
-
-				log.Log.Info("HandleRecordStream: Recording finished: file save: " + name)
-				file.Close()
-
-				// Check if need to convert to fragmented using bento
-				if config.Capture.Fragmented == "true" && config.Capture.FragmentedDuration > 0 {
-					utils.CreateFragmentedMP4(fullName, config.Capture.FragmentedDuration)
-				}
-
-				// Create a symbol link.
-				fc, _ := os.Create("./data/cloud/" + name)
-				fc.Close()
+				CloseRecording(myMuxer, file, recording, firstPacketTime, lastPacketTime, config)
 
 				// Cleanup muxer
 				start = false
@@ -198,98 +186,292 @@ func HandleRecordStream(recordingCursor *pubsub.QueueCursor, configuration *mode
 
 		log.Log.Info("HandleRecordStream: Start motion based recording ")
 
-		var myMuxer *mp4.Muxer
+		var myMuxer av.Muxer
 		var file *os.File
 		var err error
 
-		for _ = range communication.HandleMotion {
-
-			now = time.Now().Unix()
-			timestamp = now
-			startRecording = now // we mark the current time when the record started.
-
-			// timestamp_microseconds_instanceName_regionCoordinates_numberOfChanges_token
-			// 1564859471_6-474162_oprit_577-283-727-375_1153_27.mp4
-			// - Timestamp
-			// - Size + - + microseconds
-			// - device
-			// - Region
-			// - Number of changes
-			// - Token
-
-			s := strconv.FormatInt(startRecording, 10) + "_" + "6" + "-" + "967003" + "_" + config.Name + "_" + "200-200-400-400" + "_" + "24" + "_" + "769"
-			name := s + ".mp4"
-			fullName := "./data/recordings/" + name
-
-			// Running...
-			log.Log.Info("HandleRecordStream: Recording started")
-			file, err = os.Create(fullName)
-			if err == nil {
-				myMuxer = mp4.NewMuxer(file)
-			}
+		// We keep a rolling buffer of packets, so the seconds before a motion
+		// event are written at the start of the recording. The buffer always
+		// starts with a keyframe, otherwise the recording can't be decoded.
+		preRecording := time.Duration(config.Capture.PreRecording) * time.Second
+		var preRecordingBuffer []av.Packet
+		log.Log.Info("HandleRecordStream: pre-recording buffer of " + preRecording.String())
 
-			start := false
+		start := false
+		motionDetected := false
+		var motionData models.MotionDataPartial
+		name := ""
+		fullName := ""
+		var recording models.Recording
+		var firstPacketTime, lastPacketTime time.Duration
 
-			log.Log.Info("HandleRecordStream: composing recording")
-			log.Log.Info("HandleRecordStream: write header")
-			// Creating the file, might block sometimes.
-			if err := myMuxer.WriteHeader(streams); err != nil {
-				log.Log.Error(err.Error())
-			}
+		var cursorError error
+		var pkt av.Packet
 
-			// Get as much packets we need.
-			//for pkt := range packets {
+		for cursorError == nil {
 
-			var cursorError error
-			var pkt av.Packet
+			pkt, cursorError = recordingCursor.ReadPacket()
+			if cursorError != nil {
+				log.Log.Error("HandleRecordStream: " + cursorError.Error())
+				break
+			}
 
-			for cursorError == nil {
+			now := time.Now().Unix()
+			select {
+			case motion := <-communication.HandleMotion:
+				timestamp = now
+				if !motionDetected && !start {
+					motionData = motion
+				}
+				motionDetected = true
+			default:
+			}
 
-				pkt, cursorError = recordingCursor.ReadPacket()
-				if cursorError != nil {
-					log.Log.Error("HandleRecordStream: " + cursorError.Error())
+			if !start {
+
+				// Not recording, so keep filling the pre-recording buffer until
+				// we receive a motion event.
+				preRecordingBuffer = BufferPreRecording(preRecordingBuffer, pkt, preRecording)
+				if !motionDetected || len(preRecordingBuffer) == 0 {
+					continue
 				}
 
-				now := time.Now().Unix()
-				select {
-				case <-communication.HandleMotion:
-					timestamp = now
-					log.Log.Info("HandleRecordStream: motion detected while recording. Expanding recording.")
-				default:
+				motionDetected = false
+				start = true
+				startRecording = now // we mark the current time when the record started.
+
+				// The motion event which triggered the recording, is
+				// encoded in the name of the recording.
+				name = CreateRecordingName(config.Name, motionData)
+				fullName = "./data/recordings/" + name
+				trigger := models.TriggerMotion
+				if motionData.Trigger != "" {
+					trigger = motionData.Trigger
 				}
-				if timestamp+recordingPeriod-now <= 0 || now-startRecording >= maxRecordingPeriod {
-					log.Log.Info("HandleRecordStream: closing recording (timestamp: " + strconv.FormatInt(timestamp, 10) + ", recordingPeriod: " + strconv.FormatInt(recordingPeriod, 10) + ", now: " + strconv.FormatInt(now, 10) + ", startRecording: " + strconv.FormatInt(startRecording, 10) + ", maxRecordingPeriod: " + strconv.FormatInt(maxRecordingPeriod, 10))
-					break
+				recording = models.Recording{
+					Name:            name,
+					Camera:          configuration.Camera,
+					Trigger:         trigger,
+					Region:          motionData.Rectangle,
+					NumberOfChanges: motionData.NumberOfChanges,
+					Zones:           motionData.Zones,
+					Blobs:           motionData.Blobs,
+					Labels:          motionData.Labels,
+					Thumbnail:       CreateThumbnail(name, configuration.Camera),
 				}
-				if pkt.IsKeyFrame {
-					log.Log.Info("HandleRecordStream: write frames")
-					start = true
+				firstPacketTime = preRecordingBuffer[0].Time
+				lastPacketTime = pkt.Time
+
+				// Running...
+				log.Log.Info("HandleRecordStream: Recording started")
+				file, err = os.Create(fullName)
+				if err == nil {
+					myMuxer = NewRecordingMuxer(file, config, streams)
 				}
-				if start {
-					if err := myMuxer.WritePacket(pkt); err != nil {
+
+				log.Log.Info("HandleRecordStream: composing recording")
+				log.Log.Info("HandleRecordStream: write header")
+				// Creating the file, might block sometimes.
+				if err := myMuxer.WriteHeader(streams); err != nil {
+					log.Log.Error(err.Error())
+				}
+
+				// Write the pre-recording, this includes the current packet.
+				log.Log.Info("HandleRecordStream: write pre-recording (" + strconv.Itoa(len(preRecordingBuffer)) + " packets)")
+				for _, bufferedPkt := range preRecordingBuffer {
+					if err := myMuxer.WritePacket(bufferedPkt); err != nil {
 						log.Log.Error(err.Error())
 					}
 				}
+				preRecordingBuffer = nil
+				continue
+			}
+
+			if motionDetected {
+				motionDetected = false
+				log.Log.Info("HandleRecordStream: motion detected while recording. Expanding recording.")
+			}
+
+			if timestamp+recordingPeriod-now <= 0 || now-startRecording >= maxRecordingPeriod {
+				log.Log.Info("HandleRecordStream: closing recording (timestamp: " + strconv.FormatInt(timestamp, 10) + ", recordingPeriod: " + strconv.FormatInt(recordingPeriod, 10) + ", now: " + strconv.FormatInt(now, 10) + ", startRecording: " + strconv.FormatInt(startRecording, 10) + ", maxRecordingPeriod: " + strconv.FormatInt(maxRecordingPeriod, 10))
+
+				// This will write the trailer as well.
+				CloseRecording(myMuxer, file, recording, firstPacketTime, lastPacketTime, config)
+				myMuxer = nil
+				runtime.GC()
+				debug.FreeOSMemory()
+
+				// Start buffering again, the current packet might already
+				// be the start of the next pre-recording.
+				start = false
+				preRecordingBuffer = BufferPreRecording(nil, pkt, preRecording)
+				continue
 			}
 
+			if err := myMuxer.WritePacket(pkt); err != nil {
+				log.Log.Error(err.Error())
+			}
+			lastPacketTime = pkt.Time
+		}
+
+		// We might have interrupted the recording while restarting the agent.
+		// If this happens we need to check to properly close the recording.
+		if start {
 			// This will write the trailer as well.
-			myMuxer.WriteTrailer()
-			log.Log.Info("HandleRecordStream:  file save: " + name)
-			file.Close()
+			CloseRecording(myMuxer, file, recording, firstPacketTime, lastPacketTime, config)
 			myMuxer = nil
 			runtime.GC()
 			debug.FreeOSMemory()
+		}
+	}
 
-			// Check if need to convert to fragmented using bento
-			if config.Capture.Fragmented == "true" && config.Capture.FragmentedDuration > 0 {
-				utils.CreateFragmentedMP4(fullName, config.Capture.FragmentedDuration)
-			}
+	log.Log.Debug("HandleRecordStream: finished")
+}
+
+// CloseRecording writes the trailer of a recording and closes the file. The recording
+// is added to the catalog, and queued for upload in ./data/cloud if a cloud is configured.
+func CloseRecording(myMuxer av.Muxer, file *os.File, recording models.Recording, firstPacketTime time.Duration, lastPacketTime time.Duration, config models.Config) {
+	if err := myMuxer.WriteTrailer(); err != nil {
+		log.Log.Error(err.Error())
+	}
+	// Release the audio transcoder, if any.
+	if closer, ok := myMuxer.(io.Closer); ok {
+		closer.Close()
+	}
+	log.Log.Info("HandleRecordStream: Recording finished: file save: " + recording.Name)
+	file.Close()
+
+	// The recording might contain a pre-recording, so the start is
+	// calculated from the duration of the recording.
+	recording.End = time.Now().UnixNano() / int64(time.Millisecond)
+	recording.Duration = int64((lastPacketTime - firstPacketTime) / time.Millisecond)
+	recording.Start = recording.End - recording.Duration
+	if fileInfo, err := os.Stat("./data/recordings/" + recording.Name); err == nil {
+		recording.Size = fileInfo.Size()
+	}
+	recording.Local = true
+	recording.Uploads = map[string]string{}
+	if config.Cloud != "" {
+		recording.Uploads[config.Cloud] = models.UploadPending
+	}
+	if err := catalog.Add(recording); err != nil {
+		log.Log.Error("HandleRecordStream: could not add recording to catalog, " + err.Error())
+	}
 
-			// Create a symbol linc.
-			fc, _ := os.Create("./data/cloud/" + name)
-			fc.Close()
+	// Create a symbol link, which is removed by the upload.
+	if config.Cloud != "" {
+		fc, _ := os.Create("./data/cloud/" + recording.Name)
+		fc.Close()
+	}
+}
+
+// CreateThumbnail copies the most recent snapshot of the motion detection, as the
+// thumbnail of a recording. It returns the path of the thumbnail, or an empty string
+// if no snapshot is available (e.g. for continuous recordings).
+func CreateThumbnail(name string, camera string) string {
+	snapshotsDirectory := utils.SnapshotsDirectory(camera)
+	entries, err := ioutil.ReadDir(snapshotsDirectory)
+	if err != nil {
+		return ""
+	}
+	var files []os.FileInfo
+	for _, f := range entries {
+		if !f.IsDir() {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return ""
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	snapshot, err := ioutil.ReadFile(snapshotsDirectory + files[0].Name())
+	if err != nil {
+		return ""
+	}
+	os.MkdirAll("./data/thumbnails", 0755)
+	thumbnail := "./data/thumbnails/" + strings.TrimSuffix(name, ".mp4") + filepath.Ext(files[0].Name())
+	if err := ioutil.WriteFile(thumbnail, snapshot, 0644); err != nil {
+		log.Log.Error("CreateThumbnail: " + err.Error())
+		return ""
+	}
+	return thumbnail
+}
+
+// NewRecordingMuxer creates the muxer of a recording. If fragmentation is enabled, the
+// recording is written as a fragmented mp4, otherwise as a regular mp4. The mp4 muxer
+// of joy4 doesn't support H265, so H265 is always written as a fragmented mp4.
+// G.711 audio can't be stored in an mp4, so it's transcoded to AAC.
+func NewRecordingMuxer(file *os.File, config models.Config, streams []av.CodecData) av.Muxer {
+	var muxer av.Muxer
+	fragmentedDuration := config.Capture.FragmentedDuration
+	if config.Capture.Fragmented == "true" && fragmentedDuration > 0 {
+		muxer = fmp4.NewMuxer(file, time.Duration(fragmentedDuration)*time.Second)
+	} else if HasH265(streams) {
+		if fragmentedDuration <= 0 {
+			fragmentedDuration = 8
 		}
+		muxer = fmp4.NewMuxer(file, time.Duration(fragmentedDuration)*time.Second)
+	} else {
+		muxer = mp4.NewMuxer(file)
 	}
 
-	log.Log.Debug("HandleRecordStream: finished")
+	if HasG711(streams) {
+		return &transcode.Muxer{
+			Muxer: muxer,
+			Options: transcode.Options{
+				FindAudioDecoderEncoder: G711ToAAC,
+			},
+		}
+	}
+	return muxer
+}
+
+// CreateRecordingName composes the name of a recording, which carries the metadata of
+// the event that triggered it. The format of the name is:
+//
+//	timestamp_microseconds_instanceName_regionCoordinates_numberOfChanges_token
+//	1564859471_6-474162_oprit_577-283-727-375_1153_27.mp4
+//
+// - Timestamp
+// - Size + - + microseconds
+// - device
+// - Region
+// - Number of changes
+// - Token, a random number to distinguish recordings started within the same second.
+func CreateRecordingName(instanceName string, motion models.MotionDataPartial) string {
+	microseconds := strconv.Itoa(utils.CountDigits(motion.Microseconds)) + "-" + strconv.FormatInt(motion.Microseconds, 10)
+	region := motion.Rectangle
+	regionCoordinates := strconv.Itoa(region.X1) + "-" + strconv.Itoa(region.Y1) + "-" + strconv.Itoa(region.X2) + "-" + strconv.Itoa(region.Y2)
+	numberOfChanges := strconv.Itoa(motion.NumberOfChanges)
+	token := strconv.Itoa(rand.Intn(1000))
+	// An underscore in the instance name would break parsing of the name.
+	instanceName = strings.ReplaceAll(instanceName, "_", "-")
+	return strconv.FormatInt(motion.Timestamp, 10) + "_" + microseconds + "_" + instanceName + "_" + regionCoordinates + "_" + numberOfChanges + "_" + token + ".mp4"
+}
+
+// BufferPreRecording appends a packet to the pre-recording buffer and drops the oldest
+// GOPs which are no longer needed to cover the pre-recording period. The buffer
+// always starts with a keyframe, so it can be written as the start of a recording.
+func BufferPreRecording(buffer []av.Packet, pkt av.Packet, preRecording time.Duration) []av.Packet {
+
+	// Wait for a keyframe before we start buffering.
+	if len(buffer) == 0 && !pkt.IsKeyFrame {
+		return buffer
+	}
+	buffer = append(buffer, pkt)
+
+	// Find the most recent keyframe which still covers the pre-recording
+	// period, everything before can be dropped.
+	cut := 0
+	for i := 1; i < len(buffer); i++ {
+		if buffer[i].IsKeyFrame && pkt.Time-buffer[i].Time >= preRecording {
+			cut = i
+		}
+	}
+	if cut > 0 {
+		buffer = append([]av.Packet(nil), buffer[cut:]...)
+	}
+	return buffer
 }
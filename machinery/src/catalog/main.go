@@ -0,0 +1,332 @@
+// Keeping a local index of all recordings, so they can be queried without reading
+// the recordings directory over and over again.
+package catalog
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// The recordings bucket maps the name of a recording to its entry, the time bucket
+	// is an index on the start time (big endian) followed by the name of the recording.
+	recordingsBucket = []byte("recordings")
+	timeBucket       = []byte("time")
+
+	ErrNotFound = errors.New("catalog: recording not found")
+	ErrNotOpen  = errors.New("catalog: not opened")
+)
+
+var (
+	dbMutex sync.RWMutex
+	db      *bolt.DB
+)
+
+// Open opens (or creates) the catalog database, this should be called once when
+// the agent starts.
+func Open(path string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	database, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return err
+	}
+	err = database.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(recordingsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(timeBucket)
+		return err
+	})
+	if err != nil {
+		database.Close()
+		return err
+	}
+	db = database
+	log.Log.Info("Catalog: opened " + path)
+	return nil
+}
+
+// Close closes the catalog database.
+func Close() {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	if db != nil {
+		db.Close()
+		db = nil
+	}
+}
+
+func timeKey(recording models.Recording) []byte {
+	key := make([]byte, 8, 8+len(recording.Name))
+	binary.BigEndian.PutUint64(key, uint64(recording.Start))
+	return append(key, recording.Name...)
+}
+
+func put(tx *bolt.Tx, recording models.Recording) error {
+	recordings := tx.Bucket(recordingsBucket)
+	times := tx.Bucket(timeBucket)
+
+	// Remove the previous time index, the start time might have changed.
+	if previous := recordings.Get([]byte(recording.Name)); previous != nil {
+		var old models.Recording
+		if err := json.Unmarshal(previous, &old); err == nil {
+			times.Delete(timeKey(old))
+		}
+	}
+	value, err := json.Marshal(recording)
+	if err != nil {
+		return err
+	}
+	if err := recordings.Put([]byte(recording.Name), value); err != nil {
+		return err
+	}
+	return times.Put(timeKey(recording), []byte(recording.Name))
+}
+
+// Add adds a recording to the catalog, an existing entry with the same name is replaced.
+func Add(recording models.Recording) error {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+	if db == nil {
+		return ErrNotOpen
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return put(tx, recording)
+	})
+}
+
+// Get returns the entry of a recording.
+func Get(name string) (recording models.Recording, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+	if db == nil {
+		return recording, ErrNotOpen
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(recordingsBucket).Get([]byte(name))
+		if value == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(value, &recording)
+	})
+	return
+}
+
+// Update changes the entry of a recording within a single transaction.
+func Update(name string, update func(recording *models.Recording)) error {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+	if db == nil {
+		return ErrNotOpen
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		value := tx.Bucket(recordingsBucket).Get([]byte(name))
+		if value == nil {
+			return ErrNotFound
+		}
+		var recording models.Recording
+		if err := json.Unmarshal(value, &recording); err != nil {
+			return err
+		}
+		update(&recording)
+		return put(tx, recording)
+	})
+}
+
+// SetUploadStatus sets the upload status of a recording for a destination (s3, kstorage, etc).
+func SetUploadStatus(name string, destination string, status string) error {
+	return Update(name, func(recording *models.Recording) {
+		if recording.Uploads == nil {
+			recording.Uploads = map[string]string{}
+		}
+		recording.Uploads[destination] = status
+	})
+}
+
+// Remove removes a recording from the catalog.
+func Remove(name string) error {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+	if db == nil {
+		return ErrNotOpen
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		recordings := tx.Bucket(recordingsBucket)
+		value := recordings.Get([]byte(name))
+		if value == nil {
+			return ErrNotFound
+		}
+		var recording models.Recording
+		if err := json.Unmarshal(value, &recording); err == nil {
+			tx.Bucket(timeBucket).Delete(timeKey(recording))
+		}
+		return recordings.Delete([]byte(name))
+	})
+}
+
+// List returns the recordings matching the query, ordered by start time, together with
+// the total number of matching recordings (ignoring offset and limit).
+func List(query models.RecordingQuery) (recordings []models.Recording, total int, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+	if db == nil {
+		return recordings, 0, ErrNotOpen
+	}
+	recordings = []models.Recording{}
+	err = db.View(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(recordingsBucket)
+		cursor := tx.Bucket(timeBucket).Cursor()
+
+		from := make([]byte, 8)
+		binary.BigEndian.PutUint64(from, uint64(query.From))
+		inRange := func(key []byte) bool {
+			start := int64(binary.BigEndian.Uint64(key[:8]))
+			return start >= query.From && (query.To == 0 || start <= query.To)
+		}
+
+		var key, name []byte
+		if query.Newest {
+			if query.To > 0 {
+				to := make([]byte, 8)
+				binary.BigEndian.PutUint64(to, uint64(query.To+1))
+				key, name = cursor.Seek(to)
+				if key == nil {
+					key, name = cursor.Last()
+				} else {
+					key, name = cursor.Prev()
+				}
+			} else {
+				key, name = cursor.Last()
+			}
+		} else {
+			key, name = cursor.Seek(from)
+		}
+
+		for key != nil && len(key) >= 8 && inRange(key) {
+			value := entries.Get(name)
+			var recording models.Recording
+			if value != nil && json.Unmarshal(value, &recording) == nil &&
+				(query.Trigger == "" || query.Trigger == recording.Trigger) &&
+				(query.Camera == "" || query.Camera == recording.Camera) {
+				if total >= query.Offset && (query.Limit <= 0 || len(recordings) < query.Limit) {
+					recordings = append(recordings, recording)
+				}
+				total++
+			}
+			if query.Newest {
+				key, name = cursor.Prev()
+			} else {
+				key, name = cursor.Next()
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// ParseRecordingName creates a catalog entry from the name of a recording, which has
+// the following format: timestamp_microseconds_instanceName_regionCoordinates_numberOfChanges_token
+func ParseRecordingName(name string) (recording models.Recording, err error) {
+	fileParts := strings.Split(strings.TrimSuffix(name, filepath.Ext(name)), "_")
+	if len(fileParts) != 6 {
+		return recording, errors.New("catalog: " + name + " is not a valid name")
+	}
+	timestamp, err := strconv.ParseInt(fileParts[0], 10, 64)
+	if err != nil {
+		return recording, err
+	}
+	var microseconds int64
+	if microParts := strings.Split(fileParts[1], "-"); len(microParts) == 2 {
+		microseconds, _ = strconv.ParseInt(microParts[1], 10, 64)
+	}
+	var coordinates []int
+	for _, c := range strings.Split(fileParts[3], "-") {
+		value, _ := strconv.Atoi(c)
+		coordinates = append(coordinates, value)
+	}
+	numberOfChanges, _ := strconv.Atoi(fileParts[4])
+
+	recording = models.Recording{
+		Name:            name,
+		Start:           timestamp*1000 + microseconds/1000,
+		Trigger:         models.TriggerMotion,
+		NumberOfChanges: numberOfChanges,
+		Uploads:         map[string]string{},
+	}
+	if len(coordinates) == 4 {
+		recording.Region = models.Rectangle{X1: coordinates[0], Y1: coordinates[1], X2: coordinates[2], Y2: coordinates[3]}
+	}
+	if numberOfChanges == 0 {
+		recording.Trigger = models.TriggerContinuous
+	}
+	return
+}
+
+// Synchronise makes sure the catalog matches the recordings directory. Recordings which
+// are not in the catalog are added (based on their name), entries of recordings which no
+// longer exist are marked as not local. Recordings which are queued in the cloud directory,
+// are marked as pending for the upload destination. This is done when the agent starts.
+func Synchronise(recordingsDirectory string, cloudDirectory string, destination string) {
+	files, err := utils.ReadDirectory(recordingsDirectory)
+	if err != nil {
+		return
+	}
+	onDisk := map[string]bool{}
+	added := 0
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		name := f.Name()
+		onDisk[name] = true
+		if _, err := Get(name); err == nil {
+			continue
+		}
+		recording, err := ParseRecordingName(name)
+		if err != nil {
+			continue
+		}
+		recording.Size = f.Size()
+		recording.End = f.ModTime().UnixNano() / int64(1000000)
+		if recording.End > recording.Start {
+			recording.Duration = recording.End - recording.Start
+		}
+		recording.Local = true
+		if _, err := os.Stat(filepath.Join(cloudDirectory, name)); err == nil && destination != "" {
+			recording.Uploads[destination] = models.UploadPending
+		}
+		if err := Add(recording); err == nil {
+			added++
+		}
+	}
+
+	removed := 0
+	recordings, _, err := List(models.RecordingQuery{})
+	if err == nil {
+		for _, recording := range recordings {
+			if recording.Local && !onDisk[recording.Name] {
+				Update(recording.Name, func(r *models.Recording) {
+					r.Local = false
+				})
+				removed++
+			}
+		}
+	}
+	log.Log.Info("Catalog: synchronised, " + strconv.Itoa(added) + " recordings added, " + strconv.Itoa(removed) + " recordings no longer on disk.")
+}
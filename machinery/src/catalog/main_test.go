@@ -0,0 +1,294 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// open opens a catalog in a temporary directory, which is closed after the test.
+func open(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := Open(filepath.Join(dir, "catalog.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(Close)
+	return dir
+}
+
+func add(t *testing.T, recordings ...models.Recording) {
+	t.Helper()
+	for _, recording := range recordings {
+		if err := Add(recording); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// names returns the names of the recordings which are listed.
+func names(t *testing.T, query models.RecordingQuery) ([]string, int) {
+	t.Helper()
+	recordings, total, err := List(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := []string{}
+	for _, recording := range recordings {
+		result = append(result, recording.Name)
+	}
+	return result, total
+}
+
+func TestNotOpen(t *testing.T) {
+	if err := Add(models.Recording{Name: "a"}); err != ErrNotOpen {
+		t.Errorf("Add: expected ErrNotOpen, got %v", err)
+	}
+	if _, err := Get("a"); err != ErrNotOpen {
+		t.Errorf("Get: expected ErrNotOpen, got %v", err)
+	}
+	if _, _, err := List(models.RecordingQuery{}); err != ErrNotOpen {
+		t.Errorf("List: expected ErrNotOpen, got %v", err)
+	}
+	if err := Remove("a"); err != ErrNotOpen {
+		t.Errorf("Remove: expected ErrNotOpen, got %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	open(t)
+	// Added out of order, the time index sorts them.
+	add(t,
+		models.Recording{Name: "c", Start: 3000, Trigger: models.TriggerMotion, Camera: "garden"},
+		models.Recording{Name: "a", Start: 1000, Trigger: models.TriggerMotion},
+		models.Recording{Name: "e", Start: 5000, Trigger: models.TriggerContinuous, Camera: "garden"},
+		models.Recording{Name: "b", Start: 2000, Trigger: models.TriggerManual},
+		models.Recording{Name: "d", Start: 4000, Trigger: models.TriggerMotion},
+	)
+
+	tests := []struct {
+		name  string
+		query models.RecordingQuery
+		names []string
+		total int
+	}{
+		{name: "oldest first", query: models.RecordingQuery{}, names: []string{"a", "b", "c", "d", "e"}, total: 5},
+		{name: "newest first", query: models.RecordingQuery{Newest: true}, names: []string{"e", "d", "c", "b", "a"}, total: 5},
+		{name: "from", query: models.RecordingQuery{From: 3000}, names: []string{"c", "d", "e"}, total: 3},
+		{name: "from between", query: models.RecordingQuery{From: 2500}, names: []string{"c", "d", "e"}, total: 3},
+		{name: "to", query: models.RecordingQuery{To: 3000}, names: []string{"a", "b", "c"}, total: 3},
+		{name: "from and to", query: models.RecordingQuery{From: 2000, To: 4000}, names: []string{"b", "c", "d"}, total: 3},
+		{name: "from after the last", query: models.RecordingQuery{From: 6000}, names: []string{}, total: 0},
+		{name: "newest from", query: models.RecordingQuery{From: 3000, Newest: true}, names: []string{"e", "d", "c"}, total: 3},
+		{name: "newest to a recording", query: models.RecordingQuery{To: 3000, Newest: true}, names: []string{"c", "b", "a"}, total: 3},
+		{name: "newest to between", query: models.RecordingQuery{To: 3500, Newest: true}, names: []string{"c", "b", "a"}, total: 3},
+		{name: "newest to after the last", query: models.RecordingQuery{To: 9000, Newest: true}, names: []string{"e", "d", "c", "b", "a"}, total: 5},
+		{name: "newest to the first", query: models.RecordingQuery{To: 1000, Newest: true}, names: []string{"a"}, total: 1},
+		{name: "newest to before the first", query: models.RecordingQuery{To: 500, Newest: true}, names: []string{}, total: 0},
+		{name: "newest from and to", query: models.RecordingQuery{From: 2000, To: 4000, Newest: true}, names: []string{"d", "c", "b"}, total: 3},
+		{name: "limit", query: models.RecordingQuery{Limit: 2}, names: []string{"a", "b"}, total: 5},
+		{name: "offset and limit", query: models.RecordingQuery{Offset: 1, Limit: 2}, names: []string{"b", "c"}, total: 5},
+		{name: "newest offset and limit", query: models.RecordingQuery{Offset: 1, Limit: 2, Newest: true}, names: []string{"d", "c"}, total: 5},
+		{name: "offset beyond the total", query: models.RecordingQuery{Offset: 10}, names: []string{}, total: 5},
+		{name: "trigger", query: models.RecordingQuery{Trigger: models.TriggerMotion}, names: []string{"a", "c", "d"}, total: 3},
+		{name: "trigger with offset", query: models.RecordingQuery{Trigger: models.TriggerMotion, Offset: 1, Limit: 1, Newest: true}, names: []string{"c"}, total: 3},
+		{name: "camera", query: models.RecordingQuery{Camera: "garden"}, names: []string{"c", "e"}, total: 2},
+		{name: "camera and trigger", query: models.RecordingQuery{Camera: "garden", Trigger: models.TriggerMotion}, names: []string{"c"}, total: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, total := names(t, test.query)
+			if !reflect.DeepEqual(result, test.names) {
+				t.Errorf("recordings %v, expected %v", result, test.names)
+			}
+			if total != test.total {
+				t.Errorf("total %d, expected %d", total, test.total)
+			}
+		})
+	}
+}
+
+func TestTimeIndex(t *testing.T) {
+	open(t)
+	add(t,
+		models.Recording{Name: "a", Start: 1000},
+		models.Recording{Name: "b", Start: 2000},
+	)
+
+	// Replacing a recording with another start time moves it in the index.
+	add(t, models.Recording{Name: "a", Start: 3000})
+	if result, total := names(t, models.RecordingQuery{}); !reflect.DeepEqual(result, []string{"b", "a"}) || total != 2 {
+		t.Errorf("after replacing: %v (%d), expected [b a]", result, total)
+	}
+
+	// The same for an update.
+	if err := Update("b", func(r *models.Recording) { r.Start = 4000 }); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := names(t, models.RecordingQuery{}); !reflect.DeepEqual(result, []string{"a", "b"}) {
+		t.Errorf("after updating: %v, expected [a b]", result)
+	}
+	if result, _ := names(t, models.RecordingQuery{To: 3000}); !reflect.DeepEqual(result, []string{"a"}) {
+		t.Errorf("the previous start time is still indexed: %v", result)
+	}
+
+	// A removed recording is no longer listed.
+	if err := Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if result, total := names(t, models.RecordingQuery{Newest: true}); !reflect.DeepEqual(result, []string{"b"}) || total != 1 {
+		t.Errorf("after removing: %v (%d), expected [b]", result, total)
+	}
+	if _, err := Get("a"); err != ErrNotFound {
+		t.Errorf("Get: expected ErrNotFound, got %v", err)
+	}
+	if err := Remove("a"); err != ErrNotFound {
+		t.Errorf("Remove: expected ErrNotFound, got %v", err)
+	}
+	if err := Update("a", func(r *models.Recording) {}); err != ErrNotFound {
+		t.Errorf("Update: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSetUploadStatus(t *testing.T) {
+	open(t)
+	add(t, models.Recording{Name: "a", Start: 1000})
+	if err := SetUploadStatus("a", "s3", models.UploadPending); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUploadStatus("a", "s3", models.UploadFinished); err != nil {
+		t.Fatal(err)
+	}
+	recording, err := Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recording.Uploads["s3"] != models.UploadFinished {
+		t.Errorf("upload status %q, expected %q", recording.Uploads["s3"], models.UploadFinished)
+	}
+}
+
+func TestParseRecordingName(t *testing.T) {
+	tests := []struct {
+		name      string
+		recording models.Recording
+		valid     bool
+	}{
+		{
+			name: "1564859471_6-474162_oprit_577-283-727-375_1153_27.mp4",
+			recording: models.Recording{
+				Name:            "1564859471_6-474162_oprit_577-283-727-375_1153_27.mp4",
+				Start:           1564859471474,
+				Trigger:         models.TriggerMotion,
+				Region:          models.Rectangle{X1: 577, Y1: 283, X2: 727, Y2: 375},
+				NumberOfChanges: 1153,
+				Uploads:         map[string]string{},
+			},
+			valid: true,
+		},
+		{
+			name: "1564859471_0-0_oprit_0-0-0-0_0_0.mp4",
+			recording: models.Recording{
+				Name:    "1564859471_0-0_oprit_0-0-0-0_0_0.mp4",
+				Start:   1564859471000,
+				Trigger: models.TriggerContinuous,
+				Uploads: map[string]string{},
+			},
+			valid: true,
+		},
+		{
+			name: "1564859471_6-474162_oprit_577-283_1153_27.mp4",
+			recording: models.Recording{
+				Name:            "1564859471_6-474162_oprit_577-283_1153_27.mp4",
+				Start:           1564859471474,
+				Trigger:         models.TriggerMotion,
+				NumberOfChanges: 1153,
+				Uploads:         map[string]string{},
+			},
+			valid: true,
+		},
+		{name: "1564859471_6-474162_oprit_1153_27.mp4"},
+		{name: "now_6-474162_oprit_577-283-727-375_1153_27.mp4"},
+		{name: "recording.mp4"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recording, err := ParseRecordingName(test.name)
+			if !test.valid {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", recording)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(recording, test.recording) {
+				t.Errorf("recording %+v, expected %+v", recording, test.recording)
+			}
+		})
+	}
+}
+
+func TestSynchronise(t *testing.T) {
+	dir := open(t)
+	recordingsDirectory := filepath.Join(dir, "recordings") + "/"
+	cloudDirectory := filepath.Join(dir, "cloud") + "/"
+	for _, directory := range []string{recordingsDirectory, cloudDirectory, recordingsDirectory + "directory"} {
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const (
+		known  = "1564859000_6-000000_oprit_0-0-100-100_10_1.mp4"
+		added  = "1564859471_6-474162_oprit_577-283-727-375_1153_27.mp4"
+		queued = "1564859500_6-000000_oprit_0-0-100-100_20_2.mp4"
+		gone   = "1564858000_6-000000_oprit_0-0-100-100_30_3.mp4"
+	)
+	modified := time.Unix(1564859481, 0)
+	for _, name := range []string{known, added, queued, "invalid.mp4"} {
+		if err := ioutil.WriteFile(recordingsDirectory+name, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(recordingsDirectory+name, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(cloudDirectory+queued, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	add(t,
+		models.Recording{Name: known, Start: 1564859000000, Trigger: models.TriggerManual, Local: true},
+		models.Recording{Name: gone, Start: 1564858000000, Local: true},
+	)
+
+	Synchronise(recordingsDirectory, cloudDirectory, "s3")
+
+	if result, total := names(t, models.RecordingQuery{}); !reflect.DeepEqual(result, []string{gone, known, added, queued}) || total != 4 {
+		t.Fatalf("recordings %v (%d)", result, total)
+	}
+
+	// A known recording is kept as it is.
+	if recording, _ := Get(known); recording.Trigger != models.TriggerManual || !recording.Local {
+		t.Errorf("the known recording changed: %+v", recording)
+	}
+	// A recording which no longer exists isn't local.
+	if recording, _ := Get(gone); recording.Local {
+		t.Errorf("the removed recording is still local")
+	}
+	// A new recording is added from its name and file.
+	recording, _ := Get(added)
+	if !recording.Local || recording.Size != 100 || recording.End != 1564859481000 || recording.Duration != 9526 || len(recording.Uploads) != 0 {
+		t.Errorf("new recording %+v", recording)
+	}
+	// A recording in the cloud directory is pending.
+	if recording, _ := Get(queued); recording.Uploads["s3"] != models.UploadPending {
+		t.Errorf("queued recording %+v, expected a pending upload", recording)
+	}
+}
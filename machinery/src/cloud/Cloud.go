@@ -10,19 +10,19 @@ import (
 	"github.com/kerberos-io/joy4/av/pubsub"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/kerberos-io/agent/machinery/src/capture"
 	av "github.com/kerberos-io/joy4/av"
-	"github.com/kerberos-io/joy4/cgo/ffmpeg"
 	"gocv.io/x/gocv"
 
 	"net/http"
-	"runtime"
-	"runtime/debug"
 	"strconv"
 	"time"
 
+	"github.com/kerberos-io/agent/machinery/src/catalog"
 	"github.com/kerberos-io/agent/machinery/src/computervision"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/retention"
 	"github.com/kerberos-io/agent/machinery/src/utils"
 	"github.com/kerberos-io/agent/machinery/src/webrtc"
 	"github.com/shirou/gopsutil/disk"
@@ -69,10 +69,20 @@ loop:
 				}
 
 				fileName := f.Name()
+				uploaded := false
 				if config.Cloud == "s3" {
-					UploadS3(configuration, fileName, watchDirectory)
+					uploaded = UploadS3(configuration, fileName, watchDirectory)
 				} else if config.Cloud == "kstorage" {
-					UploadKerberosVault(configuration, fileName, watchDirectory)
+					uploaded = UploadKerberosVault(configuration, fileName, watchDirectory)
+				} else {
+					continue
+				}
+
+				// Keep track of the upload in the catalog.
+				if uploaded {
+					catalog.SetUploadStatus(fileName, config.Cloud, models.UploadFinished)
+				} else {
+					catalog.SetUploadStatus(fileName, config.Cloud, models.UploadFailed)
 				}
 			}
 		}
@@ -128,6 +138,9 @@ loop:
 		usage, _ := disk.Usage("/")
 		diskPercentUsed := strconv.Itoa(int(usage.UsedPercent))
 
+		// The outcome of the retention, which removes recordings from disk.
+		retentionStatus := retention.GetStatus()
+
 		onvifEnabled := "false"
 		if config.Capture.IPCamera.ONVIFXAddr != "" {
 			onvifEnabled = "true"
@@ -150,7 +163,11 @@ loop:
 			"disk1size" : "%s",
 			"disk3size" : "%s",
 			"diskvdasize" :  "%s",
-			"numberoffiles" : "33",
+			"numberoffiles" : "%d",
+			"retention_totalsize" : %d,
+			"retention_deletedfiles" : %d,
+			"retention_deletedsize" : %d,
+			"retention_queued" : %d,
 			"temperature" : "sh: 1: vcgencmd: not found",
 			"wifissid" : "",
 			"wifistrength" : "",
@@ -158,7 +175,9 @@ loop:
 			"timestamp" : 1564747908,
 			"siteID" : "%s",
 			"onvif" : "%s"
-		}`, config.Key, username, key, config.Name, "0", "0", diskPercentUsed, days, config.HubSite, onvifEnabled)
+		}`, config.Key, username, key, config.Name, "0", "0", diskPercentUsed,
+			retentionStatus.NumberOfFiles, retentionStatus.TotalSize, retentionStatus.DeletedFiles, retentionStatus.DeletedSize, retentionStatus.QueuedForCloud,
+			days, config.HubSite, onvifEnabled)
 
 		var jsonStr = []byte(object)
 		buffy := bytes.NewBuffer(jsonStr)
@@ -201,7 +220,7 @@ loop:
 	log.Log.Debug("HandleHeartBeat: finished")
 }
 
-func HandleLiveStreamSD(livestreamCursor *pubsub.QueueCursor, configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, decoder *ffmpeg.VideoDecoder, decoderMutex *sync.Mutex) {
+func HandleLiveStreamSD(livestreamCursor *pubsub.QueueCursor, configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, decoder *capture.VideoDecoder, decoderMutex *sync.Mutex) {
 
 	log.Log.Debug("HandleLiveStreamSD: finished")
 
@@ -245,25 +264,25 @@ func HandleLiveStreamSD(livestreamCursor *pubsub.QueueCursor, configuration *mod
 	log.Log.Debug("HandleLiveStreamSD: finished")
 }
 
-func sendImage(topic string, mqttClient mqtt.Client, pkt av.Packet, decoder *ffmpeg.VideoDecoder, decoderMutex *sync.Mutex) {
+func sendImage(topic string, mqttClient mqtt.Client, pkt av.Packet, decoder *capture.VideoDecoder, decoderMutex *sync.Mutex) {
 	mat := computervision.GetRGBImage(pkt, decoder, decoderMutex)
 	buffer, err := gocv.IMEncode(gocv.JPEGFileExt, mat)
 	mat.Close()
 	if err == nil {
 		encoded := base64.StdEncoding.EncodeToString(buffer.GetBytes())
 		mqttClient.Publish(topic, 0, false, encoded)
+		buffer.Close()
 	}
-	runtime.GC()
-	debug.FreeOSMemory()
 }
 
-func HandleLiveStreamHD(livestreamCursor *pubsub.QueueCursor, configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, codecs []av.CodecData, decoder *ffmpeg.VideoDecoder, decoderMutex *sync.Mutex) {
+func HandleLiveStreamHD(livestreamCursor *pubsub.QueueCursor, configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, codecs []av.CodecData, decoder *capture.VideoDecoder, decoderMutex *sync.Mutex) {
 
 	config := configuration.Config
 
 	// Should create a track here.
 	track := webrtc.NewVideoTrack()
-	go webrtc.WriteToTrack(livestreamCursor, configuration, communication, mqttClient, track, codecs, decoder, decoderMutex)
+	audioTrack := webrtc.NewAudioTrack(codecs)
+	go webrtc.WriteToTrack(livestreamCursor, configuration, communication, mqttClient, track, audioTrack, codecs, decoder, decoderMutex)
 
 	if config.Capture.ForwardWebRTC == "true" {
 		// We get a request with an offer, but we'll forward it.
@@ -286,7 +305,7 @@ func HandleLiveStreamHD(livestreamCursor *pubsub.QueueCursor, configuration *mod
 				webrtc.CandidateArrays[key] = make(chan string, 30)
 			}
 			webrtc.CandidatesMutex.Unlock()
-			webrtc.InitializeWebRTCConnection(configuration, communication, mqttClient, track, handshake, webrtc.CandidateArrays[key])
+			webrtc.InitializeWebRTCConnection(configuration, communication, mqttClient, track, audioTrack, handshake, webrtc.CandidateArrays[key])
 
 		}
 	}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/kerberos-io/agent/machinery/src/catalog"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
 )
@@ -74,6 +75,7 @@ func UploadKerberosVault(configuration *models.Configuration, fileName string, d
 		defer resp.Body.Close()
 	}
 
+	uploaded := false
 	if err == nil {
 		if resp != nil {
 			body, err := ioutil.ReadAll(resp.Body)
@@ -83,6 +85,10 @@ func UploadKerberosVault(configuration *models.Configuration, fileName string, d
 					// We will remove the file from disk as well
 					os.Remove(fullname)
 					os.Remove(directory + "/" + fileName)
+					catalog.Update(fileName, func(recording *models.Recording) {
+						recording.Local = false
+					})
+					uploaded = true
 				} else {
 					log.Log.Info("UploadKerberosVault: Upload Failed, " + resp.Status + ", " + string(body))
 				}
@@ -92,5 +98,5 @@ func UploadKerberosVault(configuration *models.Configuration, fileName string, d
 	} else {
 		log.Log.Info("UploadKerberosVault: Upload Failed, " + err.Error())
 	}
-	return true
+	return uploaded
 }
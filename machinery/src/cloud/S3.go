@@ -7,12 +7,16 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
 	"github.com/minio/minio-go/v6"
 )
 
+// The names of the recordings which can't be uploaded, so they are only logged once.
+var skippedUploads sync.Map
+
 func UploadS3(configuration *models.Configuration, fileName string, directory string) bool {
 
 	config := configuration.Config
@@ -55,18 +59,22 @@ func UploadS3(configuration *models.Configuration, fileName string, directory st
 		s3Client.SetCustomTransport(transport)
 	}
 
-	fileParts := strings.Split(fileName, "_")
-	if len(fileParts) == 1 {
-		log.Log.Error("ERROR: " + fileName + " is not a valid name.")
-		os.Remove(directory + "/" + fileName)
+	// Recordings with an older or foreign name are kept on disk (and their marker), so
+	// they can still be uploaded by hand.
+	fileParts := strings.Split(strings.TrimSuffix(fileName, ".mp4"), "_")
+	if len(fileParts) != 6 {
+		if _, logged := skippedUploads.LoadOrStore(fileName, true); !logged {
+			log.Log.Error("UploadS3: " + fileName + " is not a valid name, skipping upload.")
+		}
 		return false
 	}
 
 	deviceKey := config.Key
 	startRecording, _ := strconv.ParseInt(fileParts[0], 10, 64)
+	microseconds := fileParts[1]
 	devicename := fileParts[2]
 	coordinates := fileParts[3]
-	//numberOfChanges := fileParts[4]
+	numberOfChanges := fileParts[4]
 	token, _ := strconv.Atoi(fileParts[5])
 
 	log.Log.Info("UploadS3: Upload started for " + fileName)
@@ -96,10 +104,10 @@ func UploadS3(configuration *models.Configuration, fileName string, directory st
 			StorageClass: "ONEZONE_IA",
 			UserMetadata: map[string]string{
 				"event-timestamp":         strconv.FormatInt(startRecording, 10),
-				"event-microseconds":      deviceKey,
+				"event-microseconds":      microseconds,
 				"event-instancename":      devicename,
 				"event-regioncoordinates": coordinates,
-				"event-numberofchanges":   deviceKey,
+				"event-numberofchanges":   numberOfChanges,
 				"event-token":             strconv.Itoa(token),
 				"productid":               deviceKey,
 				"publickey":               aws_access_key_id,
@@ -0,0 +1,162 @@
+package components
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// An API key looks like "ka_<id>_<secret>", the id is used to find the key
+// in the user store, the secret is only known by the owner of the key.
+const apiKeyPrefix = "ka_"
+
+var (
+	ErrInvalidAPIKey  = errors.New("invalid api key")
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidName    = errors.New("the name is not valid")
+)
+
+func randomHex(size int) (string, error) {
+	random := make([]byte, size)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// GetAPIKeys returns all API keys, without their hashes.
+func GetAPIKeys() (apiKeys []models.APIKey, err error) {
+	userMutex.Lock()
+	defer userMutex.Unlock()
+
+	userConfig, err := ReadUserConfig()
+	if err != nil {
+		return apiKeys, err
+	}
+	apiKeys = []models.APIKey{}
+	for _, k := range userConfig.APIKeys {
+		k.Hash = ""
+		apiKeys = append(apiKeys, k)
+	}
+	return apiKeys, nil
+}
+
+// CreateAPIKey creates a new API key for a role. The returned entry contains the key,
+// this is the only time the key is available as we only store its hash.
+func CreateAPIKey(name string, role string) (apiKey models.APIKey, err error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return apiKey, ErrInvalidName
+	}
+	if models.RoleLevel(role) == 0 {
+		return apiKey, ErrInvalidRole
+	}
+
+	userMutex.Lock()
+	defer userMutex.Unlock()
+
+	userConfig, err := ReadUserConfig()
+	if err != nil {
+		return apiKey, err
+	}
+	if !userConfig.Installed {
+		return apiKey, ErrNotInstalled
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return apiKey, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return apiKey, err
+	}
+	key := apiKeyPrefix + id + "_" + secret
+
+	apiKey = models.APIKey{
+		ID:      id,
+		Name:    name,
+		Role:    role,
+		Hash:    hashAPIKey(key),
+		Created: time.Now().Unix(),
+	}
+	userConfig.APIKeys = append(userConfig.APIKeys, apiKey)
+	if err := WriteUserConfig(userConfig); err != nil {
+		return apiKey, err
+	}
+	log.Log.Info("CreateAPIKey: created " + role + " api key " + name + " (" + id + ")")
+
+	apiKey.Hash = ""
+	apiKey.Key = key
+	return apiKey, nil
+}
+
+// RevokeAPIKey removes an API key, it can no longer be used.
+func RevokeAPIKey(id string) error {
+	userMutex.Lock()
+	defer userMutex.Unlock()
+
+	userConfig, err := ReadUserConfig()
+	if err != nil {
+		return err
+	}
+	for i, k := range userConfig.APIKeys {
+		if k.ID == id {
+			userConfig.APIKeys = append(userConfig.APIKeys[:i], userConfig.APIKeys[i+1:]...)
+			if err := WriteUserConfig(userConfig); err != nil {
+				return err
+			}
+			log.Log.Info("RevokeAPIKey: revoked api key " + k.Name + " (" + id + ")")
+			return nil
+		}
+	}
+	return ErrAPIKeyNotFound
+}
+
+// AuthenticateAPIKey verifies an API key, and keeps track of when it was last used.
+// To avoid writing the user store on every request, the last use is stored once a minute.
+func AuthenticateAPIKey(key string) (apiKey models.APIKey, err error) {
+	parts := strings.Split(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(parts) != 2 {
+		return apiKey, ErrInvalidAPIKey
+	}
+	id := parts[0]
+	hash := hashAPIKey(key)
+
+	userMutex.Lock()
+	defer userMutex.Unlock()
+
+	userConfig, err := ReadUserConfig()
+	if err != nil {
+		return apiKey, err
+	}
+	for i, k := range userConfig.APIKeys {
+		if k.ID == id {
+			if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) != 1 {
+				break
+			}
+			now := time.Now().Unix()
+			if now-k.LastUsed >= 60 {
+				userConfig.APIKeys[i].LastUsed = now
+				if err := WriteUserConfig(userConfig); err != nil {
+					log.Log.Error("AuthenticateAPIKey: could not store last use, " + err.Error())
+				}
+			}
+			k.Hash = ""
+			k.LastUsed = now
+			return k, nil
+		}
+	}
+	return apiKey, ErrInvalidAPIKey
+}
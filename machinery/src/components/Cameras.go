@@ -0,0 +1,159 @@
+package components
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// DefaultCamera is the identifier of the camera, when no cameras are configured
+// and the agent runs a single camera with its own capture settings.
+const DefaultCamera = "default"
+
+// Camera is a running camera of the agent, with its own configuration and
+// communication so it can be restarted without affecting the other cameras.
+type Camera struct {
+	ID            string
+	Name          string
+	Configuration *models.Configuration
+	Communication *models.Communication
+}
+
+var (
+	camerasMutex sync.RWMutex
+	cameras      []*Camera
+)
+
+// CameraConfiguration creates the configuration of a camera, the capture settings,
+// region and timetable of the camera are applied to the configuration of the agent.
+// If the camera has no key, the key of the agent is suffixed with the camera id, so
+// every camera has its own MQTT topics.
+func CameraConfiguration(configuration *models.Configuration, camera *models.Camera) *models.Configuration {
+	config := configuration.Config
+	if camera.Name != "" {
+		config.Name = camera.Name
+	}
+	if camera.Key != "" {
+		config.Key = camera.Key
+	} else {
+		config.Key = config.Key + "-" + camera.ID
+	}
+	config.Capture = camera.Capture
+	if camera.Region != nil {
+		config.Region = camera.Region
+	}
+	if camera.Timetable != nil {
+		config.Timetable = camera.Timetable
+	}
+	config.Cameras = nil
+
+	return &models.Configuration{
+		Name:         configuration.Name,
+		Port:         configuration.Port,
+		Camera:       camera.ID,
+		Config:       config,
+		CustomConfig: configuration.CustomConfig,
+		GlobalConfig: configuration.GlobalConfig,
+	}
+}
+
+// CreateCameras creates a camera for every camera in the configuration, or a single
+// camera if no cameras are configured. Cameras without a valid or unique id are skipped.
+func CreateCameras(configuration *models.Configuration, communication *models.Communication) []*Camera {
+	var created []*Camera
+	newCommunication := func() *models.Communication {
+		// The channels which are used by the API live as long as the camera, so
+		// they are never closed or replaced while the camera restarts.
+		return &models.Communication{
+			HandleBootstrap: make(chan string, 1),
+			HandleMotion:    make(chan models.MotionDataPartial, 1),
+			HandleONVIF:     make(chan models.OnvifAction, 1),
+			IsConfiguring:   communication.IsConfiguring,
+		}
+	}
+
+	if len(configuration.Config.Cameras) == 0 {
+		config := configuration.Config
+		created = append(created, &Camera{
+			ID:   DefaultCamera,
+			Name: config.Name,
+			Configuration: &models.Configuration{
+				Name:         configuration.Name,
+				Port:         configuration.Port,
+				Config:       config,
+				CustomConfig: configuration.CustomConfig,
+				GlobalConfig: configuration.GlobalConfig,
+			},
+			Communication: newCommunication(),
+		})
+	} else {
+		ids := map[string]bool{}
+		for _, camera := range configuration.Config.Cameras {
+			if camera == nil {
+				continue
+			}
+			if camera.ID == "" || camera.ID == "." || camera.ID == ".." || filepath.Base(camera.ID) != camera.ID || ids[camera.ID] {
+				log.Log.Error("CreateCameras: skipping camera " + camera.Name + ", the id should be unique and can't contain a slash.")
+				continue
+			}
+			ids[camera.ID] = true
+			cameraConfiguration := CameraConfiguration(configuration, camera)
+			created = append(created, &Camera{
+				ID:            camera.ID,
+				Name:          cameraConfiguration.Config.Name,
+				Configuration: cameraConfiguration,
+				Communication: newCommunication(),
+			})
+		}
+	}
+
+	camerasMutex.Lock()
+	cameras = created
+	camerasMutex.Unlock()
+	return created
+}
+
+// GetCameras returns all running cameras.
+func GetCameras() []*Camera {
+	camerasMutex.RLock()
+	defer camerasMutex.RUnlock()
+	return cameras
+}
+
+// GetCamera returns a running camera, or the first camera if the id is empty.
+func GetCamera(id string) *Camera {
+	camerasMutex.RLock()
+	defer camerasMutex.RUnlock()
+	for _, camera := range cameras {
+		if id == "" || camera.ID == id {
+			return camera
+		}
+	}
+	return nil
+}
+
+// OpenCameraConfig reopens the configuration of a single camera, when the camera is
+// restarted. If the camera is no longer configured, the current configuration is kept.
+func OpenCameraConfig(configuration *models.Configuration) {
+	agent := models.Configuration{
+		Name: configuration.Name,
+		Port: configuration.Port,
+	}
+	OpenConfig(&agent)
+
+	if configuration.Camera == "" {
+		configuration.Config = agent.Config
+		configuration.CustomConfig = agent.CustomConfig
+		configuration.GlobalConfig = agent.GlobalConfig
+		return
+	}
+	for _, camera := range agent.Config.Cameras {
+		if camera != nil && camera.ID == configuration.Camera {
+			*configuration = *CameraConfiguration(&agent, camera)
+			return
+		}
+	}
+	log.Log.Info("OpenCameraConfig: camera " + configuration.Camera + " is no longer configured, keeping the current configuration.")
+}
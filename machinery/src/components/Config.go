@@ -9,23 +9,33 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/InVisionApp/conjungo"
 	"github.com/kerberos-io/agent/machinery/src/database"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
 	"gopkg.in/mgo.v2/bson"
 )
 
-func GetSnapshot() string {
+// GetSnapshot returns a recent snapshot of a camera, encoded as base64.
+func GetSnapshot(camera string) string {
 	var snapshot string
-	files, err := ioutil.ReadDir("./data/snapshots")
+	snapshotsDirectory := utils.SnapshotsDirectory(camera)
+	entries, err := ioutil.ReadDir(snapshotsDirectory)
+	var files []os.FileInfo
+	for _, f := range entries {
+		if !f.IsDir() {
+			files = append(files, f)
+		}
+	}
 	if err == nil && len(files) > 1 {
 		sort.Slice(files, func(i, j int) bool {
 			return files[i].ModTime().Before(files[j].ModTime())
 		})
-		f, _ := os.Open("./data/snapshots/" + files[1].Name())
+		f, _ := os.Open(snapshotsDirectory + files[1].Name())
 		defer f.Close()
 		// Read entire JPG into byte slice.
 		reader := bufio.NewReader(f)
@@ -36,34 +46,6 @@ func GetSnapshot() string {
 	return snapshot
 }
 
-// ReadUserConfig Reads the user configuration of the Kerberos Open Source instance.
-// This will return a models.User struct including the username, password,
-// selected language, and if the installation was completed or not.
-func ReadUserConfig() (userConfig models.User) {
-	for {
-		jsonFile, err := os.Open("./data/config/user.json")
-		if err != nil {
-			fmt.Println(err)
-			fmt.Println("Config file is not found " + "./data/config/user.json" + ", trying again in 5s.")
-			time.Sleep(5 * time.Second)
-		} else {
-			fmt.Println("Successfully Opened user.json")
-			byteValue, _ := ioutil.ReadAll(jsonFile)
-			err = json.Unmarshal(byteValue, &userConfig)
-			if err != nil {
-				fmt.Println("JSON file not valid: " + err.Error())
-			} else {
-				jsonFile.Close()
-				break
-			}
-			time.Sleep(5 * time.Second)
-		}
-		jsonFile.Close()
-	}
-
-	return
-}
-
 func OpenConfig(configuration *models.Configuration) {
 
 	// We are checking which deployment this is running, so we can load
@@ -157,3 +139,145 @@ func OpenConfig(configuration *models.Configuration) {
 
 	return
 }
+
+// SecretPlaceholder replaces the secrets of the configuration in API responses.
+// When a configuration is saved with this placeholder, the current secret is kept.
+const SecretPlaceholder = "********"
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return SecretPlaceholder
+}
+
+func restore(secret string, current string) string {
+	if secret == SecretPlaceholder {
+		return current
+	}
+	return secret
+}
+
+// splitURL splits the credentials (user:password@) from an URL, e.g. of a RTSP stream.
+// The credentials end at the last @ before the path, as a password can contain an @.
+func splitURL(uri string) (prefix string, user string, password string, hasPassword bool, host string) {
+	scheme := strings.Index(uri, "://")
+	if scheme < 0 {
+		return uri, "", "", false, ""
+	}
+	prefix, rest := uri[:scheme+3], uri[scheme+3:]
+	end := len(rest)
+	if slash := strings.Index(rest, "/"); slash >= 0 {
+		end = slash
+	}
+	at := strings.LastIndex(rest[:end], "@")
+	if at < 0 {
+		return prefix, "", "", false, rest
+	}
+	userinfo := rest[:at]
+	if colon := strings.Index(userinfo, ":"); colon >= 0 {
+		return prefix, userinfo[:colon], userinfo[colon+1:], true, rest[at:]
+	}
+	return prefix, userinfo, "", false, rest[at:]
+}
+
+// redactURL replaces the password in the credentials of an URL.
+func redactURL(uri string) string {
+	prefix, user, password, hasPassword, host := splitURL(uri)
+	if !hasPassword || password == "" {
+		return uri
+	}
+	return prefix + user + ":" + SecretPlaceholder + host
+}
+
+// restoreURL puts back the current password in an URL, if it was left to the placeholder.
+func restoreURL(uri string, current string) string {
+	prefix, user, password, hasPassword, host := splitURL(uri)
+	if !hasPassword || password != SecretPlaceholder {
+		return uri
+	}
+	_, _, currentPassword, _, _ := splitURL(current)
+	return prefix + user + ":" + currentPassword + host
+}
+
+func redactIPCamera(camera *models.IPCamera) {
+	camera.RTSP = redactURL(camera.RTSP)
+	camera.SubRTSP = redactURL(camera.SubRTSP)
+	camera.ONVIFPassword = redact(camera.ONVIFPassword)
+}
+
+func restoreIPCamera(camera *models.IPCamera, current models.IPCamera) {
+	camera.RTSP = restoreURL(camera.RTSP, current.RTSP)
+	camera.SubRTSP = restoreURL(camera.SubRTSP, current.SubRTSP)
+	camera.ONVIFPassword = restore(camera.ONVIFPassword, current.ONVIFPassword)
+}
+
+// RedactConfig returns a copy of the configuration without any secrets (S3 secret key,
+// Kerberos Vault access keys, Hub private key, MQTT, TURN and ONVIF passwords and the
+// passwords in the RTSP urls), so it can be returned by the API.
+func RedactConfig(config models.Config) models.Config {
+	if config.S3 != nil {
+		s3 := *config.S3
+		s3.Secretkey = redact(s3.Secretkey)
+		config.S3 = &s3
+	}
+	if config.KStorage != nil {
+		kstorage := *config.KStorage
+		kstorage.AccessKey = redact(kstorage.AccessKey)
+		kstorage.SecretAccessKey = redact(kstorage.SecretAccessKey)
+		config.KStorage = &kstorage
+	}
+	config.HubPrivateKey = redact(config.HubPrivateKey)
+	config.MQTTPassword = redact(config.MQTTPassword)
+	config.TURNPassword = redact(config.TURNPassword)
+	redactIPCamera(&config.Capture.IPCamera)
+	if config.Cameras != nil {
+		cameras := make([]*models.Camera, len(config.Cameras))
+		for i, c := range config.Cameras {
+			if c == nil {
+				continue
+			}
+			camera := *c
+			redactIPCamera(&camera.Capture.IPCamera)
+			cameras[i] = &camera
+		}
+		config.Cameras = cameras
+	}
+	return config
+}
+
+// RestoreSecrets puts back the current secrets in a configuration which was
+// received through the API, for every secret which was left to the placeholder.
+func RestoreSecrets(config *models.Config, current models.Config) {
+	if config.S3 != nil {
+		currentSecret := ""
+		if current.S3 != nil {
+			currentSecret = current.S3.Secretkey
+		}
+		config.S3.Secretkey = restore(config.S3.Secretkey, currentSecret)
+	}
+	if config.KStorage != nil {
+		currentKey, currentSecret := "", ""
+		if current.KStorage != nil {
+			currentKey, currentSecret = current.KStorage.AccessKey, current.KStorage.SecretAccessKey
+		}
+		config.KStorage.AccessKey = restore(config.KStorage.AccessKey, currentKey)
+		config.KStorage.SecretAccessKey = restore(config.KStorage.SecretAccessKey, currentSecret)
+	}
+	config.HubPrivateKey = restore(config.HubPrivateKey, current.HubPrivateKey)
+	config.MQTTPassword = restore(config.MQTTPassword, current.MQTTPassword)
+	config.TURNPassword = restore(config.TURNPassword, current.TURNPassword)
+	restoreIPCamera(&config.Capture.IPCamera, current.Capture.IPCamera)
+	for _, camera := range config.Cameras {
+		if camera == nil {
+			continue
+		}
+		var currentCamera models.IPCamera
+		for _, c := range current.Cameras {
+			if c != nil && c.ID == camera.ID {
+				currentCamera = c.Capture.IPCamera
+			}
+		}
+		restoreIPCamera(&camera.Capture.IPCamera, currentCamera)
+	}
+}
@@ -12,26 +12,77 @@ import (
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
 	"github.com/kerberos-io/agent/machinery/src/onvif"
+	"github.com/kerberos-io/agent/machinery/src/retention"
 	routers "github.com/kerberos-io/agent/machinery/src/routers/mqtt"
+	"github.com/kerberos-io/joy4/av"
 	"github.com/kerberos-io/joy4/av/pubsub"
 	"github.com/tevino/abool"
 )
 
+// Bootstrap starts the agent, the services which are shared by all cameras (upload and
+// retention) and a pipeline for every camera. When the agent is restarted (e.g. after
+// a reconfiguration) everything is stopped, the configuration is reopened and started again.
 func Bootstrap(configuration *models.Configuration, communication *models.Communication) {
 	log.Log.Debug("Bootstrap: started")
 
+	communication.HandleUpload = make(chan string, 1)
+	communication.HandleRetention = make(chan string, 1)
+	communication.IsConfiguring = abool.New()
+
+	for {
+		// Handle Upload to cloud provider (Kerberos Hub, Kerberos Vault and others)
+		go cloud.HandleUpload(configuration, communication)
+
+		// Handle retention of recordings, so the disk doesn't fill up.
+		go retention.HandleRetention(configuration, communication)
+
+		// Start a pipeline for every camera.
+		var wg sync.WaitGroup
+		for _, camera := range CreateCameras(configuration, communication) {
+			wg.Add(1)
+			go func(camera *Camera) {
+				BootstrapCamera(camera.Configuration, camera.Communication)
+				wg.Done()
+			}(camera)
+		}
+
+		// This will blocking until receiving a signal to be restarted, reconfigured, stopped, etc.
+		status := <-communication.HandleBootstrap
+
+		communication.HandleUpload <- "stop"
+		communication.HandleRetention <- "stop"
+		for _, camera := range GetCameras() {
+			camera.Communication.HandleBootstrap <- "stop"
+		}
+		wg.Wait()
+
+		if status == "stop" {
+			break
+		}
+		// We will re open the configuration, might have changed :O!
+		OpenConfig(configuration)
+	}
+	log.Log.Debug("Bootstrap: finished")
+}
+
+// BootstrapCamera runs the pipeline of a single camera, until it is stopped. The pipeline
+// is restarted when the camera is restarted, or when the stream is blocking.
+func BootstrapCamera(configuration *models.Configuration, communication *models.Communication) {
+	log.Log.Debug("BootstrapCamera: started " + configuration.Camera)
+
 	// Initiate the packet counter, this is being used to detect
 	// if a camera is going blocky, or got disconnected.
 	var packageCounter atomic.Value
 	packageCounter.Store(int64(0))
 	communication.PackageCounter = &packageCounter
+	communication.HandleControlAgent = make(chan string, 1)
 	communication.HandleStream = make(chan string, 1)
-	communication.HandleUpload = make(chan string, 1)
+	communication.HandleSubStream = make(chan string, 1)
 	communication.HandleHeartBeat = make(chan string, 1)
 	communication.HandleLiveSD = make(chan int64, 1)
 	communication.HandleLiveHDKeepalive = make(chan string, 1)
 	communication.HandleLiveHDPeers = make(chan string, 1)
-	communication.IsConfiguring = abool.New()
+	communication.HandleONVIFActions = make(chan string, 1)
 
 	// Before starting the agent, we have a control goroutine, that might
 	// do several checks to see if the agent is still operational.
@@ -47,9 +98,10 @@ func Bootstrap(configuration *models.Configuration, communication *models.Commun
 			break
 		}
 		// We will re open the configuration, might have changed :O!
-		OpenConfig(configuration)
+		OpenCameraConfig(configuration)
 	}
-	log.Log.Debug("Bootstrap: finished")
+	communication.HandleControlAgent <- "stop"
+	log.Log.Debug("BootstrapCamera: finished " + configuration.Camera)
 }
 
 func RunAgent(configuration *models.Configuration, communication *models.Communication) string {
@@ -57,11 +109,53 @@ func RunAgent(configuration *models.Configuration, communication *models.Communi
 
 	config := configuration.Config
 
-	// Currently only support H264 encoded cameras, this will change.
-	// Establishing the camera connection
-	log.Log.Info("RunAgent: opening RTSP stream")
-	rtspUrl := config.Capture.IPCamera.RTSP
-	infile, streams, err := capture.OpenRTSP(rtspUrl)
+	// H264 and H265 encoded cameras are supported.
+	// Establishing the camera connection, USB and Raspberry Pi cameras
+	// are accessed through V4L2.
+	var infile av.DemuxCloser
+	var streams []av.CodecData
+	var subInfile av.DemuxCloser
+	var subStreams []av.CodecData
+	var err error
+	switch config.Capture.ID {
+	case "usbcamera":
+		usbCamera := config.Capture.USBCamera
+		fps, _ := strconv.Atoi(usbCamera.FPS)
+		log.Log.Info("RunAgent: opening USB camera " + usbCamera.Device)
+		infile, streams, err = capture.OpenUSBCamera(usbCamera.Device, usbCamera.Width, usbCamera.Height, fps)
+	case "raspicamera":
+		raspiCamera := config.Capture.RaspiCamera
+		fps, _ := strconv.Atoi(raspiCamera.FPS)
+		log.Log.Info("RunAgent: opening Raspberry Pi camera " + raspiCamera.Device)
+		infile, streams, err = capture.OpenUSBCamera(raspiCamera.Device, raspiCamera.Width, raspiCamera.Height, fps)
+	default:
+		rtspUrl := config.Capture.IPCamera.RTSP
+		if capture.IsFileURL(rtspUrl) {
+			// A local recording, which is played as if it was a camera.
+			log.Log.Info("RunAgent: opening file " + rtspUrl)
+			infile, streams, err = capture.OpenFile(rtspUrl)
+		} else {
+			log.Log.Info("RunAgent: opening RTSP stream")
+			infile, streams, err = capture.OpenRTSP(rtspUrl)
+		}
+
+		// A low resolution substream is optional, it's used for motion detection
+		// and the SD livestream. If it can't be opened, the main stream is used.
+		subRtspUrl := config.Capture.IPCamera.SubRTSP
+		if err == nil && subRtspUrl != "" {
+			log.Log.Info("RunAgent: opening RTSP substream")
+			var subErr error
+			if capture.IsFileURL(subRtspUrl) {
+				subInfile, subStreams, subErr = capture.OpenFile(subRtspUrl)
+			} else {
+				subInfile, subStreams, subErr = capture.OpenRTSP(subRtspUrl)
+			}
+			if subErr != nil {
+				log.Log.Error("RunAgent: could not open the substream, using the main stream: " + subErr.Error())
+				subInfile = nil
+			}
+		}
+	}
 
 	//var decoder *ffmpeg.VideoDecoder
 	var queue *pubsub.Queue
@@ -81,7 +175,6 @@ func RunAgent(configuration *models.Configuration, communication *models.Communi
 		queue.WriteHeader(streams)
 
 		// Configure a MQTT client which helps for a bi-directional communication
-		communication.HandleONVIF = make(chan models.OnvifAction, 1)
 		mqttClient := routers.ConfigureMQTT(configuration, communication)
 
 		// Handle heartbeats
@@ -90,14 +183,39 @@ func RunAgent(configuration *models.Configuration, communication *models.Communi
 		// Handle the camera stream
 		go capture.HandleStream(infile, queue, communication) //, &wg)
 
+		// Motion detection and the SD livestream use the substream, if there is one,
+		// which has its own queue and decoder.
+		motionQueue := queue
+		motionDecoder := decoder
+		motionDecoderMutex := &decoderMutex
+		regionScale := 1.0
+		var subQueue *pubsub.Queue
+		var subDecoder *capture.VideoDecoder
+		if subInfile != nil {
+			var subDecoderMutex sync.Mutex
+			subDecoder = capture.GetVideoDecoder(subStreams)
+			subQueue = pubsub.NewQueue()
+			subQueue.SetMaxGopCount(5)
+			subQueue.WriteHeader(subStreams)
+			go capture.HandleSubStream(subInfile, subQueue, communication)
+
+			motionQueue = subQueue
+			motionDecoder = subDecoder
+			motionDecoderMutex = &subDecoderMutex
+			regionScale = computervision.RegionScale(streams, subStreams)
+		}
+
 		// Handle processing of motion
-		motionCursor := queue.Oldest()
-		communication.HandleMotion = make(chan int64, 1)
-		go computervision.ProcessMotion(motionCursor, configuration, communication, mqttClient, decoder, &decoderMutex)
+		motionCursor := motionQueue.Oldest()
+		go computervision.ProcessMotion(motionCursor, configuration, communication, mqttClient, motionDecoder, motionDecoderMutex, regionScale)
+
+		// Handle tamper detection (covered, defocused or moved camera)
+		tamperCursor := motionQueue.Oldest()
+		go computervision.ProcessTamper(tamperCursor, configuration, communication, mqttClient, motionDecoder, motionDecoderMutex)
 
 		// Handle livestream SD (low resolution over MQTT)
-		livestreamCursor := queue.Oldest()
-		go cloud.HandleLiveStreamSD(livestreamCursor, configuration, communication, mqttClient, decoder, &decoderMutex)
+		livestreamCursor := motionQueue.Oldest()
+		go cloud.HandleLiveStreamSD(livestreamCursor, configuration, communication, mqttClient, motionDecoder, motionDecoderMutex)
 
 		// Handle livestream HD (high resolution over WEBRTC)
 		livestreamHDCursor := queue.Oldest()
@@ -108,9 +226,6 @@ func RunAgent(configuration *models.Configuration, communication *models.Communi
 		recordingCursor := queue.Oldest()
 		go capture.HandleRecordStream(recordingCursor, configuration, communication, streams)
 
-		// Handle Upload to cloud provider (Kerberos Hub, Kerberos Vault and others)
-		go cloud.HandleUpload(configuration, communication)
-
 		// Handle ONVIF actions
 		go onvif.HandleONVIFActions(configuration, communication)
 
@@ -122,21 +237,32 @@ func RunAgent(configuration *models.Configuration, communication *models.Communi
 		// Here we are cleaning up everything!
 		communication.HandleStream <- "stop"
 		communication.HandleHeartBeat <- "stop"
-		communication.HandleUpload <- "stop"
 		infile.Close()
 		queue.Close()
-		close(communication.HandleONVIF)
+		if subInfile != nil {
+			communication.HandleSubStream <- "stop"
+			subInfile.Close()
+			subQueue.Close()
+		}
+		communication.HandleONVIFActions <- "stop"
 		close(communication.HandleLiveHDHandshake)
-		close(communication.HandleMotion)
 		routers.DisconnectMQTT(mqttClient)
 		decoder.Close()
+		if subDecoder != nil {
+			subDecoder.Close()
+		}
 
 		// Waiting for some seconds to make sure everything is properly closed.
 		log.Log.Info("RunAgent: waiting 1 second to make sure everything is properly closed.")
 		time.Sleep(time.Second * 1)
 	} else {
-		log.Log.Error("Something went wrong while opening RTSP: " + err.Error())
-		time.Sleep(time.Second * 3)
+		log.Log.Error("Something went wrong while opening the camera: " + err.Error())
+
+		// We might be stopped or restarted while the camera is not available.
+		select {
+		case status = <-communication.HandleBootstrap:
+		case <-time.After(time.Second * 3):
+		}
 	}
 
 	log.Log.Debug("RunAgent: finished")
@@ -152,6 +278,13 @@ func ControlAgent(communication *models.Communication) {
 		var previousPacket int64 = 0
 		var occurence = 0
 		for {
+			// The camera was stopped.
+			select {
+			case <-communication.HandleControlAgent:
+				return
+			default:
+			}
+
 			packetsR := packageCounter.Load().(int64)
 			if packetsR == previousPacket {
 				// If we are already reconfiguring,
@@ -168,7 +301,10 @@ func ControlAgent(communication *models.Communication) {
 			// After 15 seconds without activity this is thrown..
 			if occurence == 3 {
 				log.Log.Info("Main: Restarting machinery.")
-				communication.HandleBootstrap <- "restart"
+				select {
+				case communication.HandleBootstrap <- "restart":
+				default:
+				}
 				time.Sleep(2 * time.Second)
 				occurence = 0
 			}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/deepch/vdk/av"
 	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
 	"github.com/deepch/vdk/format/rtsp"
 )
 
@@ -63,7 +64,7 @@ func (s Stream) GetCodecs() []av.CodecData {
 
 func (s Stream) ReadPackets(packetChannel chan av.Packet) {
 	session := s.Open()
-	fmt.Println("Start reading H264 packages from stream")
+	fmt.Println("Start reading packages from stream")
 	for {
 		packet, err := session.ReadPacket()
 		if err != nil {
@@ -77,6 +78,9 @@ func (s Stream) ReadPackets(packetChannel chan av.Packet) {
 }
 
 func GetSPSFromCodec(codecs []av.CodecData) ([]byte, []byte) {
+	if codec, ok := codecs[0].(h265parser.CodecData); ok {
+		return codec.SPS(), codec.PPS()
+	}
 	sps := codecs[0].(h264parser.CodecData).SPS()
 	pps := codecs[0].(h264parser.CodecData).PPS()
 	return sps, pps
@@ -0,0 +1,388 @@
+package components
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const userConfigFile = "./data/config/user.json"
+const jwtKeyFile = "./data/config/jwt.key"
+
+// MinimumPasswordLength is the minimum length of a password.
+const MinimumPasswordLength = 8
+
+// The default password of the former user store, which is never migrated.
+const defaultPassword = "root"
+
+var (
+	ErrAlreadyInstalled   = errors.New("the agent is already installed")
+	ErrNotInstalled       = errors.New("the agent is not installed yet")
+	ErrInvalidCredentials = errors.New("incorrect username or password")
+	ErrPasswordTooShort   = errors.New("the password should contain at least 8 characters")
+	ErrInvalidUsername    = errors.New("the username is not valid")
+	ErrInvalidRole        = errors.New("the role should be admin, operator or viewer")
+	ErrUserExists         = errors.New("a user with this username already exists")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrLastAdmin          = errors.New("the last admin user cannot be removed")
+	ErrInvalidSetupToken  = errors.New("the setup token is not valid, it's printed in the logs of the agent")
+)
+
+var userMutex sync.Mutex
+
+// The one-time token which is required to install the agent, so the first one to reach
+// the agent can't become admin. It's generated on startup and printed in the logs.
+var setupToken string
+
+// ReadUserConfig reads the user store of the Kerberos Agent. The former format, which
+// contained a single user with a plain text password, is migrated automatically. When
+// that user still has the default password, it's not migrated: the agent needs to be
+// installed with a new admin user instead.
+func ReadUserConfig() (userConfig models.UserConfig, err error) {
+	content, err := ioutil.ReadFile(userConfigFile)
+	if os.IsNotExist(err) {
+		return userConfig, nil
+	} else if err != nil {
+		return userConfig, err
+	}
+	if err = json.Unmarshal(content, &userConfig); err != nil {
+		return userConfig, err
+	}
+
+	// Migrate the single user format, and hash its password.
+	if len(userConfig.Users) == 0 {
+		var legacy models.User
+		if json.Unmarshal(content, &legacy) == nil && legacy.Password == defaultPassword {
+			userConfig = models.UserConfig{
+				Language: legacy.Language,
+			}
+			if err = WriteUserConfig(userConfig); err != nil {
+				return userConfig, err
+			}
+			log.Log.Info("ReadUserConfig: the default password of " + legacy.Username + " is not migrated, the agent needs to be installed.")
+		} else if legacy.Username != "" && legacy.Password != "" {
+			hash, err := HashPassword(legacy.Password)
+			if err != nil {
+				return userConfig, err
+			}
+			role := legacy.Role
+			if models.RoleLevel(role) == 0 {
+				role = models.RoleAdmin
+			}
+			userConfig = models.UserConfig{
+				Installed: true,
+				Language:  legacy.Language,
+				Users: []models.User{{
+					Username: legacy.Username,
+					Hash:     hash,
+					Role:     role,
+				}},
+			}
+			if err = WriteUserConfig(userConfig); err != nil {
+				return userConfig, err
+			}
+			log.Log.Info("ReadUserConfig: migrated user " + legacy.Username + " to a hashed password.")
+		}
+	}
+	return userConfig, nil
+}
+
+// WriteUserConfig persists the user store, the file is replaced atomically.
+func WriteUserConfig(userConfig models.UserConfig) error {
+	if userConfig.Users == nil {
+		userConfig.Users = []models.User{}
+	}
+	content, err := json.MarshalIndent(userConfig, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := userConfigFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, userConfigFile)
+}
+
+// HashPassword returns the bcrypt hash of a password.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// IsInstalled returns true when the first admin user has been created.
+func IsInstalled() bool {
+	userMutex.Lock()
+	defer userMutex.Unlock()
+	userConfig, err := ReadUserConfig()
+	return err == nil && userConfig.Installed
+}
+
+// CreateSetupToken generates the setup token when the agent isn't installed yet, and
+// prints it in the logs. It's called once when the agent starts.
+func CreateSetupToken() {
+	userMutex.Lock()
+	defer userMutex.Unlock()
+
+	userConfig, err := ReadUserConfig()
+	if err != nil || userConfig.Installed {
+		return
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		log.Log.Error("CreateSetupToken: could not generate a token, " + err.Error())
+		return
+	}
+	setupToken = hex.EncodeToString(random)
+	log.Log.Info("CreateSetupToken: the agent is not installed yet, use the setup token " + setupToken + " to create the admin user.")
+}
+
+// Install creates the first admin user, this can only be done once and requires the
+// setup token from the logs.
+func Install(username string, password string, language string, token string) error {
+	userMutex.Lock()
+	defer userMutex.Unlock()
+
+	userConfig, err := ReadUserConfig()
+	if err != nil {
+		return err
+	}
+	if userConfig.Installed {
+		return ErrAlreadyInstalled
+	}
+	if setupToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(setupToken)) != 1 {
+		return ErrInvalidSetupToken
+	}
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return ErrInvalidUsername
+	}
+	if len(password) < MinimumPasswordLength {
+		return ErrPasswordTooShort
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if language == "" {
+		language = userConfig.Language
+	}
+	if language == "" {
+		language = "en"
+	}
+	userConfig = models.UserConfig{
+		Installed: true,
+		Language:  language,
+		Users: []models.User{{
+			Username: username,
+			Hash:     hash,
+			Role:     models.RoleAdmin,
+		}},
+	}
+	if err := WriteUserConfig(userConfig); err != nil {
+		return err
+	}
+	setupToken = ""
+	log.Log.Info("Install: created admin user " + username)
+	return nil
+}
+
+// Authenticate verifies the password of a user, and returns the user without its hash.
+func Authenticate(username string, password string) (user models.User, err error) {
+	userMutex.Lock()
+	defer userMutex.Unlock()
+
+	userConfig, err := ReadUserConfig()
+	if err != nil {
+		return user, err
+	}
+	if !userConfig.Installed {
+		return user, ErrNotInstalled
+	}
+	for _, u := range userConfig.Users {
+		if u.Username == username {
+			if bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)) != nil {
+				break
+			}
+			u.Hash = ""
+			u.Password = ""
+			if u.Language == "" {
+				u.Language = userConfig.Language
+			}
+			return u, nil
+		}
+	}
+	return user, ErrInvalidCredentials
+}
+
+// ChangePassword changes the password of a user, the current password should be provided.
+func ChangePassword(username string, password string, newPassword string) error {
+	if len(newPassword) < MinimumPasswordLength {
+		return ErrPasswordTooShort
+	}
+
+	userMutex.Lock()
+	defer userMutex.Unlock()
+
+	userConfig, err := ReadUserConfig()
+	if err != nil {
+		return err
+	}
+	for i, u := range userConfig.Users {
+		if u.Username == username {
+			if bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)) != nil {
+				return ErrInvalidCredentials
+			}
+			hash, err := HashPassword(newPassword)
+			if err != nil {
+				return err
+			}
+			userConfig.Users[i].Hash = hash
+			if err := WriteUserConfig(userConfig); err != nil {
+				return err
+			}
+			log.Log.Info("ChangePassword: password changed for " + username)
+			return nil
+		}
+	}
+	return ErrInvalidCredentials
+}
+
+// GetUsers returns all users, without their password hashes.
+func GetUsers() (users []models.User, err error) {
+	userMutex.Lock()
+	defer userMutex.Unlock()
+
+	userConfig, err := ReadUserConfig()
+	if err != nil {
+		return users, err
+	}
+	users = []models.User{}
+	for _, u := range userConfig.Users {
+		u.Hash = ""
+		u.Password = ""
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// GetUser returns a user, without its password hash.
+func GetUser(username string) (user models.User, err error) {
+	users, err := GetUsers()
+	if err != nil {
+		return user, err
+	}
+	for _, u := range users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return user, ErrUserNotFound
+}
+
+// AddUser adds a user with one of the roles: admin, operator or viewer.
+func AddUser(user models.User) error {
+	user.Username = strings.TrimSpace(user.Username)
+	if user.Username == "" {
+		return ErrInvalidUsername
+	}
+	if models.RoleLevel(user.Role) == 0 {
+		return ErrInvalidRole
+	}
+	if len(user.Password) < MinimumPasswordLength {
+		return ErrPasswordTooShort
+	}
+
+	userMutex.Lock()
+	defer userMutex.Unlock()
+
+	userConfig, err := ReadUserConfig()
+	if err != nil {
+		return err
+	}
+	if !userConfig.Installed {
+		return ErrNotInstalled
+	}
+	for _, u := range userConfig.Users {
+		if u.Username == user.Username {
+			return ErrUserExists
+		}
+	}
+	hash, err := HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+	userConfig.Users = append(userConfig.Users, models.User{
+		Username: user.Username,
+		Hash:     hash,
+		Role:     user.Role,
+		Language: user.Language,
+	})
+	if err := WriteUserConfig(userConfig); err != nil {
+		return err
+	}
+	log.Log.Info("AddUser: created " + user.Role + " user " + user.Username)
+	return nil
+}
+
+// DeleteUser removes a user, the last admin user cannot be removed.
+func DeleteUser(username string) error {
+	userMutex.Lock()
+	defer userMutex.Unlock()
+
+	userConfig, err := ReadUserConfig()
+	if err != nil {
+		return err
+	}
+	admins := 0
+	index := -1
+	for i, u := range userConfig.Users {
+		if u.Role == models.RoleAdmin {
+			admins++
+		}
+		if u.Username == username {
+			index = i
+		}
+	}
+	if index < 0 {
+		return ErrUserNotFound
+	}
+	if userConfig.Users[index].Role == models.RoleAdmin && admins == 1 {
+		return ErrLastAdmin
+	}
+	userConfig.Users = append(userConfig.Users[:index], userConfig.Users[index+1:]...)
+	if err := WriteUserConfig(userConfig); err != nil {
+		return err
+	}
+	log.Log.Info("DeleteUser: removed user " + username)
+	return nil
+}
+
+// GetJWTKey returns the key which is used to sign the JWT tokens. A random key
+// is generated the first time, and persisted so tokens survive a restart.
+func GetJWTKey() []byte {
+	content, err := ioutil.ReadFile(jwtKeyFile)
+	if err == nil && len(strings.TrimSpace(string(content))) >= 32 {
+		return []byte(strings.TrimSpace(string(content)))
+	}
+
+	random := make([]byte, 64)
+	if _, err := rand.Read(random); err != nil {
+		log.Log.Error("GetJWTKey: could not generate a key, " + err.Error())
+		os.Exit(1)
+	}
+	key := hex.EncodeToString(random)
+	if err := ioutil.WriteFile(jwtKeyFile, []byte(key), 0600); err != nil {
+		log.Log.Error("GetJWTKey: could not persist the key, tokens will be invalid after a restart, " + err.Error())
+	}
+	return []byte(key)
+}
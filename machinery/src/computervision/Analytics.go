@@ -0,0 +1,146 @@
+package computervision
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/webhook"
+)
+
+// The maximum distance an object moves between two frames, as a fraction of the width
+// of the image.
+const maxTrackDistance = 0.15
+
+// analytics tracks the blobs of the motion detection, and evaluates the tripwires and
+// dwells of the region. The coordinates are those of the region (the main stream).
+type analytics struct {
+	tracker   *tracker
+	tripwires []models.Tripwire
+	dwells    []models.Dwell
+	countIn   map[string]int
+	countOut  map[string]int
+}
+
+// newAnalytics returns the analytics of the region, or nil if the region has no rules.
+// The width is the width of the image in the coordinates of the region.
+func newAnalytics(region *models.Region, width float64) *analytics {
+	if region == nil || (len(region.Tripwires) == 0 && len(region.Dwells) == 0) {
+		return nil
+	}
+	return &analytics{
+		tracker:   newTracker(width * maxTrackDistance),
+		tripwires: region.Tripwires,
+		dwells:    region.Dwells,
+		countIn:   make(map[string]int),
+		countOut:  make(map[string]int),
+	}
+}
+
+// update tracks the blobs of a frame, and returns the events of the rules which fired.
+func (a *analytics) update(blobs []models.Blob, now time.Time) []models.AnalyticsEvent {
+	var events []models.AnalyticsEvent
+	for _, tr := range a.tracker.update(blobs) {
+		for _, tripwire := range a.tripwires {
+			direction := crossing(tripwire, tr.previous, tr.centroid)
+			if direction == "" || (tripwire.Direction != "" && tripwire.Direction != direction) {
+				continue
+			}
+			if direction == models.DirectionIn {
+				a.countIn[tripwire.ID]++
+			} else {
+				a.countOut[tripwire.ID]++
+			}
+			events = append(events, models.AnalyticsEvent{
+				Event:     models.EventLineCrossing,
+				Rule:      tripwire.ID,
+				Name:      tripwire.Name,
+				Track:     tr.id,
+				Position:  tr.centroid,
+				Timestamp: now.Unix(),
+				Direction: direction,
+				CountIn:   a.countIn[tripwire.ID],
+				CountOut:  a.countOut[tripwire.ID],
+			})
+		}
+
+		for _, dwell := range a.dwells {
+			if !insidePolygon(dwell.Coordinates, tr.centroid) {
+				delete(tr.entered, dwell.ID)
+				delete(tr.loitered, dwell.ID)
+				continue
+			}
+			entered, ok := tr.entered[dwell.ID]
+			if !ok {
+				tr.entered[dwell.ID] = now
+				continue
+			}
+			duration := now.Sub(entered)
+			if !tr.loitered[dwell.ID] && duration >= time.Duration(dwell.Duration)*time.Second {
+				tr.loitered[dwell.ID] = true
+				events = append(events, models.AnalyticsEvent{
+					Event:     models.EventLoitering,
+					Rule:      dwell.ID,
+					Name:      dwell.Name,
+					Track:     tr.id,
+					Position:  tr.centroid,
+					Timestamp: now.Unix(),
+					Duration:  int(duration.Seconds()),
+				})
+			}
+		}
+	}
+	return events
+}
+
+// crossing returns the direction in which the movement (from, to) crosses the tripwire,
+// or an empty string if it doesn't cross.
+func crossing(tripwire models.Tripwire, from models.Coordinate, to models.Coordinate) string {
+	sideFrom := side(tripwire.Start, tripwire.End, from)
+	sideTo := side(tripwire.Start, tripwire.End, to)
+	if sideFrom == 0 || sideTo == 0 || (sideFrom > 0) == (sideTo > 0) {
+		return ""
+	}
+	// The movement should cross the line between its start and end.
+	sideStart := side(from, to, tripwire.Start)
+	sideEnd := side(from, to, tripwire.End)
+	if (sideStart > 0) == (sideEnd > 0) && sideStart != 0 && sideEnd != 0 {
+		return ""
+	}
+	if sideTo > 0 {
+		return models.DirectionIn
+	}
+	return models.DirectionOut
+}
+
+// side returns the cross product of (a, b) and (a, p), which is positive if the point p is
+// on the right side of the line from a to b (the y axis of an image points downwards).
+func side(a models.Coordinate, b models.Coordinate, p models.Coordinate) float64 {
+	return (b.X-a.X)*(p.Y-a.Y) - (b.Y-a.Y)*(p.X-a.X)
+}
+
+// insidePolygon returns true if the point is inside the polygon (ray casting).
+func insidePolygon(polygon []models.Coordinate, p models.Coordinate) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Y > p.Y) != (b.Y > p.Y) && p.X < (b.X-a.X)*(p.Y-a.Y)/(b.Y-a.Y)+a.X {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// sendAnalyticsEvent publishes the event of a rule over MQTT and to the webhook.
+func sendAnalyticsEvent(configuration *models.Configuration, mqttClient mqtt.Client, event models.AnalyticsEvent) {
+	config := configuration.Config
+	event.Camera = configuration.Camera
+	log.Log.Info("ProcessMotion: " + event.Event + " of track " + strconv.Itoa(event.Track) + " (rule " + event.Rule + ")")
+
+	payload, _ := json.Marshal(event)
+	mqttClient.Publish("kerberos/"+config.HubKey+"/device/"+config.Key+"/analytics/"+event.Event, 2, false, payload)
+	go webhook.Send(config.WebhookURI, event)
+}
@@ -0,0 +1,212 @@
+package computervision
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+func point(x float64, y float64) models.Coordinate {
+	return models.Coordinate{X: x, Y: y}
+}
+
+func TestCrossing(t *testing.T) {
+	// A horizontal tripwire, in is downwards (the right side of the line from start to end).
+	tripwire := models.Tripwire{ID: "door", Start: point(0, 50), End: point(100, 50)}
+	tests := []struct {
+		name      string
+		from      models.Coordinate
+		to        models.Coordinate
+		direction string
+	}{
+		{name: "inward", from: point(50, 40), to: point(50, 60), direction: models.DirectionIn},
+		{name: "outward", from: point(50, 60), to: point(50, 40), direction: models.DirectionOut},
+		{name: "diagonal inward", from: point(10, 0), to: point(90, 100), direction: models.DirectionIn},
+		{name: "same side", from: point(50, 10), to: point(50, 40), direction: ""},
+		{name: "parallel", from: point(0, 40), to: point(100, 40), direction: ""},
+		{name: "no movement", from: point(50, 40), to: point(50, 40), direction: ""},
+		{name: "beyond the end", from: point(150, 40), to: point(150, 60), direction: ""},
+		{name: "before the start", from: point(-1, 40), to: point(-1, 60), direction: ""},
+		{name: "through the end", from: point(100, 40), to: point(100, 60), direction: models.DirectionIn},
+		{name: "through the start", from: point(0, 60), to: point(0, 40), direction: models.DirectionOut},
+		{name: "from the line", from: point(50, 50), to: point(50, 60), direction: ""},
+		{name: "to the line", from: point(50, 40), to: point(50, 50), direction: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if direction := crossing(tripwire, test.from, test.to); direction != test.direction {
+				t.Errorf("direction %q, expected %q", direction, test.direction)
+			}
+		})
+	}
+}
+
+func TestInsidePolygon(t *testing.T) {
+	// A U shape, the gap is between x 40 and 60 above y 50.
+	polygon := []models.Coordinate{
+		point(0, 0), point(40, 0), point(40, 50), point(60, 50),
+		point(60, 0), point(100, 0), point(100, 100), point(0, 100),
+	}
+	tests := []struct {
+		point  models.Coordinate
+		inside bool
+	}{
+		{point(20, 20), true},
+		{point(80, 20), true},
+		{point(50, 80), true},
+		{point(50, 20), false},
+		{point(150, 50), false},
+		{point(-10, 50), false},
+		{point(50, 110), false},
+	}
+	for _, test := range tests {
+		if inside := insidePolygon(polygon, test.point); inside != test.inside {
+			t.Errorf("point %v: inside %t, expected %t", test.point, inside, test.inside)
+		}
+	}
+}
+
+func TestAnalyticsNoRules(t *testing.T) {
+	if newAnalytics(nil, 1000) != nil || newAnalytics(&models.Region{}, 1000) != nil {
+		t.Error("no analytics expected without tripwires and dwells")
+	}
+}
+
+// frame is a moment at which blobs are detected, and the events which are expected.
+type frame struct {
+	at     time.Duration
+	blobs  []models.Blob
+	events []models.AnalyticsEvent
+}
+
+func runFrames(t *testing.T, a *analytics, frames []frame) {
+	t.Helper()
+	start := time.Date(2023, time.January, 1, 12, 0, 0, 0, time.UTC)
+	for i, f := range frames {
+		events := a.update(f.blobs, start.Add(f.at))
+		if len(events) != len(f.events) {
+			t.Fatalf("frame %d: %d events, expected %d (%+v)", i, len(events), len(f.events), events)
+		}
+		for j, expected := range f.events {
+			expected.Timestamp = start.Add(f.at).Unix()
+			if events[j] != expected {
+				t.Errorf("frame %d: event %+v, expected %+v", i, events[j], expected)
+			}
+		}
+	}
+}
+
+func TestAnalyticsTripwire(t *testing.T) {
+	tests := []struct {
+		name      string
+		direction string
+		frames    []frame
+	}{
+		{
+			name: "both directions are counted",
+			frames: []frame{
+				{at: 0, blobs: []models.Blob{blobAt(50, 40)}},
+				{at: time.Second, blobs: []models.Blob{blobAt(50, 60)}, events: []models.AnalyticsEvent{
+					{Event: models.EventLineCrossing, Rule: "door", Name: "Door", Track: 1, Position: point(50, 60), Direction: models.DirectionIn, CountIn: 1},
+				}},
+				{at: 2 * time.Second, blobs: []models.Blob{blobAt(50, 45)}, events: []models.AnalyticsEvent{
+					{Event: models.EventLineCrossing, Rule: "door", Name: "Door", Track: 1, Position: point(50, 45), Direction: models.DirectionOut, CountIn: 1, CountOut: 1},
+				}},
+			},
+		},
+		{
+			name:      "only the direction of the tripwire is counted",
+			direction: models.DirectionIn,
+			frames: []frame{
+				{at: 0, blobs: []models.Blob{blobAt(50, 60)}},
+				{at: time.Second, blobs: []models.Blob{blobAt(50, 40)}},
+				{at: 2 * time.Second, blobs: []models.Blob{blobAt(50, 60)}, events: []models.AnalyticsEvent{
+					{Event: models.EventLineCrossing, Rule: "door", Name: "Door", Track: 1, Position: point(50, 60), Direction: models.DirectionIn, CountIn: 1},
+				}},
+			},
+		},
+		{
+			name: "a new object doesn't cross",
+			frames: []frame{
+				{at: 0, blobs: []models.Blob{blobAt(50, 40)}},
+				{at: time.Second, blobs: []models.Blob{blobAt(50, 400)}},
+			},
+		},
+		{
+			name: "every object is counted",
+			frames: []frame{
+				{at: 0, blobs: []models.Blob{blobAt(20, 40), blobAt(80, 60)}},
+				{at: time.Second, blobs: []models.Blob{blobAt(20, 55), blobAt(80, 40)}, events: []models.AnalyticsEvent{
+					{Event: models.EventLineCrossing, Rule: "door", Name: "Door", Track: 1, Position: point(20, 55), Direction: models.DirectionIn, CountIn: 1},
+					{Event: models.EventLineCrossing, Rule: "door", Name: "Door", Track: 2, Position: point(80, 40), Direction: models.DirectionOut, CountIn: 1, CountOut: 1},
+				}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			region := &models.Region{Tripwires: []models.Tripwire{
+				{ID: "door", Name: "Door", Start: point(0, 50), End: point(100, 50), Direction: test.direction},
+			}}
+			runFrames(t, newAnalytics(region, 200), test.frames)
+		})
+	}
+}
+
+func TestAnalyticsDwell(t *testing.T) {
+	region := &models.Region{Dwells: []models.Dwell{
+		{ID: "entrance", Name: "Entrance", Duration: 5, Coordinates: []models.Coordinate{
+			point(0, 0), point(100, 0), point(100, 100), point(0, 100),
+		}},
+	}}
+	loitering := func(position models.Coordinate, duration int) []models.AnalyticsEvent {
+		return []models.AnalyticsEvent{{
+			Event: models.EventLoitering, Rule: "entrance", Name: "Entrance", Track: 1, Position: position, Duration: duration,
+		}}
+	}
+	tests := []struct {
+		name   string
+		frames []frame
+	}{
+		{
+			name: "loitering once the duration is reached",
+			frames: []frame{
+				{at: 0, blobs: []models.Blob{blobAt(50, 50)}},
+				{at: 4 * time.Second, blobs: []models.Blob{blobAt(52, 50)}},
+				{at: 5 * time.Second, blobs: []models.Blob{blobAt(54, 50)}, events: loitering(point(54, 50), 5)},
+				{at: 8 * time.Second, blobs: []models.Blob{blobAt(56, 50)}},
+			},
+		},
+		{
+			name: "the timer restarts when the object leaves",
+			frames: []frame{
+				{at: 0, blobs: []models.Blob{blobAt(90, 50)}},
+				{at: 3 * time.Second, blobs: []models.Blob{blobAt(110, 50)}},
+				{at: 4 * time.Second, blobs: []models.Blob{blobAt(90, 50)}},
+				{at: 8 * time.Second, blobs: []models.Blob{blobAt(90, 50)}},
+				{at: 9 * time.Second, blobs: []models.Blob{blobAt(90, 50)}, events: loitering(point(90, 50), 5)},
+			},
+		},
+		{
+			name: "an object outside doesn't loiter",
+			frames: []frame{
+				{at: 0, blobs: []models.Blob{blobAt(150, 50)}},
+				{at: 10 * time.Second, blobs: []models.Blob{blobAt(150, 50)}},
+			},
+		},
+		{
+			name: "a track which disappeared for a moment keeps its timer",
+			frames: []frame{
+				{at: 0, blobs: []models.Blob{blobAt(50, 50)}},
+				{at: 2 * time.Second},
+				{at: 6 * time.Second, blobs: []models.Blob{blobAt(50, 50)}, events: loitering(point(50, 50), 6)},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runFrames(t, newAnalytics(region, 200), test.frames)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package computervision
+
+import (
+	"gocv.io/x/gocv"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// FindBlobs extracts the contours of the changed pixels, and returns them as blobs with
+// their bounding box, area and centroid. Blobs smaller than minArea or larger than maxArea
+// (when not 0) are ignored, e.g. rain, insects or a change of lighting.
+func FindBlobs(changed gocv.Mat, minArea int, maxArea int) []models.Blob {
+	contours := gocv.FindContours(changed, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+	defer contours.Close()
+
+	var blobs []models.Blob
+	for i := 0; i < contours.Size(); i++ {
+		contour := contours.At(i)
+		area := int(gocv.ContourArea(contour) + 0.5)
+		if area < minArea || (maxArea > 0 && area > maxArea) {
+			continue
+		}
+		bounds := gocv.BoundingRect(contour)
+		blobs = append(blobs, models.Blob{
+			Rectangle: models.Rectangle{X1: bounds.Min.X, Y1: bounds.Min.Y, X2: bounds.Max.X - 1, Y2: bounds.Max.Y - 1},
+			Area:      area,
+			Centroid:  centroid(contour, bounds.Min.X, bounds.Min.Y, bounds.Max.X-1, bounds.Max.Y-1),
+		})
+	}
+	return blobs
+}
+
+// centroid returns the centroid of the polygon of a contour. For contours without an area
+// (a line or a single point) the center of the bounding box is returned.
+func centroid(contour gocv.PointVector, x1 int, y1 int, x2 int, y2 int) models.Coordinate {
+	points := contour.ToPoints()
+	var area, cx, cy float64
+	for i := range points {
+		p, q := points[i], points[(i+1)%len(points)]
+		cross := float64(p.X*q.Y - q.X*p.Y)
+		area += cross
+		cx += float64(p.X+q.X) * cross
+		cy += float64(p.Y+q.Y) * cross
+	}
+	if area == 0 {
+		return models.Coordinate{X: float64(x1+x2) / 2, Y: float64(y1+y2) / 2}
+	}
+	return models.Coordinate{X: cx / (3 * area), Y: cy / (3 * area)}
+}
+
+// scaleBlob maps a blob of the motion image to the main stream.
+func scaleBlob(blob models.Blob, regionScale float64) models.Blob {
+	return models.Blob{
+		Rectangle: scaleRectangle(blob.Rectangle, regionScale),
+		Area:      int(float64(blob.Area) / (regionScale * regionScale)),
+		Centroid:  models.Coordinate{X: blob.Centroid.X / regionScale, Y: blob.Centroid.Y / regionScale},
+	}
+}
+
+// scaleRectangle maps a rectangle of the motion image to the main stream.
+func scaleRectangle(rectangle models.Rectangle, regionScale float64) models.Rectangle {
+	return models.Rectangle{
+		X1: int(float64(rectangle.X1) / regionScale),
+		Y1: int(float64(rectangle.Y1) / regionScale),
+		X2: int(float64(rectangle.X2) / regionScale),
+		Y2: int(float64(rectangle.Y2) / regionScale),
+	}
+}
@@ -0,0 +1,105 @@
+package computervision
+
+import (
+	"strconv"
+
+	"gocv.io/x/gocv"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// The motion detectors which can be selected per camera (capture.motiondetector).
+const (
+	DetectorFrameDifference = "framedifference"
+	DetectorMOG2            = "mog2"
+	DetectorKNN             = "knn"
+)
+
+// Default number of frames of the background model, when no learning rate is set.
+const defaultHistory = 500
+
+// Default percentage of the image which should change to be a scene change.
+const defaultSceneChangeThreshold = 50
+
+// Detector returns the foreground of the current frame, which are the pixels that
+// changed. The frames are the three most recent frames, the last one is the current.
+type Detector interface {
+	Foreground(frames [3]*gocv.Mat, pool *MatPool) gocv.Mat
+	Close()
+}
+
+// NewDetector creates the motion detector of the camera, by default the three most
+// recent frames are compared. A background subtractor (MOG2 or KNN) learns a model of
+// the background, so slow changes such as clouds are not detected as motion. Its
+// foreground is binary, so the sensitivity of a zone only applies to frame differencing.
+func NewDetector(capture models.Capture) Detector {
+	// OpenCV uses a learning rate of 1/history.
+	history := defaultHistory
+	if capture.LearningRate > 0 && capture.LearningRate <= 1 {
+		history = int(1/capture.LearningRate + 0.5)
+	}
+
+	switch capture.MotionDetector {
+	case DetectorMOG2:
+		log.Log.Info("NewDetector: using a MOG2 background subtractor with a history of " + strconv.Itoa(history) + " frames.")
+		mog2 := gocv.NewBackgroundSubtractorMOG2WithParams(history, 16, false)
+		return &backgroundSubtractor{subtractor: &mog2}
+	case DetectorKNN:
+		log.Log.Info("NewDetector: using a KNN background subtractor with a history of " + strconv.Itoa(history) + " frames.")
+		knn := gocv.NewBackgroundSubtractorKNNWithParams(history, 400, false)
+		return &backgroundSubtractor{subtractor: &knn}
+	default:
+		return frameDifference{}
+	}
+}
+
+// frameDifference compares the current frame with the two previous frames.
+type frameDifference struct{}
+
+func (frameDifference) Foreground(frames [3]*gocv.Mat, pool *MatPool) gocv.Mat {
+	return DifferenceImage(frames, pool)
+}
+
+func (frameDifference) Close() {}
+
+// backgroundSubtractor updates a model of the background with every frame, the foreground
+// is a binary image.
+type backgroundSubtractor struct {
+	subtractor interface {
+		Apply(src gocv.Mat, dst *gocv.Mat)
+		Close() error
+	}
+}
+
+func (b *backgroundSubtractor) Foreground(frames [3]*gocv.Mat, pool *MatPool) gocv.Mat {
+	foreground := pool.Get(frames[2].Rows(), frames[2].Cols(), gocv.MatTypeCV8UC1)
+	b.subtractor.Apply(*frames[2], &foreground)
+	return foreground
+}
+
+func (b *backgroundSubtractor) Close() {
+	b.subtractor.Close()
+}
+
+// SceneChanged returns true if more than the threshold (a percentage) of the pixels of
+// the foreground changed. This is caused by a change of the scene (e.g. auto exposure,
+// the IR cut filter or the camera being moved), and shouldn't be detected as motion.
+func SceneChanged(foreground gocv.Mat, threshold int) bool {
+	if threshold <= 0 {
+		threshold = defaultSceneChangeThreshold
+	}
+	if threshold >= 100 {
+		return false
+	}
+	return ChangedPercentage(foreground) > float64(threshold)
+}
+
+// ChangedPercentage returns the percentage of the pixels of the foreground which changed.
+func ChangedPercentage(foreground gocv.Mat) float64 {
+	changed := gocv.NewMat()
+	gocv.Threshold(foreground, &changed, float32(differenceThreshold(defaultSensitivity)), 255.0, gocv.ThresholdBinary)
+	changes := gocv.CountNonZero(changed)
+	changed.Close()
+	return float64(changes) * 100 / float64(foreground.Rows()*foreground.Cols())
+}
@@ -0,0 +1,79 @@
+package computervision
+
+import (
+	"sync"
+
+	"gocv.io/x/gocv"
+)
+
+// Maximum number of unused Mats of the same size and type, which are kept in a pool.
+const matPoolSize = 8
+
+type matKey struct {
+	rows int
+	cols int
+	mt   gocv.MatType
+}
+
+// MatPool keeps the Mats which are no longer used, so they can be reused for the next
+// frames (of the same size and type), instead of allocating memory for every frame.
+// A nil pool can be used as well, then Mats are created and closed.
+type MatPool struct {
+	mutex sync.Mutex
+	mats  map[matKey][]gocv.Mat
+}
+
+// NewMatPool creates an empty pool.
+func NewMatPool() *MatPool {
+	return &MatPool{
+		mats: make(map[matKey][]gocv.Mat),
+	}
+}
+
+// Get returns a Mat of the given size and type, its content is undefined.
+func (p *MatPool) Get(rows int, cols int, mt gocv.MatType) gocv.Mat {
+	if p != nil {
+		key := matKey{rows: rows, cols: cols, mt: mt}
+		p.mutex.Lock()
+		mats := p.mats[key]
+		if len(mats) > 0 {
+			mat := mats[len(mats)-1]
+			p.mats[key] = mats[:len(mats)-1]
+			p.mutex.Unlock()
+			return mat
+		}
+		p.mutex.Unlock()
+	}
+	return gocv.NewMatWithSize(rows, cols, mt)
+}
+
+// Put returns a Mat to the pool, it shouldn't be used afterwards.
+func (p *MatPool) Put(mat gocv.Mat) {
+	if p == nil || mat.Empty() || !mat.IsContinuous() {
+		mat.Close()
+		return
+	}
+	key := matKey{rows: mat.Rows(), cols: mat.Cols(), mt: mat.Type()}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.mats[key]) >= matPoolSize {
+		mat.Close()
+		return
+	}
+	p.mats[key] = append(p.mats[key], mat)
+}
+
+// Close releases all the Mats of the pool.
+func (p *MatPool) Close() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, mats := range p.mats {
+		for _, mat := range mats {
+			mat.Close()
+		}
+		delete(p.mats, key)
+	}
+}
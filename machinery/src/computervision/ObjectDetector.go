@@ -0,0 +1,297 @@
+package computervision
+
+import (
+	"errors"
+	"image"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"gocv.io/x/gocv"
+
+	"github.com/kerberos-io/agent/machinery/src/capture"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// The backends of the object detection (capture.objectdetection.backend).
+const (
+	BackendOpenCV = "opencv"
+)
+
+// The defaults of the object detection, see models.ObjectDetection.
+const (
+	defaultConfidence   = 0.5
+	defaultNMSThreshold = 0.4
+	defaultInputSize    = 416
+)
+
+// ObjectDetector detects objects in a (BGR) image, the rectangles of the objects are
+// expressed in pixels of the image.
+type ObjectDetector interface {
+	Detect(img gocv.Mat) ([]models.Object, error)
+	Close()
+}
+
+// NewObjectDetector creates the object detector of the backend in the configuration.
+func NewObjectDetector(settings *models.ObjectDetection) (ObjectDetector, error) {
+	switch settings.Backend {
+	case "", BackendOpenCV:
+		return newDNNDetector(settings)
+	default:
+		return nil, errors.New("NewObjectDetector: unknown backend " + settings.Backend)
+	}
+}
+
+// detectObjects runs the object detector on the frame, and returns the objects which
+// overlap with the motion and their labels. The rectangles are expressed in pixels of
+// the motion image, which is width pixels wide.
+func detectObjects(detector ObjectDetector, frame *capture.Frame, width int, motion models.Rectangle, pool *MatPool) ([]models.Object, []string) {
+	bgr, err := ToBGR(frame.Image, pool)
+	if err != nil {
+		log.Log.Error("detectObjects: " + err.Error())
+		return nil, nil
+	}
+	detected, err := detector.Detect(bgr)
+	pool.Put(bgr)
+	if err != nil {
+		log.Log.Error("detectObjects: " + err.Error())
+		return nil, nil
+	}
+
+	scale := float64(frame.Width()) / float64(width)
+	var objects []models.Object
+	var labels []string
+	seen := make(map[string]bool)
+	for _, object := range detected {
+		object.Rectangle = scaleRectangle(object.Rectangle, scale)
+		if !overlaps(object.Rectangle, motion) {
+			continue
+		}
+		objects = append(objects, object)
+		if !seen[object.Label] {
+			seen[object.Label] = true
+			labels = append(labels, object.Label)
+		}
+	}
+	return objects, labels
+}
+
+// containsClass returns true if one of the labels is one of the classes, or if there
+// are no classes (every object is accepted).
+func containsClass(labels []string, classes []string) bool {
+	if len(classes) == 0 {
+		return true
+	}
+	for _, label := range labels {
+		for _, class := range classes {
+			if strings.EqualFold(label, class) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// overlaps returns true if both rectangles (x1,y1,x2,y2) have pixels in common.
+func overlaps(a models.Rectangle, b models.Rectangle) bool {
+	return a.X1 <= b.X2 && b.X1 <= a.X2 && a.Y1 <= b.Y2 && b.Y1 <= a.Y2
+}
+
+// dnnDetector runs a YOLO (Darknet or ONNX) or SSD model on the CPU with the DNN module
+// of OpenCV.
+type dnnDetector struct {
+	net          gocv.Net
+	outputs      []string
+	labels       []string
+	inputSize    int
+	confidence   float32
+	nmsThreshold float32
+}
+
+func newDNNDetector(settings *models.ObjectDetection) (*dnnDetector, error) {
+	net := gocv.ReadNet(settings.Model, settings.Config)
+	if net.Empty() {
+		return nil, errors.New("newDNNDetector: could not read the model " + settings.Model)
+	}
+	net.SetPreferableBackend(gocv.NetBackendOpenCV)
+	net.SetPreferableTarget(gocv.NetTargetCPU)
+
+	var labels []string
+	if settings.Labels != "" {
+		data, err := ioutil.ReadFile(settings.Labels)
+		if err != nil {
+			net.Close()
+			return nil, err
+		}
+		for _, label := range strings.Split(string(data), "\n") {
+			if label = strings.TrimSpace(label); label != "" {
+				labels = append(labels, label)
+			}
+		}
+	}
+
+	var outputs []string
+	names := net.GetLayerNames()
+	for _, id := range net.GetUnconnectedOutLayers() {
+		if id > 0 && id <= len(names) {
+			outputs = append(outputs, names[id-1])
+		}
+	}
+
+	d := &dnnDetector{
+		net:          net,
+		outputs:      outputs,
+		labels:       labels,
+		inputSize:    settings.InputSize,
+		confidence:   float32(settings.Confidence),
+		nmsThreshold: float32(settings.NMSThreshold),
+	}
+	if d.inputSize <= 0 {
+		d.inputSize = defaultInputSize
+	}
+	if d.confidence <= 0 {
+		d.confidence = defaultConfidence
+	}
+	if d.nmsThreshold <= 0 {
+		d.nmsThreshold = defaultNMSThreshold
+	}
+	log.Log.Info("newDNNDetector: loaded " + settings.Model + " with " + strconv.Itoa(len(labels)) + " labels.")
+	return d, nil
+}
+
+// Detect runs the model, and returns the objects which remain after non maximum suppression.
+func (d *dnnDetector) Detect(img gocv.Mat) ([]models.Object, error) {
+	blob := gocv.BlobFromImage(img, 1.0/255.0, image.Pt(d.inputSize, d.inputSize), gocv.NewScalar(0, 0, 0, 0), true, false)
+	d.net.SetInput(blob, "")
+	blob.Close()
+	results := d.net.ForwardLayers(d.outputs)
+
+	var boxes []image.Rectangle
+	var scores []float32
+	var classes []int
+	for _, result := range results {
+		b, s, c, err := d.parse(result, img.Cols(), img.Rows())
+		result.Close()
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, b...)
+		scores = append(scores, s...)
+		classes = append(classes, c...)
+	}
+	if len(boxes) == 0 {
+		return nil, nil
+	}
+
+	indices := make([]int, len(boxes))
+	for i := range indices {
+		indices[i] = -1
+	}
+	gocv.NMSBoxes(boxes, scores, d.confidence, d.nmsThreshold, indices)
+
+	var objects []models.Object
+	for _, i := range indices {
+		if i < 0 {
+			break
+		}
+		box := boxes[i]
+		objects = append(objects, models.Object{
+			Label:      d.label(classes[i]),
+			Confidence: float64(scores[i]),
+			Rectangle:  models.Rectangle{X1: box.Min.X, Y1: box.Min.Y, X2: box.Max.X - 1, Y2: box.Max.Y - 1},
+		})
+	}
+	return objects, nil
+}
+
+// parse reads the detections of an output of the model. The following layouts are supported:
+//
+//	SSD:           [1, 1, N, 7] with image id, class, confidence and x1, y1, x2, y2 (normalized)
+//	YOLOv3/v4/v5:  [N, 5+classes] with cx, cy, w, h, objectness and the scores of the classes
+//	YOLOv8:        [1, 4+classes, N] with cx, cy, w, h and the scores of the classes
+//
+// The coordinates of YOLO are either normalized, or expressed in pixels of the input.
+func (d *dnnDetector) parse(result gocv.Mat, width int, height int) (boxes []image.Rectangle, scores []float32, classes []int, err error) {
+	data, err := result.DataPtrFloat32()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dims := result.Size()
+	if len(dims) == 0 {
+		return nil, nil, nil, nil
+	}
+
+	// SSD
+	if dims[len(dims)-1] == 7 && len(dims) == 4 {
+		for i := 0; i+7 <= len(data); i += 7 {
+			score := data[i+2]
+			if score < d.confidence {
+				continue
+			}
+			boxes = append(boxes, image.Rect(int(data[i+3]*float32(width)), int(data[i+4]*float32(height)), int(data[i+5]*float32(width)), int(data[i+6]*float32(height))))
+			scores = append(scores, score)
+			classes = append(classes, int(data[i+1]))
+		}
+		return boxes, scores, classes, nil
+	}
+
+	// YOLO, the rows are the detections.
+	rows, cols := 1, dims[len(dims)-1]
+	for _, dim := range dims[:len(dims)-1] {
+		rows *= dim
+	}
+	transposed := false
+	if len(dims) == 3 && dims[1] < dims[2] {
+		rows, cols, transposed = dims[2], dims[1], true
+	}
+	value := func(row int, col int) float32 {
+		if transposed {
+			return data[col*rows+row]
+		}
+		return data[row*cols+col]
+	}
+	objectness := !transposed
+	first := 4
+	if objectness {
+		first = 5
+	}
+	if cols <= first {
+		return nil, nil, nil, errors.New("parse: unsupported output of the model")
+	}
+
+	for row := 0; row < rows; row++ {
+		class, score := -1, float32(0)
+		for col := first; col < cols; col++ {
+			if s := value(row, col); s > score {
+				class, score = col-first, s
+			}
+		}
+		if objectness {
+			score *= value(row, 4)
+		}
+		if score < d.confidence {
+			continue
+		}
+		cx, cy, w, h := value(row, 0), value(row, 1), value(row, 2), value(row, 3)
+		scaleX, scaleY := float32(width), float32(height)
+		if cx > 1 || cy > 1 || w > 1 || h > 1 {
+			scaleX, scaleY = float32(width)/float32(d.inputSize), float32(height)/float32(d.inputSize)
+		}
+		boxes = append(boxes, image.Rect(int((cx-w/2)*scaleX), int((cy-h/2)*scaleY), int((cx+w/2)*scaleX), int((cy+h/2)*scaleY)))
+		scores = append(scores, score)
+		classes = append(classes, class)
+	}
+	return boxes, scores, classes, nil
+}
+
+func (d *dnnDetector) label(class int) string {
+	if class >= 0 && class < len(d.labels) {
+		return d.labels[class]
+	}
+	return strconv.Itoa(class)
+}
+
+func (d *dnnDetector) Close() {
+	d.net.Close()
+}
@@ -0,0 +1,197 @@
+package computervision
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/kerberos-io/agent/machinery/src/capture"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/webhook"
+	"github.com/kerberos-io/joy4/av/pubsub"
+	"gocv.io/x/gocv"
+)
+
+// The defaults of the tamper detection, see models.Tamper.
+const (
+	defaultTamperInterval             = 300
+	defaultTamperDuration             = 10
+	defaultTamperBrightnessThreshold  = 30
+	defaultTamperEdgeThreshold        = 30
+	defaultTamperSceneChangeThreshold = 60
+)
+
+// The keyframes are decoded at most once per interval, they are already decoded for
+// the motion detection.
+const tamperCheckInterval = time.Second
+
+// A reference frame with less edges (a percentage of the pixels) is not used to
+// detect defocusing, e.g. a dark scene at night.
+const minimumEdges = 0.5
+
+// tamperMeasurement describes a frame: its mean brightness and the percentage of
+// pixels which are an edge.
+type tamperMeasurement struct {
+	brightness float64
+	edges      float64
+}
+
+// ProcessTamper detects tampering of the camera in the keyframes of the cursor: a
+// covered, defocused or moved lens. Every frame is compared with a reference frame,
+// which is refreshed periodically, so slow changes (e.g. dusk) are not detected.
+func ProcessTamper(tamperCursor *pubsub.QueueCursor, configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, decoder *capture.VideoDecoder, decoderMutex *sync.Mutex) {
+	log.Log.Debug("ProcessTamper: started")
+	config := configuration.Config
+	settings := config.Capture.Tamper
+	if settings == nil || settings.Enabled != "true" {
+		log.Log.Info("ProcessTamper: tamper detection disabled.")
+		return
+	}
+
+	interval := time.Duration(valueOrDefault(settings.Interval, defaultTamperInterval)) * time.Second
+	duration := time.Duration(valueOrDefault(settings.Duration, defaultTamperDuration)) * time.Second
+	brightnessThreshold := float64(valueOrDefault(settings.BrightnessThreshold, defaultTamperBrightnessThreshold))
+	edgeThreshold := float64(valueOrDefault(settings.EdgeThreshold, defaultTamperEdgeThreshold))
+	sceneChangeThreshold := valueOrDefault(settings.SceneChangeThreshold, defaultTamperSceneChangeThreshold)
+
+	pool := NewMatPool()
+	defer pool.Close()
+	readImage := keyFrameReader(tamperCursor, decoder, decoderMutex, pool, false, tamperCheckInterval)
+
+	var reference gocv.Mat
+	var referenceMeasurement tamperMeasurement
+	var refreshed time.Time
+	hasReference := false
+
+	var since time.Time // when the current tampering started
+	fired := false
+
+	for {
+		gray, _, err := readImage()
+		if err != nil {
+			break
+		}
+		now := time.Now()
+		measurement := measureTamper(gray)
+
+		// The scenes are compared after equalizing their histograms, so a change of
+		// the lighting (e.g. auto exposure) isn't a change of the scene.
+		equalized := pool.Get(gray.Rows(), gray.Cols(), gocv.MatTypeCV8UC1)
+		gocv.EqualizeHist(gray, &equalized)
+		pool.Put(gray)
+
+		if !hasReference {
+			reference, referenceMeasurement, refreshed, hasReference = equalized, measurement, now, true
+			continue
+		}
+		if reference.Rows() != equalized.Rows() || reference.Cols() != equalized.Cols() {
+			pool.Put(reference)
+			reference, referenceMeasurement, refreshed = equalized, measurement, now
+			continue
+		}
+
+		// Check for tampering, a covered lens also has no edges so it's checked first.
+		tamper := ""
+		var value, referenceValue float64
+		if measurement.brightness*100 < referenceMeasurement.brightness*brightnessThreshold {
+			tamper, value, referenceValue = models.TamperCovered, measurement.brightness, referenceMeasurement.brightness
+		} else if referenceMeasurement.edges >= minimumEdges && measurement.edges*100 < referenceMeasurement.edges*edgeThreshold {
+			tamper, value, referenceValue = models.TamperDefocused, measurement.edges, referenceMeasurement.edges
+		} else {
+			difference := pool.Get(equalized.Rows(), equalized.Cols(), gocv.MatTypeCV8UC1)
+			gocv.AbsDiff(equalized, reference, &difference)
+			if changed := ChangedPercentage(difference); changed > float64(sceneChangeThreshold) {
+				tamper, value, referenceValue = models.TamperMoved, changed, float64(sceneChangeThreshold)
+			}
+			pool.Put(difference)
+		}
+
+		refresh := false
+		if tamper == "" {
+			since, fired = time.Time{}, false
+			refresh = now.Sub(refreshed) >= interval
+		} else {
+			if since.IsZero() {
+				since = now
+				log.Log.Info("ProcessTamper: possible tampering (" + tamper + "), waiting " + duration.String())
+			}
+			if !fired && now.Sub(since) >= duration {
+				fired = true
+				sendTamperEvent(configuration, communication, mqttClient, models.TamperEvent{
+					Event:     "tamper",
+					Camera:    configuration.Camera,
+					Type:      tamper,
+					Timestamp: now.Unix(),
+					Value:     value,
+					Reference: referenceValue,
+				})
+			}
+			// The new scene becomes the reference, if the tampering persists.
+			if fired && now.Sub(since) >= interval {
+				since, fired, refresh = time.Time{}, false, true
+			}
+		}
+
+		if refresh {
+			pool.Put(reference)
+			reference, referenceMeasurement, refreshed = equalized, measurement, now
+		} else {
+			pool.Put(equalized)
+		}
+	}
+
+	if hasReference {
+		pool.Put(reference)
+	}
+	log.Log.Debug("ProcessTamper: finished")
+}
+
+// measureTamper returns the mean brightness and the percentage of edges of a frame.
+func measureTamper(gray gocv.Mat) tamperMeasurement {
+	mean := gray.Mean()
+	edges := gocv.NewMat()
+	gocv.Canny(gray, &edges, 50, 150)
+	numberOfEdges := gocv.CountNonZero(edges)
+	edges.Close()
+	return tamperMeasurement{
+		brightness: mean.Val1,
+		edges:      float64(numberOfEdges) * 100 / float64(gray.Rows()*gray.Cols()),
+	}
+}
+
+// sendTamperEvent publishes the tamper event over MQTT and to the webhook, and triggers
+// a recording when enabled.
+func sendTamperEvent(configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, event models.TamperEvent) {
+	config := configuration.Config
+	log.Log.Info("ProcessTamper: tampering detected (" + event.Type + "), value " + strconv.FormatFloat(event.Value, 'f', 2, 64) + ", reference " + strconv.FormatFloat(event.Reference, 'f', 2, 64))
+
+	payload, _ := json.Marshal(event)
+	mqttClient.Publish("kerberos/"+config.HubKey+"/device/"+config.Key+"/tamper", 2, false, payload)
+	go webhook.Send(config.WebhookURI, event)
+
+	if config.Capture.Tamper.Record == "true" {
+		now := time.Now()
+		triggerRecording(communication, models.MotionDataPartial{
+			Timestamp:    now.Unix(),
+			Microseconds: int64(now.Nanosecond() / 1000),
+			Trigger:      models.TriggerTamper,
+		})
+	}
+}
+
+// triggerRecording sends an event to the recorder, without blocking.
+func triggerRecording(communication *models.Communication, motion models.MotionDataPartial) {
+	if !communication.SendMotion(motion) {
+		log.Log.Info("triggerRecording: the recorder is busy, event ignored.")
+	}
+}
+
+func valueOrDefault(value int, defaultValue int) int {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,105 @@
+package computervision
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// Number of frames a track is kept without a matching blob, e.g. when the object stops
+// moving for a moment.
+const maxDisappeared = 5
+
+// track is an object which is followed across the frames, by its centroid.
+type track struct {
+	id          int
+	centroid    models.Coordinate
+	previous    models.Coordinate
+	disappeared int
+	entered     map[string]time.Time // the dwells in which the object is, and since when
+	loitered    map[string]bool      // the dwells for which a loitering event was sent
+}
+
+// tracker matches the blobs of a frame with the tracks of the previous frames, by the
+// distance between their centroids. A blob which is farther than maxDistance from every
+// track is a new object.
+type tracker struct {
+	nextID      int
+	tracks      []*track
+	maxDistance float64
+}
+
+func newTracker(maxDistance float64) *tracker {
+	return &tracker{
+		nextID:      1,
+		maxDistance: maxDistance,
+	}
+}
+
+// update matches the blobs with the tracks, and returns the tracks which were seen in
+// this frame. The closest pairs are matched first.
+func (t *tracker) update(blobs []models.Blob) []*track {
+	type pair struct {
+		track    int
+		blob     int
+		distance float64
+	}
+	var pairs []pair
+	for i, tr := range t.tracks {
+		for j, blob := range blobs {
+			distance := math.Hypot(tr.centroid.X-blob.Centroid.X, tr.centroid.Y-blob.Centroid.Y)
+			if distance <= t.maxDistance {
+				pairs = append(pairs, pair{track: i, blob: j, distance: distance})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].distance < pairs[j].distance
+	})
+
+	matchedTracks := make([]bool, len(t.tracks))
+	matchedBlobs := make([]bool, len(blobs))
+	var seen []*track
+	for _, p := range pairs {
+		if matchedTracks[p.track] || matchedBlobs[p.blob] {
+			continue
+		}
+		matchedTracks[p.track], matchedBlobs[p.blob] = true, true
+		tr := t.tracks[p.track]
+		tr.previous, tr.centroid, tr.disappeared = tr.centroid, blobs[p.blob].Centroid, 0
+		seen = append(seen, tr)
+	}
+
+	// Tracks which weren't matched for too long are removed.
+	var tracks []*track
+	for i, tr := range t.tracks {
+		if !matchedTracks[i] {
+			tr.disappeared++
+			if tr.disappeared > maxDisappeared {
+				continue
+			}
+		}
+		tracks = append(tracks, tr)
+	}
+
+	// Every blob which isn't matched is a new object.
+	for j, blob := range blobs {
+		if matchedBlobs[j] {
+			continue
+		}
+		tr := &track{
+			id:       t.nextID,
+			centroid: blob.Centroid,
+			previous: blob.Centroid,
+			entered:  make(map[string]time.Time),
+			loitered: make(map[string]bool),
+		}
+		t.nextID++
+		tracks = append(tracks, tr)
+		seen = append(seen, tr)
+	}
+	t.tracks = tracks
+	return seen
+}
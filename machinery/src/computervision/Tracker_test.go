@@ -0,0 +1,98 @@
+package computervision
+
+import (
+	"testing"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+func blobAt(x float64, y float64) models.Blob {
+	return models.Blob{Centroid: models.Coordinate{X: x, Y: y}}
+}
+
+func TestTracker(t *testing.T) {
+	type position struct {
+		id       int
+		centroid models.Coordinate
+	}
+	tests := []struct {
+		name   string
+		frames [][]models.Blob
+		seen   []position // the tracks seen in the last frame
+		tracks int        // the number of tracks after the last frame
+	}{
+		{
+			name:   "every blob is a new track",
+			frames: [][]models.Blob{{blobAt(0, 0), blobAt(500, 0)}},
+			seen:   []position{{1, models.Coordinate{X: 0}}, {2, models.Coordinate{X: 500}}},
+			tracks: 2,
+		},
+		{
+			name:   "a blob which moved is the same track",
+			frames: [][]models.Blob{{blobAt(0, 0)}, {blobAt(30, 40)}},
+			seen:   []position{{1, models.Coordinate{X: 30, Y: 40}}},
+			tracks: 1,
+		},
+		{
+			name:   "a blob which is too far is a new track",
+			frames: [][]models.Blob{{blobAt(0, 0)}, {blobAt(101, 0)}},
+			seen:   []position{{2, models.Coordinate{X: 101}}},
+			tracks: 2,
+		},
+		{
+			// The tracks are at 0 and 50, the closest pair (50, 30) is matched first
+			// even though the first track has no other blob within reach.
+			name:   "the closest pairs are matched first",
+			frames: [][]models.Blob{{blobAt(0, 0), blobAt(50, 0)}, {blobAt(30, 0), blobAt(150, 0)}},
+			seen:   []position{{2, models.Coordinate{X: 30}}, {3, models.Coordinate{X: 150}}},
+			tracks: 3,
+		},
+		{
+			name:   "blobs are matched to the nearest track",
+			frames: [][]models.Blob{{blobAt(0, 0), blobAt(100, 0)}, {blobAt(95, 0), blobAt(10, 0)}},
+			seen:   []position{{2, models.Coordinate{X: 95}}, {1, models.Coordinate{X: 10}}},
+			tracks: 2,
+		},
+		{
+			name:   "a track is kept while it disappeared for a few frames",
+			frames: [][]models.Blob{{blobAt(0, 0)}, {}, {}, {}, {}, {}, {blobAt(10, 0)}},
+			seen:   []position{{1, models.Coordinate{X: 10}}},
+			tracks: 1,
+		},
+		{
+			name:   "a track is removed when it disappeared for too long",
+			frames: [][]models.Blob{{blobAt(0, 0)}, {}, {}, {}, {}, {}, {}, {blobAt(10, 0)}},
+			seen:   []position{{2, models.Coordinate{X: 10}}},
+			tracks: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr := newTracker(100)
+			var seen []*track
+			for _, blobs := range test.frames {
+				seen = tr.update(blobs)
+			}
+			if len(seen) != len(test.seen) {
+				t.Fatalf("%d tracks seen, expected %d", len(seen), len(test.seen))
+			}
+			for i, expected := range test.seen {
+				if seen[i].id != expected.id || seen[i].centroid != expected.centroid {
+					t.Errorf("track %d at %v, expected track %d at %v", seen[i].id, seen[i].centroid, expected.id, expected.centroid)
+				}
+			}
+			if len(tr.tracks) != test.tracks {
+				t.Errorf("%d tracks, expected %d", len(tr.tracks), test.tracks)
+			}
+		})
+	}
+}
+
+func TestTrackerPrevious(t *testing.T) {
+	tr := newTracker(100)
+	tr.update([]models.Blob{blobAt(10, 10)})
+	seen := tr.update([]models.Blob{blobAt(20, 30)})
+	if len(seen) != 1 || seen[0].previous != (models.Coordinate{X: 10, Y: 10}) || seen[0].centroid != (models.Coordinate{X: 20, Y: 30}) {
+		t.Fatalf("the previous and current centroid of the track should be kept")
+	}
+}
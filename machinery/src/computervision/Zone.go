@@ -0,0 +1,171 @@
+package computervision
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"gocv.io/x/gocv"
+)
+
+// Default sensitivity of a zone, which is a difference of 30 in intensity.
+const defaultSensitivity = 50
+
+// Default number of pixels which should change, before motion is detected.
+const defaultPixelChangeThreshold = 75
+
+// zone is a polygon of the region, motion is detected in every zone independently.
+// The mask is the rasterized polygon, without the exclusions of the region.
+type zone struct {
+	id                   string
+	mask                 gocv.Mat
+	differenceThreshold  int
+	pixelChangeThreshold int
+	minObjectSize        int
+	maxObjectSize        int
+	timetable            []*models.Timetable
+}
+
+// createZones creates a zone for every polygon of the region, the coordinates of the
+// polygons are scaled to the size of the motion image (rows x cols). The zones should
+// be closed with closeZones.
+func createZones(config models.Config, rows int, cols int, regionScale float64) []zone {
+	if config.Region == nil {
+		return nil
+	}
+
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 0}
+	var zones []zone
+	for i, polygon := range config.Region.Polygon {
+		points := polygonPoints(polygon, regionScale)
+		if len(points) < 3 {
+			continue
+		}
+
+		mask := gocv.Zeros(rows, cols, gocv.MatTypeCV8UC1)
+		inclusion := gocv.NewPointsVectorFromPoints([][]image.Point{points})
+		gocv.FillPoly(&mask, inclusion, white)
+		inclusion.Close()
+		fillExclusions(&mask, config.Region, regionScale)
+
+		id := polygon.ID
+		if id == "" {
+			id = strconv.Itoa(i)
+		}
+
+		// The thresholds are expressed in pixels of the main stream.
+		pixelChangeThreshold := polygon.PixelChangeThreshold
+		if pixelChangeThreshold == 0 {
+			pixelChangeThreshold = config.Capture.PixelChangeThreshold
+		}
+		if pixelChangeThreshold == 0 {
+			pixelChangeThreshold = defaultPixelChangeThreshold
+		}
+		pixelChangeThreshold = int(float64(pixelChangeThreshold) * regionScale * regionScale)
+		if pixelChangeThreshold < 1 {
+			pixelChangeThreshold = 1
+		}
+
+		zones = append(zones, zone{
+			id:                   id,
+			mask:                 mask,
+			differenceThreshold:  differenceThreshold(polygon.Sensitivity),
+			pixelChangeThreshold: pixelChangeThreshold,
+			minObjectSize:        minObjectSize(config, regionScale),
+			maxObjectSize:        maxObjectSize(config, regionScale),
+			timetable:            polygon.Timetable,
+		})
+	}
+	return zones
+}
+
+// createTrackingZone creates a zone of the whole image without the exclusions of the
+// region. The blobs which are tracked are found in this zone, independent of the zones
+// of the region. It should be closed with closeZones.
+func createTrackingZone(config models.Config, rows int, cols int, regionScale float64) zone {
+	mask := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(255, 255, 255, 0), rows, cols, gocv.MatTypeCV8UC1)
+	fillExclusions(&mask, config.Region, regionScale)
+	return zone{
+		id:                  "tracking",
+		mask:                mask,
+		differenceThreshold: differenceThreshold(defaultSensitivity),
+		minObjectSize:       minObjectSize(config, regionScale),
+		maxObjectSize:       maxObjectSize(config, regionScale),
+	}
+}
+
+// fillExclusions removes the exclusions of the region from a mask.
+func fillExclusions(mask *gocv.Mat, region *models.Region, regionScale float64) {
+	if region == nil {
+		return
+	}
+	var exclusions [][]image.Point
+	for _, polygon := range region.Exclusions {
+		if points := polygonPoints(polygon, regionScale); len(points) >= 3 {
+			exclusions = append(exclusions, points)
+		}
+	}
+	if len(exclusions) > 0 {
+		exclusion := gocv.NewPointsVectorFromPoints(exclusions)
+		gocv.FillPoly(mask, exclusion, color.RGBA{})
+		exclusion.Close()
+	}
+}
+
+// minObjectSize and maxObjectSize return the sizes of the blobs in the motion image, the
+// sizes are expressed in pixels of the main stream.
+func minObjectSize(config models.Config, regionScale float64) int {
+	return int(float64(config.Capture.MinObjectSize) * regionScale * regionScale)
+}
+
+func maxObjectSize(config models.Config, regionScale float64) int {
+	return int(math.Ceil(float64(config.Capture.MaxObjectSize) * regionScale * regionScale))
+}
+
+// closeZones releases the masks of the zones.
+func closeZones(zones []zone) {
+	for _, z := range zones {
+		z.mask.Close()
+	}
+}
+
+// polygonPoints scales the coordinates of a polygon to the motion image.
+func polygonPoints(polygon models.Polygon, regionScale float64) []image.Point {
+	var points []image.Point
+	for _, c := range polygon.Coordinates {
+		points = append(points, image.Pt(int(c.X*regionScale+0.5), int(c.Y*regionScale+0.5)))
+	}
+	return points
+}
+
+// differenceThreshold converts a sensitivity (1-100) to the difference in intensity of
+// a pixel, which is considered a change. A higher sensitivity means a lower difference.
+func differenceThreshold(sensitivity int) int {
+	if sensitivity <= 0 {
+		sensitivity = defaultSensitivity
+	}
+	if sensitivity > 100 {
+		sensitivity = 100
+	}
+	threshold := (100 - sensitivity) * 60 / 100
+	if threshold < 5 {
+		threshold = 5
+	}
+	return threshold
+}
+
+// withinTimetable returns true if the time is within one of the two intervals of the
+// timetable of that weekday. If there is no timetable for that day, it returns true.
+func withinTimetable(timetable []*models.Timetable, now time.Time) bool {
+	weekday := int(now.Weekday())
+	if weekday >= len(timetable) || timetable[weekday] == nil {
+		return true
+	}
+	timeInterval := timetable[weekday]
+	currentTimeInSeconds := now.Hour()*60*60 + now.Minute()*60 + now.Second()
+	return (currentTimeInSeconds >= timeInterval.Start1 && currentTimeInSeconds <= timeInterval.End1) ||
+		(currentTimeInSeconds >= timeInterval.Start2 && currentTimeInSeconds <= timeInterval.End2)
+}
@@ -1,14 +1,15 @@
 package computervision
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
 	"image"
+	"image/color"
 	"io/ioutil"
 	"os"
-	"runtime"
-	"runtime/debug"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,82 +17,155 @@ import (
 	"github.com/kerberos-io/agent/machinery/src/capture"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
 	"github.com/kerberos-io/joy4/av/pubsub"
 
-	geo "github.com/kellydunn/golang-geo"
 	"github.com/kerberos-io/joy4/av"
-	"github.com/kerberos-io/joy4/cgo/ffmpeg"
 	"gocv.io/x/gocv"
 )
 
-func GetRGBImage(pkt av.Packet, dec *ffmpeg.VideoDecoder, decoderMutex *sync.Mutex) gocv.Mat {
+// GetRGBImage decodes a packet, and returns a (BGR) image of a quarter of its size.
+func GetRGBImage(pkt av.Packet, dec *capture.VideoDecoder, decoderMutex *sync.Mutex) gocv.Mat {
 	var rgb gocv.Mat
 	img, err := capture.DecodeImage(pkt, dec, decoderMutex)
 	if err == nil && img != nil {
-		rgb, _ = ToRGB8(img.Image)
+		rgb, _ = ToBGR(img.Image, nil)
+		img.Free()
 		gocv.Resize(rgb, &rgb, image.Pt(rgb.Cols()/4, rgb.Rows()/4), 0, 0, gocv.InterpolationArea)
 	}
 	return rgb
 }
 
-func GetImage(pkt av.Packet, dec *ffmpeg.VideoDecoder, decoderMutex *sync.Mutex) gocv.Mat {
-	var gray gocv.Mat
+// GetImage decodes a packet, and returns a grayscale image which is used for motion
+// detection. Images wider than 800 pixels are scaled down to half of their size. The
+// image is taken from the pool, and should be returned to it.
+func GetImage(pkt av.Packet, dec *capture.VideoDecoder, decoderMutex *sync.Mutex, pool *MatPool) (gocv.Mat, error) {
+	gray, _, err := getImage(pkt, dec, decoderMutex, pool, false)
+	return gray, err
+}
+
+// getImage is GetImage, which also returns the decoded frame if keepFrame is true (e.g.
+// for object detection on the colour image). The frame should be freed.
+func getImage(pkt av.Packet, dec *capture.VideoDecoder, decoderMutex *sync.Mutex, pool *MatPool, keepFrame bool) (gocv.Mat, *capture.Frame, error) {
 	img, err := capture.DecodeImage(pkt, dec, decoderMutex)
+	if err != nil {
+		return gocv.Mat{}, nil, err
+	}
+	if img == nil {
+		return gocv.Mat{}, nil, errors.New("GetImage: no frame decoded")
+	}
 
-	if err == nil && img != nil {
+	gray := ToGray(img.Image, pool)
+	if !keepFrame {
+		img.Free()
+		img = nil
+	}
+	if gray.Cols() > 800 {
+		small := pool.Get(gray.Rows()/2, gray.Cols()/2, gocv.MatTypeCV8UC1)
+		gocv.Resize(gray, &small, image.Pt(gray.Cols()/2, gray.Rows()/2), 0, 0, gocv.InterpolationArea)
+		pool.Put(gray)
+		gray = small
+	}
+	return gray, img, nil
+}
 
-		// Check if we need to scale down.
-		width := img.Width()
-		height := img.Height()
-		newWidth := width
-		newHeight := height
-
-		// Try minify twice.
-		scaleFactor := 1.0
-		if newWidth > 800 {
-			newWidth = width / 2
-			newHeight = height / 2
-			scaleFactor *= 2
-		}
-		if newWidth > 800 {
-			newWidth = width / 2
-			newHeight = height / 2
-			scaleFactor *= 2
-		}
-		if newWidth > 800 {
-			newWidth = width / 2
-			newHeight = height / 2
-			scaleFactor *= 2
+// motionImageSize returns the size of the images used for motion detection, which are
+// scaled down by GetImage when the stream is wider than 800 pixels.
+func motionImageSize(streams []av.CodecData) (width int, height int) {
+	for _, stream := range streams {
+		if video, ok := stream.(interface {
+			Width() int
+			Height() int
+		}); ok {
+			width, height = video.Width(), video.Height()
+			if width > 800 {
+				width, height = width/2, height/2
+			}
+			return width, height
 		}
+	}
+	return 0, 0
+}
 
-		im := img.Image
-		rgb, _ := ToRGB8(im)
-		img.Free()
-		if scaleFactor > 1 {
-			gocv.Resize(rgb, &rgb, image.Pt(newWidth, newHeight), 0, 0, gocv.InterpolationArea)
-		}
-		gray = gocv.NewMat()
-		gocv.CvtColor(rgb, &gray, gocv.ColorBGRToGray)
-		rgb.Close()
+// RegionScale returns the factor to map the coordinates of the main stream (e.g. the
+// polygons of the region) to the substream, which is used for motion detection.
+func RegionScale(mainStreams []av.CodecData, subStreams []av.CodecData) float64 {
+	mainWidth, _ := motionImageSize(mainStreams)
+	subWidth, _ := motionImageSize(subStreams)
+	if mainWidth == 0 || subWidth == 0 {
+		return 1
+	}
+	return float64(subWidth) / float64(mainWidth)
+}
+
+// ToGray returns the luma (Y) plane of the image, which is its grayscale image.
+func ToGray(img image.YCbCr, pool *MatPool) gocv.Mat {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	gray := pool.Get(height, width, gocv.MatTypeCV8UC1)
+	data, _ := gray.DataPtrUint8()
+	for y := 0; y < height; y++ {
+		offset := img.YOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		copy(data[y*width:(y+1)*width], img.Y[offset:offset+width])
 	}
 	return gray
 }
 
+// ToBGR converts the image to BGR. The planes of a YUV 4:2:0 image are copied into a
+// single I420 Mat, which is converted by OpenCV. Other images are converted pixel by pixel.
+func ToBGR(img image.YCbCr, pool *MatPool) (gocv.Mat, error) {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	if img.SubsampleRatio != image.YCbCrSubsampleRatio420 || width%2 != 0 || height%2 != 0 {
+		return ToRGB8(img)
+	}
+
+	i420 := pool.Get(height*3/2, width, gocv.MatTypeCV8UC1)
+	data, _ := i420.DataPtrUint8()
+	for y := 0; y < height; y++ {
+		offset := img.YOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		copy(data[y*width:(y+1)*width], img.Y[offset:offset+width])
+	}
+	chromaWidth, chromaHeight := width/2, height/2
+	cb := data[width*height:]
+	cr := cb[chromaWidth*chromaHeight:]
+	for y := 0; y < chromaHeight; y++ {
+		offset := img.COffset(img.Rect.Min.X, img.Rect.Min.Y+2*y)
+		copy(cb[y*chromaWidth:(y+1)*chromaWidth], img.Cb[offset:offset+chromaWidth])
+		copy(cr[y*chromaWidth:(y+1)*chromaWidth], img.Cr[offset:offset+chromaWidth])
+	}
+
+	bgr := pool.Get(height, width, gocv.MatTypeCV8UC3)
+	gocv.CvtColor(i420, &bgr, gocv.ColorYUVToBGRIYUV)
+	pool.Put(i420)
+	return bgr, nil
+}
+
+// ToRGB8 converts the image to BGR pixel by pixel, it's used for the subsample ratios
+// OpenCV can't convert.
 func ToRGB8(img image.YCbCr) (gocv.Mat, error) {
 	bounds := img.Bounds()
 	x := bounds.Dx()
 	y := bounds.Dy()
-	bytes := make([]byte, 0, x*y*3)
+	bytes := make([]byte, x*y*3)
+	i := 0
 	for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
-		for i := bounds.Min.X; i < bounds.Max.X; i++ {
-			r, g, b, _ := img.At(i, j).RGBA()
-			bytes = append(bytes, byte(b>>8), byte(g>>8), byte(r>>8))
+		for k := bounds.Min.X; k < bounds.Max.X; k++ {
+			yi := img.YOffset(k, j)
+			ci := img.COffset(k, j)
+			r, g, b := color.YCbCrToRGB(img.Y[yi], img.Cb[ci], img.Cr[ci])
+			bytes[i], bytes[i+1], bytes[i+2] = b, g, r
+			i += 3
 		}
 	}
 	return gocv.NewMatFromBytes(y, x, gocv.MatTypeCV8UC3, bytes)
 }
 
-func ProcessMotion(motionCursor *pubsub.QueueCursor, configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, decoder *ffmpeg.VideoDecoder, decoderMutex *sync.Mutex) { //, wg *sync.WaitGroup) {
+// A snapshot of the camera is stored at most once per interval.
+const snapshotInterval = 3 * time.Second
+
+// ProcessMotion detects motion in the keyframes of the cursor. When a substream is used
+// the regionScale maps the region (and the results) between the main and the substream,
+// otherwise it's 1.
+func ProcessMotion(motionCursor *pubsub.QueueCursor, configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, decoder *capture.VideoDecoder, decoderMutex *sync.Mutex, regionScale float64) { //, wg *sync.WaitGroup) {
 	log.Log.Debug("ProcessMotion: started")
 	config := configuration.Config
 
@@ -105,19 +179,55 @@ func ProcessMotion(motionCursor *pubsub.QueueCursor, configuration *models.Confi
 
 		key := config.HubKey
 
+		// The images are reused, so no memory is allocated for every frame.
+		pool := NewMatPool()
+		defer pool.Close()
+
+		// The optional object detection runs on the frames with motion, and needs the
+		// colour image of the frame.
+		var objectDetector ObjectDetector
+		objectDetection := config.Capture.ObjectDetection
+		if objectDetection != nil && objectDetection.Enabled == "true" {
+			var err error
+			objectDetector, err = NewObjectDetector(objectDetection)
+			if err != nil {
+				log.Log.Error("ProcessMotion: object detection disabled, " + err.Error())
+				objectDetector = nil
+			} else {
+				defer objectDetector.Close()
+			}
+		}
+		keepFrames := objectDetector != nil
+
+		// By default only keyframes are used. When an analysis frame rate is configured,
+		// every packet is decoded by a decoder of its own (so the shared decoder isn't
+		// blocked) and frames are sampled at that rate.
+		readImage := keyFrameReader(motionCursor, decoder, decoderMutex, pool, keepFrames, 0)
+		if config.Capture.MotionFPS > 0 {
+			streams, _ := motionCursor.Streams()
+			frameDecoder := capture.GetVideoDecoder(streams)
+			defer frameDecoder.Close()
+			if frameDecoder.DecodesEveryFrame() {
+				log.Log.Info("ProcessMotion: analysing frames at " + strconv.Itoa(config.Capture.MotionFPS) + " fps.")
+				readImage = frameReader(motionCursor, streams, frameDecoder, config.Capture.MotionFPS, pool, keepFrames)
+			} else {
+				log.Log.Info("ProcessMotion: the codec can't be decoded frame by frame, only keyframes are analysed.")
+			}
+		}
+
 		// Initialise first 2 elements
 		var matArray [3]*gocv.Mat
 		j := 0
 
-		//for pkt := range packets {
 		var cursorError error
-		var pkt av.Packet
-
 		for cursorError == nil {
-			pkt, cursorError = motionCursor.ReadPacket()
-			// Check If valid package.
-			if len(pkt.Data) > 0 && pkt.IsKeyFrame {
-				rgb := GetImage(pkt, decoder, decoderMutex)
+			var rgb gocv.Mat
+			var frame *capture.Frame
+			rgb, frame, cursorError = readImage()
+			if frame != nil {
+				frame.Free()
+			}
+			if cursorError == nil {
 				matArray[j] = &rgb
 				j++
 			}
@@ -129,65 +239,64 @@ func ProcessMotion(motionCursor *pubsub.QueueCursor, configuration *models.Confi
 		img := matArray[0]
 		if img != nil {
 
-			// Calculate mask
-			var polyObjects []geo.Polygon
-			for _, polygon := range config.Region.Polygon {
-				coords := polygon.Coordinates
-				poly := geo.Polygon{}
-				for _, c := range coords {
-					x := c.X
-					y := c.Y
-					p := geo.NewPoint(x, y)
-					if !poly.Contains(p) {
-						poly.Add(p)
-					}
-				}
-				polyObjects = append(polyObjects, poly)
-			}
-
-			rows := img.Rows()
-			cols := img.Cols()
-			var coordinatesToCheck [][]int
-			for y := 0; y < rows; y++ {
-				for x := 0; x < cols; x++ {
-					for _, poly := range polyObjects {
-						point := geo.NewPoint(float64(x), float64(y))
-						if poly.Contains(point) {
-							coordinatesToCheck = append(coordinatesToCheck, []int{x, y})
-							break
-						}
-					}
+			// Every polygon of the region is a zone, with its own thresholds and timetable.
+			zones := createZones(config, img.Rows(), img.Cols(), regionScale)
+			defer closeZones(zones)
+
+			// The detector which computes the changed pixels, by default frame differencing.
+			detector := NewDetector(config.Capture)
+			defer detector.Close()
+
+			// The blobs are tracked when the region has tripwires or dwells, which needs
+			// an analysis frame rate (keyframes are too far apart). The blobs are found in
+			// the whole image (without the exclusions), so the rules don't depend on the zones.
+			tracking := newAnalytics(config.Region, float64(img.Cols())/regionScale)
+			var trackingZone zone
+			if tracking != nil {
+				trackingZone = createTrackingZone(config, img.Rows(), img.Cols(), regionScale)
+				defer closeZones([]zone{trackingZone})
+				if config.Capture.MotionFPS <= 0 {
+					log.Log.Info("ProcessMotion: tripwires and dwells need an analysis frame rate (motionfps), only keyframes are tracked.")
 				}
 			}
 
 			// Start the motion detection
-			i := 0
+			var snapshotted time.Time
+			snapshotsDirectory := utils.SnapshotsDirectory(configuration.Camera)
+			os.MkdirAll(snapshotsDirectory, 0755)
 			loc, _ := time.LoadLocation(config.Timezone)
 
 			for cursorError == nil {
-				pkt, cursorError = motionCursor.ReadPacket()
-
-				// Check If valid package.
-				if len(pkt.Data) == 0 || !pkt.IsKeyFrame {
-					continue
+				var rgb gocv.Mat
+				var frame *capture.Frame
+				rgb, frame, cursorError = readImage()
+				if cursorError != nil {
+					break
 				}
-
-				rgb := GetImage(pkt, decoder, decoderMutex)
 				matArray[2] = &rgb
 
 				// Store snapshots (jpg) or hull.
-				if i%3 == 0 {
-					files, err := ioutil.ReadDir("./data/snapshots")
+				if time.Since(snapshotted) >= snapshotInterval {
+					snapshotted = time.Now()
+					files, err := ioutil.ReadDir(snapshotsDirectory)
 					if err == nil {
 						sort.Slice(files, func(i, j int) bool {
 							return files[i].ModTime().Before(files[j].ModTime())
 						})
 						if len(files) > 3 {
-							os.Remove("./data/snapshots/" + files[0].Name())
+							os.Remove(snapshotsDirectory + files[0].Name())
 						}
 					}
 					t := strconv.FormatInt(time.Now().Unix(), 10)
-					gocv.IMWrite("./data/snapshots/"+t+".png", rgb)
+					if regionScale != 1 {
+						// Snapshots are used to draw the region, so they have the size of the main stream.
+						snapshot := gocv.NewMat()
+						gocv.Resize(rgb, &snapshot, image.Pt(int(float64(rgb.Cols())/regionScale), int(float64(rgb.Rows())/regionScale)), 0, 0, gocv.InterpolationLinear)
+						gocv.IMWrite(snapshotsDirectory+t+".png", snapshot)
+						snapshot.Close()
+					} else {
+						gocv.IMWrite(snapshotsDirectory+t+".png", rgb)
+					}
 				}
 
 				// Check if continuous recording.
@@ -198,69 +307,244 @@ func ProcessMotion(motionCursor *pubsub.QueueCursor, configuration *models.Confi
 
 				} else { // Do motion detection.
 
-					// Check if within time interval
-					detectMotion := true
+					// Check if within time interval, a zone can have a timetable of its own.
 					now := time.Now().In(loc)
-					weekday := now.Weekday()
-					hour := now.Hour()
-					minute := now.Minute()
-					second := now.Second()
-					timeInterval := config.Timetable[int(weekday)]
-					if timeInterval != nil {
-						start1 := timeInterval.Start1
-						end1 := timeInterval.End1
-						start2 := timeInterval.Start2
-						end2 := timeInterval.End2
-						currentTimeInSeconds := hour*60*60 + minute*60 + second
-						if (currentTimeInSeconds >= start1 && currentTimeInSeconds <= end1) ||
-							(currentTimeInSeconds >= start2 && currentTimeInSeconds <= end2) {
+					cameraScheduled := withinTimetable(config.Timetable, now)
+					if !cameraScheduled {
+						log.Log.Debug("ProcessMotion: Time interval not valid, disabling motion detection.")
+					}
+
+					// The foreground is computed for every frame, as a background model
+					// needs to learn continuously.
+					foreground := detector.Foreground(matArray, pool)
+					sceneChanged := SceneChanged(foreground, config.Capture.SceneChangeThreshold)
+					if sceneChanged {
+						log.Log.Info("ProcessMotion: scene change detected, ignoring frame.")
+					}
 
+					var motionData models.MotionDataPartial
+					for _, z := range zones {
+						if sceneChanged {
+							break
+						}
+						if len(z.timetable) > 0 {
+							if !withinTimetable(z.timetable, now) {
+								continue
+							}
+						} else if !cameraScheduled {
+							continue
+						}
+						motion, changes, rectangle, blobs := FindMotion(foreground, z.mask, z.differenceThreshold, z.pixelChangeThreshold, z.minObjectSize, z.maxObjectSize)
+						if !motion {
+							continue
+						}
+						if len(motionData.Zones) == 0 {
+							motionData.Rectangle = rectangle
 						} else {
-							detectMotion = false
-							log.Log.Debug("ProcessMotion: Time interval not valid, disabling motion detection.")
+							motionData.Rectangle = unionRectangle(motionData.Rectangle, rectangle)
 						}
+						motionData.NumberOfChanges += changes
+						motionData.Zones = append(motionData.Zones, z.id)
+						motionData.Blobs = append(motionData.Blobs, blobs...)
 					}
 
-					if detectMotion && FindMotion(matArray, coordinatesToCheck, config.Capture.PixelChangeThreshold) {
-						mqttClient.Publish("kerberos/"+key+"/device/"+config.Key+"/motion", 2, false, "motion")
-						fmt.Println(key)
-						communication.HandleMotion <- time.Now().Unix()
+					// Track the blobs, and evaluate the rules of the region.
+					if tracking != nil && !sceneChanged {
+						for _, event := range tracking.update(trackingBlobs(foreground, trackingZone, regionScale), now) {
+							sendAnalyticsEvent(configuration, mqttClient, event)
+						}
+					}
+					pool.Put(foreground)
+
+					// Verify the motion with the object detection, the objects should
+					// overlap with the motion.
+					if len(motionData.Zones) > 0 && objectDetector != nil && frame != nil {
+						motionData.Objects, motionData.Labels = detectObjects(objectDetector, frame, rgb.Cols(), motionData.Rectangle, pool)
+						if !containsClass(motionData.Labels, objectDetection.Classes) {
+							log.Log.Info("ProcessMotion: motion ignored, none of the objects " + strings.Join(objectDetection.Classes, ", ") + " detected (" + strings.Join(motionData.Labels, ", ") + ").")
+							motionData = models.MotionDataPartial{}
+						}
+					}
+
+					if len(motionData.Zones) > 0 {
+						if regionScale != 1 {
+							// Map the results back to the main stream.
+							motionData.NumberOfChanges = int(float64(motionData.NumberOfChanges) / (regionScale * regionScale))
+							motionData.Rectangle = scaleRectangle(motionData.Rectangle, regionScale)
+							for i, blob := range motionData.Blobs {
+								motionData.Blobs[i] = scaleBlob(blob, regionScale)
+							}
+							for i, object := range motionData.Objects {
+								motionData.Objects[i].Rectangle = scaleRectangle(object.Rectangle, regionScale)
+							}
+						}
+						now := time.Now()
+						motionData.Timestamp = now.Unix()
+						motionData.Microseconds = int64(now.Nanosecond() / 1000)
+
+						// The motion event (zones, blobs and objects) is the payload of the message.
+						payload, _ := json.Marshal(motionData)
+						mqttClient.Publish("kerberos/"+key+"/device/"+config.Key+"/motion", 2, false, payload)
+						for _, id := range motionData.Zones {
+							mqttClient.Publish("kerberos/"+key+"/device/"+config.Key+"/motion/"+id, 2, false, payload)
+						}
+						log.Log.Info("ProcessMotion: motion detected in zones " + strings.Join(motionData.Zones, ", ") + ", blobs: " + strconv.Itoa(len(motionData.Blobs)) + ", objects: " + strings.Join(motionData.Labels, ", "))
+
+						// Send the metadata of the motion event to the recorder,
+						// so it can be added to the name of the recording.
+						if !communication.SendMotion(motionData) {
+							log.Log.Info("ProcessMotion: the recorder is busy, motion event ignored.")
+						}
 					}
 				}
 
-				matArray[0].Close()
+				if frame != nil {
+					frame.Free()
+				}
+				pool.Put(*matArray[0])
 				matArray[0] = matArray[1]
 				matArray[1] = matArray[2]
-				i++
-				runtime.GC()
-				debug.FreeOSMemory()
 			}
 		}
-		if img != nil {
-			img.Close()
+		for _, mat := range matArray[:2] {
+			if mat != nil {
+				pool.Put(*mat)
+			}
 		}
-		runtime.GC()
-		debug.FreeOSMemory()
 	}
 
 	log.Log.Debug("ProcessMotion: finished")
 }
 
-func FindMotion(matArray [3]*gocv.Mat, coordinatesToCheck [][]int, pixelChangeThreshold int) bool {
+// imageReader returns the (grayscale) image of the next frame, and the decoded frame
+// itself if the reader keeps frames (otherwise nil).
+type imageReader func() (gocv.Mat, *capture.Frame, error)
+
+// keyFrameReader returns a function which reads the next keyframe of the cursor, and
+// returns its (grayscale) image. Keyframes are decoded at most once per interval.
+func keyFrameReader(cursor *pubsub.QueueCursor, decoder *capture.VideoDecoder, decoderMutex *sync.Mutex, pool *MatPool, keepFrames bool, interval time.Duration) imageReader {
+	var last time.Duration
+	started := false
+	return func() (gocv.Mat, *capture.Frame, error) {
+		for {
+			pkt, err := cursor.ReadPacket()
+			if err != nil {
+				return gocv.Mat{}, nil, err
+			}
+			if len(pkt.Data) == 0 || !pkt.IsKeyFrame {
+				continue
+			}
+			if started && pkt.Time >= last && pkt.Time-last < interval {
+				continue
+			}
+			gray, frame, err := getImage(pkt, decoder, decoderMutex, pool, keepFrames)
+			if err != nil {
+				log.Log.Debug("keyFrameReader: " + err.Error())
+				continue
+			}
+			started = true
+			last = pkt.Time
+			return gray, frame, nil
+		}
+	}
+}
+
+// frameReader returns a function which decodes every video packet of the cursor, and
+// returns the (grayscale) image of a frame at most fps times per second. The decoder
+// shouldn't be shared, as it needs to receive all packets.
+func frameReader(cursor *pubsub.QueueCursor, streams []av.CodecData, decoder *capture.VideoDecoder, fps int, pool *MatPool, keepFrames bool) imageReader {
+	videoIdx := int8(-1)
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			videoIdx = int8(i)
+		}
+	}
+	interval := time.Second / time.Duration(fps)
+	var decoderMutex sync.Mutex
+	var last time.Duration
+	started := false
+	return func() (gocv.Mat, *capture.Frame, error) {
+		for {
+			pkt, err := cursor.ReadPacket()
+			if err != nil {
+				return gocv.Mat{}, nil, err
+			}
+			if len(pkt.Data) == 0 || pkt.Idx != videoIdx {
+				continue
+			}
+			// The decoder needs a keyframe to start with.
+			if !started && !pkt.IsKeyFrame {
+				continue
+			}
+			if started && pkt.Time >= last && pkt.Time-last < interval {
+				// Not sampled, but the decoder still needs the frame as a reference.
+				frame, err := capture.DecodeImage(pkt, decoder, &decoderMutex)
+				if err == nil && frame != nil {
+					frame.Free()
+				}
+				continue
+			}
+			gray, frame, err := getImage(pkt, decoder, &decoderMutex, pool, keepFrames)
+			if err != nil {
+				log.Log.Debug("frameReader: " + err.Error())
+				continue
+			}
+			started = true
+			last = pkt.Time
+			return gray, frame, nil
+		}
+	}
+}
 
-	h1 := gocv.NewMat()
+// DifferenceImage compares the three most recent frames, and returns the pixels which
+// changed in both the previous frames. The image is taken from the pool.
+func DifferenceImage(matArray [3]*gocv.Mat, pool *MatPool) gocv.Mat {
+	h1 := pool.Get(matArray[2].Rows(), matArray[2].Cols(), gocv.MatTypeCV8UC1)
 	gocv.AbsDiff(*matArray[2], *matArray[0], &h1)
-	h2 := gocv.NewMat()
+	h2 := pool.Get(matArray[2].Rows(), matArray[2].Cols(), gocv.MatTypeCV8UC1)
 	gocv.AbsDiff(*matArray[2], *matArray[1], &h2)
 
-	and := gocv.NewMat()
+	and := pool.Get(matArray[2].Rows(), matArray[2].Cols(), gocv.MatTypeCV8UC1)
 	gocv.BitwiseAnd(h1, h2, &and)
-	h1.Close()
-	h2.Close()
+	pool.Put(h1)
+	pool.Put(h2)
+	return and
+}
+
+// FindMotion counts the pixels of the foreground which changed more than the
+// difference threshold within the mask of the zone, and extracts the blobs of the changed
+// pixels. Motion is detected when enough pixels changed, and at least one blob has an
+// allowed size. Next to the result it returns the number of changes, the bounding box
+// (x1,y1,x2,y2) of the blobs and the blobs.
+func FindMotion(foreground gocv.Mat, mask gocv.Mat, differenceThreshold int, pixelChangeThreshold int, minObjectSize int, maxObjectSize int) (bool, int, models.Rectangle, []models.Blob) {
+
+	changed := changedPixels(foreground, mask, differenceThreshold)
+
+	var rectangle models.Rectangle
+	var blobs []models.Blob
+	changes := gocv.CountNonZero(changed)
+	if changes > pixelChangeThreshold {
+		blobs = FindBlobs(changed, minObjectSize, maxObjectSize)
+		for i, blob := range blobs {
+			if i == 0 {
+				rectangle = blob.Rectangle
+			} else {
+				rectangle = unionRectangle(rectangle, blob.Rectangle)
+			}
+		}
+	}
+	changed.Close()
 
+	log.Log.Debug("FindMotion: Number of changes detected:" + strconv.Itoa(changes) + ", blobs: " + strconv.Itoa(len(blobs)))
+
+	return changes > pixelChangeThreshold && len(blobs) > 0, changes, rectangle, blobs
+}
+
+// changedPixels returns the pixels of the mask which changed more than the threshold,
+// single pixels are removed. The image should be closed by the caller.
+func changedPixels(foreground gocv.Mat, mask gocv.Mat, differenceThreshold int) gocv.Mat {
 	thresh := gocv.NewMat()
-	gocv.Threshold(and, &thresh, 30.0, 255.0, gocv.ThresholdBinary)
-	and.Close()
+	gocv.Threshold(foreground, &thresh, float32(differenceThreshold), 255.0, gocv.ThresholdBinary)
 
 	kernel := gocv.GetStructuringElement(gocv.MorphRect, image.Pt(3, 3))
 	eroded := gocv.NewMat()
@@ -268,20 +552,36 @@ func FindMotion(matArray [3]*gocv.Mat, coordinatesToCheck [][]int, pixelChangeTh
 	thresh.Close()
 	kernel.Close()
 
-	changes := 0
-	for _, c := range coordinatesToCheck {
-		value := eroded.GetUCharAt(c[1], c[0])
-		if value > 0 {
-			changes++
-		}
-	}
+	changed := gocv.NewMat()
+	gocv.BitwiseAnd(eroded, mask, &changed)
 	eroded.Close()
+	return changed
+}
 
-	log.Log.Info("FindMotion: Number of changes detected:" + strconv.Itoa(changes))
-
-	if pixelChangeThreshold == 0 {
-		pixelChangeThreshold = 75 // Keep hardcoded value of 75 for now if no value is given for changes treshold in config.json
+// trackingBlobs returns the blobs of the tracking zone, mapped to the main stream.
+func trackingBlobs(foreground gocv.Mat, z zone, regionScale float64) []models.Blob {
+	changed := changedPixels(foreground, z.mask, z.differenceThreshold)
+	defer changed.Close()
+	blobs := FindBlobs(changed, z.minObjectSize, z.maxObjectSize)
+	for i, blob := range blobs {
+		blobs[i] = scaleBlob(blob, regionScale)
 	}
+	return blobs
+}
 
-	return changes > pixelChangeThreshold
+// unionRectangle returns the bounding box of both rectangles.
+func unionRectangle(a models.Rectangle, b models.Rectangle) models.Rectangle {
+	if b.X1 < a.X1 {
+		a.X1 = b.X1
+	}
+	if b.Y1 < a.Y1 {
+		a.Y1 = b.Y1
+	}
+	if b.X2 > a.X2 {
+		a.X2 = b.X2
+	}
+	if b.Y2 > a.Y2 {
+		a.Y2 = b.Y2
+	}
+	return a
 }
@@ -0,0 +1,422 @@
+// Package fmp4 writes recordings as fragmented MP4. Instead of a single moov atom at the
+// end of the file, the samples are written in moof/mdat fragments of a fixed duration.
+// A recording is playable up to the last written fragment, even when the agent stops
+// unexpectedly while recording.
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/kerberos-io/joy4/av"
+	"github.com/kerberos-io/joy4/codec/aacparser"
+	"github.com/kerberos-io/joy4/codec/h264parser"
+	"github.com/kerberos-io/joy4/codec/h265parser"
+	"github.com/kerberos-io/joy4/format/mp4/mp4io"
+)
+
+// The timescale of a track, this is the same as the one used by the joy4 mp4 muxer.
+const timeScale = 90000
+
+// Sample flags as defined in ISO/IEC 14496-12, a keyframe doesn't depend on other
+// samples, all other samples depend on others and are not a sync sample.
+const (
+	sampleFlagsKeyFrame    = 0x02000000
+	sampleFlagsNonKeyFrame = 0x01010000
+)
+
+// Muxer writes packets into a fragmented MP4. It implements the av.Muxer interface,
+// so it can be used as a drop-in replacement of the mp4.Muxer of joy4.
+type Muxer struct {
+	w                io.Writer
+	fragmentDuration time.Duration
+	streams          []*Stream
+	sequenceNumber   uint32
+	fragmentStarted  bool
+	fragmentStart    time.Duration
+}
+
+// Stream holds the samples of a single track, which are not yet written to a fragment.
+type Stream struct {
+	av.CodecData
+	trackID      uint32
+	decodeTime   int64
+	lastPkt      *av.Packet
+	lastDuration time.Duration
+	samples      []sample
+}
+
+type sample struct {
+	data     []byte
+	duration uint32
+	flags    uint32
+	cts      uint32
+}
+
+// NewMuxer creates a fragmented MP4 muxer, a new fragment is started on the first
+// keyframe after the fragment duration has passed.
+func NewMuxer(w io.Writer, fragmentDuration time.Duration) *Muxer {
+	return &Muxer{
+		w:                w,
+		fragmentDuration: fragmentDuration,
+	}
+}
+
+// WriteHeader writes the ftyp and moov atoms. The moov atom doesn't contain any samples,
+// those are described by the moof atom of every fragment.
+func (m *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+
+	m.streams = make([]*Stream, len(streams))
+	moov := &mp4io.Movie{
+		Header: &mp4io.MovieHeader{
+			PreferredRate:   1,
+			PreferredVolume: 1,
+			Matrix:          [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
+			TimeScale:       1000,
+		},
+		MovieExtend: &mp4io.MovieExtend{},
+	}
+
+	trackID := uint32(1)
+	for i, codec := range streams {
+		track, supported := newTrack(codec, trackID)
+		if !supported {
+			// Codecs which can't be stored in an mp4 (e.g. PCM_MULAW) are skipped.
+			continue
+		}
+		m.streams[i] = &Stream{
+			CodecData: codec,
+			trackID:   trackID,
+		}
+		moov.Tracks = append(moov.Tracks, track)
+		moov.MovieExtend.Tracks = append(moov.MovieExtend.Tracks, &mp4io.TrackExtend{
+			TrackId:              trackID,
+			DefaultSampleDescIdx: 1,
+		})
+		trackID++
+	}
+	if len(moov.Tracks) == 0 {
+		return fmt.Errorf("fmp4: no supported codecs found")
+	}
+	moov.Header.NextTrackId = int32(trackID)
+
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5"), []byte("iso6"), []byte("mp41"))
+	if _, err = m.w.Write(ftyp); err != nil {
+		return
+	}
+	b := make([]byte, moov.Len())
+	moov.Marshal(b)
+	_, err = m.w.Write(b)
+	return
+}
+
+// WritePacket adds a packet to the current fragment. As the duration of a sample is only
+// known when the next packet arrives, every packet is kept back until the next one is written.
+func (m *Muxer) WritePacket(pkt av.Packet) (err error) {
+	if int(pkt.Idx) >= len(m.streams) || m.streams[pkt.Idx] == nil {
+		return
+	}
+	stream := m.streams[pkt.Idx]
+	isVideo := stream.Type().IsVideo()
+
+	if stream.lastPkt != nil {
+		duration := pkt.Time - stream.lastPkt.Time
+		if duration < 0 {
+			duration = stream.lastDuration
+		}
+		stream.addSample(*stream.lastPkt, duration)
+	}
+
+	// Start a new fragment on a keyframe, once the current one is long enough.
+	if isVideo && pkt.IsKeyFrame {
+		if !m.fragmentStarted {
+			m.fragmentStarted = true
+			m.fragmentStart = pkt.Time
+		} else if pkt.Time-m.fragmentStart >= m.fragmentDuration {
+			if err = m.writeFragment(); err != nil {
+				return
+			}
+			m.fragmentStart = pkt.Time
+		}
+	}
+
+	stream.lastPkt = &pkt
+	return
+}
+
+// WriteTrailer writes the remaining samples in a last fragment.
+func (m *Muxer) WriteTrailer() (err error) {
+	for _, stream := range m.streams {
+		if stream != nil && stream.lastPkt != nil {
+			stream.addSample(*stream.lastPkt, stream.lastDuration)
+			stream.lastPkt = nil
+		}
+	}
+	err = m.writeFragment()
+	m.streams = nil
+	return
+}
+
+func (s *Stream) addSample(pkt av.Packet, duration time.Duration) {
+	flags := uint32(sampleFlagsKeyFrame)
+	if s.Type().IsVideo() && !pkt.IsKeyFrame {
+		flags = sampleFlagsNonKeyFrame
+	}
+	s.samples = append(s.samples, sample{
+		data:     pkt.Data,
+		duration: uint32(timeToTs(duration)),
+		flags:    flags,
+		cts:      uint32(timeToTs(pkt.CompositionTime)),
+	})
+	s.lastDuration = duration
+}
+
+// writeFragment writes a moof atom followed by a mdat atom, containing the samples
+// of all tracks one after the other.
+func (m *Muxer) writeFragment() (err error) {
+
+	var streams []*Stream
+	for _, stream := range m.streams {
+		if stream != nil && len(stream.samples) > 0 {
+			streams = append(streams, stream)
+		}
+	}
+	if len(streams) == 0 {
+		return
+	}
+	m.sequenceNumber++
+
+	// We need the size of the moof atom first, as the sample data offsets
+	// are relative to the start of the moof atom.
+	moofSize := 8 + 16
+	for _, stream := range streams {
+		moofSize += trafSize(stream)
+	}
+
+	var trafs [][]byte
+	dataOffset := moofSize + 8
+	mdatSize := 8
+	for _, stream := range streams {
+		trafs = append(trafs, traf(stream, uint32(dataOffset)))
+		for _, s := range stream.samples {
+			dataOffset += len(s.data)
+			mdatSize += len(s.data)
+		}
+	}
+
+	mfhd := box("mfhd", u32(0), u32(m.sequenceNumber))
+	moof := box("moof", append([][]byte{mfhd}, trafs...)...)
+	if _, err = m.w.Write(moof); err != nil {
+		return
+	}
+	if _, err = m.w.Write(append(u32(uint32(mdatSize)), []byte("mdat")...)); err != nil {
+		return
+	}
+	for _, stream := range streams {
+		for _, s := range stream.samples {
+			if _, err = m.w.Write(s.data); err != nil {
+				return
+			}
+			stream.decodeTime += int64(s.duration)
+		}
+		stream.samples = nil
+	}
+	return
+}
+
+func hasCompositionOffset(stream *Stream) bool {
+	return stream.Type().IsVideo()
+}
+
+func trafSize(stream *Stream) int {
+	entrySize := 12
+	if hasCompositionOffset(stream) {
+		entrySize = 16
+	}
+	tfhd := 8 + 4 + 4
+	tfdt := 8 + 4 + 8
+	trun := 8 + 4 + 4 + 4 + len(stream.samples)*entrySize
+	return 8 + tfhd + tfdt + trun
+}
+
+func traf(stream *Stream, dataOffset uint32) []byte {
+
+	// The base data offset is the start of the moof atom.
+	tfhd := box("tfhd", u32(mp4io.TFHD_DEFAULT_BASE_IS_MOOF), u32(stream.trackID))
+
+	// Version 1, so the decode time is written as 64 bit.
+	tfdt := box("tfdt", u32(1<<24), u64(uint64(stream.decodeTime)))
+
+	flags := uint32(mp4io.TRUN_DATA_OFFSET | mp4io.TRUN_SAMPLE_DURATION | mp4io.TRUN_SAMPLE_SIZE | mp4io.TRUN_SAMPLE_FLAGS)
+	if hasCompositionOffset(stream) {
+		flags |= mp4io.TRUN_SAMPLE_CTS
+	}
+	entries := [][]byte{u32(flags), u32(uint32(len(stream.samples))), u32(dataOffset)}
+	for _, s := range stream.samples {
+		entries = append(entries, u32(s.duration), u32(uint32(len(s.data))), u32(s.flags))
+		if hasCompositionOffset(stream) {
+			entries = append(entries, u32(s.cts))
+		}
+	}
+	trun := box("trun", entries...)
+
+	return box("traf", tfhd, tfdt, trun)
+}
+
+// newTrack creates the trak atom of a stream, with an empty sample table.
+func newTrack(codec av.CodecData, trackID uint32) (*mp4io.Track, bool) {
+
+	sampleTable := &mp4io.SampleTable{
+		SampleDesc:    &mp4io.SampleDesc{},
+		TimeToSample:  &mp4io.TimeToSample{},
+		SampleToChunk: &mp4io.SampleToChunk{},
+		SampleSize:    &mp4io.SampleSize{},
+		ChunkOffset:   &mp4io.ChunkOffset{},
+	}
+
+	track := &mp4io.Track{
+		Header: &mp4io.TrackHeader{
+			TrackId: int32(trackID),
+			Flags:   0x0003, // Track enabled | Track in movie
+			Matrix:  [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
+		},
+		Media: &mp4io.Media{
+			Header: &mp4io.MediaHeader{
+				TimeScale: timeScale,
+				Language:  21956,
+			},
+			Info: &mp4io.MediaInfo{
+				Sample: sampleTable,
+				Data: &mp4io.DataInfo{
+					Refer: &mp4io.DataRefer{
+						Url: &mp4io.DataReferUrl{
+							Flags: 0x000001, // Self reference
+						},
+					},
+				},
+			},
+		},
+	}
+
+	switch codec.Type() {
+	case av.H264:
+		h264Codec := codec.(h264parser.CodecData)
+		width, height := h264Codec.Width(), h264Codec.Height()
+		sampleTable.SampleDesc.AVC1Desc = &mp4io.AVC1Desc{
+			DataRefIdx:           1,
+			HorizontalResolution: 72,
+			VorizontalResolution: 72,
+			Width:                int16(width),
+			Height:               int16(height),
+			FrameCount:           1,
+			Depth:                24,
+			ColorTableId:         -1,
+			Conf:                 &mp4io.AVC1Conf{Data: h264Codec.AVCDecoderConfRecordBytes()},
+		}
+		track.Media.Handler = &mp4io.HandlerRefer{
+			SubType: [4]byte{'v', 'i', 'd', 'e'},
+			Name:    []byte("Video Media Handler"),
+		}
+		track.Media.Info.Video = &mp4io.VideoMediaInfo{
+			Flags: 0x000001,
+		}
+		track.Header.TrackWidth = float64(width)
+		track.Header.TrackHeight = float64(height)
+
+	case av.H265:
+		// mp4io has no hvc1 sample entry, so we write the atom ourselves.
+		h265Codec := codec.(h265parser.CodecData)
+		width, height := h265Codec.Width(), h265Codec.Height()
+		sampleTable.SampleDesc.Unknowns = []mp4io.Atom{&mp4io.Dummy{
+			Tag_: mp4io.StringToTag("hvc1"),
+			Data: hvc1(width, height, h265Codec.AVCDecoderConfRecordBytes()),
+		}}
+		track.Media.Handler = &mp4io.HandlerRefer{
+			SubType: [4]byte{'v', 'i', 'd', 'e'},
+			Name:    []byte("Video Media Handler"),
+		}
+		track.Media.Info.Video = &mp4io.VideoMediaInfo{
+			Flags: 0x000001,
+		}
+		track.Header.TrackWidth = float64(width)
+		track.Header.TrackHeight = float64(height)
+
+	case av.AAC:
+		aacCodec := codec.(aacparser.CodecData)
+		sampleTable.SampleDesc.MP4ADesc = &mp4io.MP4ADesc{
+			DataRefIdx:       1,
+			NumberOfChannels: int16(aacCodec.ChannelLayout().Count()),
+			SampleSize:       int16(aacCodec.SampleFormat().BytesPerSample()),
+			SampleRate:       float64(aacCodec.SampleRate()),
+			Conf: &mp4io.ElemStreamDesc{
+				DecConfig: aacCodec.MPEG4AudioConfigBytes(),
+			},
+		}
+		track.Header.Volume = 1
+		track.Header.AlternateGroup = 1
+		track.Media.Handler = &mp4io.HandlerRefer{
+			SubType: [4]byte{'s', 'o', 'u', 'n'},
+			Name:    []byte("Sound Handler"),
+		}
+		track.Media.Info.Sound = &mp4io.SoundMediaInfo{}
+
+	default:
+		return nil, false
+	}
+	return track, true
+}
+
+// hvc1 creates the visual sample entry of an H265 track (ISO/IEC 14496-15), which
+// contains the decoder configuration record (hvcC).
+func hvc1(width int, height int, record []byte) []byte {
+	compressorName := make([]byte, 32)
+	return box("hvc1",
+		make([]byte, 6), u16(1), // reserved, data reference index
+		u16(0), u16(0), make([]byte, 12), // pre defined, reserved
+		u16(uint16(width)), u16(uint16(height)),
+		u32(0x00480000), u32(0x00480000), // 72 dpi
+		u32(0), u16(1), // reserved, frame count
+		compressorName,
+		u16(0x0018), u16(0xffff), // depth, pre defined (-1)
+		box("hvcC", record),
+	)
+}
+
+func timeToTs(tm time.Duration) int64 {
+	return int64(tm * time.Duration(timeScale) / time.Second)
+}
+
+// box creates an atom with the given type, and the payloads as content.
+func box(tag string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], tag)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
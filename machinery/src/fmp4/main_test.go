@@ -0,0 +1,247 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/kerberos-io/joy4/av"
+	"github.com/kerberos-io/joy4/codec/aacparser"
+	"github.com/kerberos-io/joy4/codec/h264parser"
+	"github.com/kerberos-io/joy4/format/mp4/mp4io"
+)
+
+// The packets of a stream, which are written to the muxer.
+const (
+	videoInterval = 40 * time.Millisecond // 25 fps
+	audioInterval = 20 * time.Millisecond
+	keyFrameEvery = 25 // a keyframe every second
+	numberOfVideo = 60
+	numberOfAudio = 120
+)
+
+func testStreams(t *testing.T) []av.CodecData {
+	t.Helper()
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c8f162d96")
+	pps, _ := hex.DecodeString("68ebe3cb22c0")
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{video, audio}
+}
+
+// testPackets returns interleaved video (idx 0) and audio (idx 1) packets, ordered by time.
+// Every packet has a different size and content, so it can be found back in the mdat.
+func testPackets() []av.Packet {
+	var packets []av.Packet
+	v, a := 0, 0
+	for v < numberOfVideo || a < numberOfAudio {
+		videoTime := time.Duration(v) * videoInterval
+		audioTime := time.Duration(a) * audioInterval
+		if v < numberOfVideo && (a >= numberOfAudio || videoTime <= audioTime) {
+			packets = append(packets, av.Packet{
+				Idx:        0,
+				IsKeyFrame: v%keyFrameEvery == 0,
+				Time:       videoTime,
+				Data:       bytes.Repeat([]byte{byte(v)}, 100+v),
+			})
+			v++
+		} else {
+			packets = append(packets, av.Packet{
+				Idx:  1,
+				Time: audioTime,
+				Data: bytes.Repeat([]byte{byte(a)}, 10+a),
+			})
+			a++
+		}
+	}
+	return packets
+}
+
+// decodeTime returns the base decode time of a tfdt atom, which joy4 parses as a time.
+func decodeTime(tfdt *mp4io.TrackFragDecodeTime) uint64 {
+	return uint64(tfdt.Time.Sub(time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)) / time.Second)
+}
+
+// trunEntries parses the samples of a trun atom. joy4 reads the fields of the first sample
+// according to the first sample flags, instead of the flags of the trun (ISO/IEC 14496-12),
+// so its entries can't be used.
+func trunEntries(t *testing.T, output []byte, trun *mp4io.TrackFragRun) []mp4io.TrackFragRunEntry {
+	t.Helper()
+	offset, size := trun.Pos()
+	b := output[offset : offset+size]
+	n := 8 + 4
+	count := binary.BigEndian.Uint32(b[n:])
+	n += 4
+	if trun.Flags&mp4io.TRUN_DATA_OFFSET != 0 {
+		n += 4
+	}
+	if trun.Flags&mp4io.TRUN_FIRST_SAMPLE_FLAGS != 0 {
+		n += 4
+	}
+	read := func() uint32 {
+		v := binary.BigEndian.Uint32(b[n:])
+		n += 4
+		return v
+	}
+	entries := make([]mp4io.TrackFragRunEntry, count)
+	for i := range entries {
+		if trun.Flags&mp4io.TRUN_SAMPLE_DURATION != 0 {
+			entries[i].Duration = read()
+		}
+		if trun.Flags&mp4io.TRUN_SAMPLE_SIZE != 0 {
+			entries[i].Size = read()
+		}
+		if trun.Flags&mp4io.TRUN_SAMPLE_FLAGS != 0 {
+			entries[i].Flags = read()
+		}
+		if trun.Flags&mp4io.TRUN_SAMPLE_CTS != 0 {
+			entries[i].Cts = read()
+		}
+	}
+	if n != size {
+		t.Fatalf("trun is %d bytes, its samples end at %d", size, n)
+	}
+	return entries
+}
+
+func TestMuxer(t *testing.T) {
+	var buffer bytes.Buffer
+	muxer := NewMuxer(&buffer, time.Second)
+	if err := muxer.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	packets := testPackets()
+	for _, pkt := range packets {
+		if err := muxer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	output := buffer.Bytes()
+
+	atoms, err := mp4io.ReadFileAtoms(bytes.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The top level atoms should cover the whole file: ftyp, moov and a moof/mdat per fragment.
+	end := 0
+	var tags []string
+	for _, atom := range atoms {
+		offset, size := atom.Pos()
+		if offset != end {
+			t.Fatalf("atom %s starts at %d, expected %d", atom.Tag(), offset, end)
+		}
+		end = offset + size
+		tags = append(tags, atom.Tag().String())
+	}
+	if end != len(output) {
+		t.Fatalf("atoms end at %d, the file is %d bytes", end, len(output))
+	}
+	expectedTags := []string{"ftyp", "moov", "moof", "mdat", "moof", "mdat", "moof", "mdat"}
+	if len(tags) != len(expectedTags) {
+		t.Fatalf("atoms %v, expected %v", tags, expectedTags)
+	}
+	for i := range tags {
+		if tags[i] != expectedTags[i] {
+			t.Fatalf("atoms %v, expected %v", tags, expectedTags)
+		}
+	}
+
+	moov := atoms[1].(*mp4io.Movie)
+	if len(moov.Tracks) != 2 || moov.MovieExtend == nil || len(moov.MovieExtend.Tracks) != 2 {
+		t.Fatalf("moov should contain 2 tracks and their trex")
+	}
+
+	// The packets of every track, in the order they should be found in the fragments.
+	expected := map[uint32][]av.Packet{}
+	for _, pkt := range packets {
+		expected[uint32(pkt.Idx)+1] = append(expected[uint32(pkt.Idx)+1], pkt)
+	}
+	durations := map[uint32]uint32{
+		1: uint32(timeToTs(videoInterval)),
+		2: uint32(timeToTs(audioInterval)),
+	}
+
+	found := map[uint32]int{}
+	decodeTimes := map[uint32]uint64{}
+	for i := 2; i < len(atoms); i += 2 {
+		moof := atoms[i].(*mp4io.MovieFrag)
+		moofOffset, _ := moof.Pos()
+		mdatOffset, mdatSize := atoms[i+1].Pos()
+		sequenceNumber := uint32(i / 2)
+		if moof.Header == nil || moof.Header.Seqnum != sequenceNumber {
+			t.Errorf("moof %d: wrong sequence number", sequenceNumber)
+		}
+
+		for _, traf := range moof.Tracks {
+			// joy4 doesn't parse the track id of the tfhd, it follows the version and flags.
+			tfhdOffset, _ := traf.Header.Pos()
+			trackID := binary.BigEndian.Uint32(output[tfhdOffset+12:])
+			if traf.Header.Flags&mp4io.TFHD_DEFAULT_BASE_IS_MOOF == 0 {
+				t.Errorf("moof %d, track %d: base data offset isn't the moof", sequenceNumber, trackID)
+			}
+			if got := decodeTime(traf.DecodeTime); got != decodeTimes[trackID] {
+				t.Errorf("moof %d, track %d: tfdt %d, expected %d", sequenceNumber, trackID, got, decodeTimes[trackID])
+			}
+
+			offset := moofOffset + int(traf.Run.DataOffset)
+			for j, entry := range trunEntries(t, output, traf.Run) {
+				pkt := expected[trackID][found[trackID]]
+				found[trackID]++
+				decodeTimes[trackID] += uint64(entry.Duration)
+
+				if entry.Duration != durations[trackID] {
+					t.Errorf("moof %d, track %d, sample %d: duration %d, expected %d", sequenceNumber, trackID, j, entry.Duration, durations[trackID])
+				}
+				flags := uint32(sampleFlagsKeyFrame)
+				if trackID == 1 && !pkt.IsKeyFrame {
+					flags = sampleFlagsNonKeyFrame
+				}
+				if entry.Flags != flags {
+					t.Errorf("moof %d, track %d, sample %d: flags %x, expected %x", sequenceNumber, trackID, j, entry.Flags, flags)
+				}
+				// A video fragment starts with a keyframe.
+				if trackID == 1 && j == 0 && !pkt.IsKeyFrame {
+					t.Errorf("moof %d: video doesn't start with a keyframe", sequenceNumber)
+				}
+				if int(entry.Size) != len(pkt.Data) {
+					t.Fatalf("moof %d, track %d, sample %d: size %d, expected %d", sequenceNumber, trackID, j, entry.Size, len(pkt.Data))
+				}
+				if offset < mdatOffset+8 || offset+int(entry.Size) > mdatOffset+mdatSize {
+					t.Fatalf("moof %d, track %d, sample %d: data outside of the mdat", sequenceNumber, trackID, j)
+				}
+				if !bytes.Equal(output[offset:offset+int(entry.Size)], pkt.Data) {
+					t.Fatalf("moof %d, track %d, sample %d: wrong data", sequenceNumber, trackID, j)
+				}
+				offset += int(entry.Size)
+			}
+		}
+	}
+
+	if found[1] != numberOfVideo || found[2] != numberOfAudio {
+		t.Errorf("found %d video and %d audio samples, expected %d and %d", found[1], found[2], numberOfVideo, numberOfAudio)
+	}
+}
+
+func TestMuxerWithoutSupportedCodecs(t *testing.T) {
+	var buffer bytes.Buffer
+	muxer := NewMuxer(&buffer, time.Second)
+	if err := muxer.WriteHeader(nil); err == nil {
+		t.Error("expected an error without streams")
+	}
+}
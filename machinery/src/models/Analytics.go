@@ -0,0 +1,50 @@
+package models
+
+// The events of the analytics, which are sent separately from the motion events.
+const (
+	EventLineCrossing = "linecrossing" // an object crossed a tripwire
+	EventLoitering    = "loitering"    // an object stayed in an area longer than allowed
+)
+
+// The directions in which a tripwire is crossed. Walking along the line from the start
+// to the end, "in" is crossing from the left to the right side, "out" the other way.
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// Tripwire is a line (start, end) which is crossed by the tracked objects. When a
+// direction is set, only crossings in that direction are reported, otherwise both.
+type Tripwire struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty" bson:"name,omitempty"`
+	Start     Coordinate `json:"start"`
+	End       Coordinate `json:"end"`
+	Direction string     `json:"direction,omitempty" bson:"direction,omitempty"`
+}
+
+// Dwell is an area (polygon) in which a tracked object may stay for at most the duration
+// (seconds), e.g. to detect loitering in front of a door.
+type Dwell struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name,omitempty" bson:"name,omitempty"`
+	Coordinates []Coordinate `json:"coordinates"`
+	Duration    int          `json:"duration"`
+}
+
+// AnalyticsEvent is sent over MQTT and to the webhook when a rule of the region fires.
+// For a line crossing it contains the direction and the number of crossings in both
+// directions since the agent started, for loitering the time the object stayed (seconds).
+type AnalyticsEvent struct {
+	Event     string     `json:"event" bson:"event"`
+	Camera    string     `json:"camera,omitempty" bson:"camera,omitempty"`
+	Rule      string     `json:"rule" bson:"rule"`
+	Name      string     `json:"name,omitempty" bson:"name,omitempty"`
+	Track     int        `json:"track" bson:"track"`
+	Position  Coordinate `json:"position" bson:"position"`
+	Timestamp int64      `json:"timestamp" bson:"timestamp"`
+	Direction string     `json:"direction,omitempty" bson:"direction,omitempty"`
+	CountIn   int        `json:"count_in,omitempty" bson:"count_in,omitempty"`
+	CountOut  int        `json:"count_out,omitempty" bson:"count_out,omitempty"`
+	Duration  int        `json:"duration,omitempty" bson:"duration,omitempty"`
+}
@@ -11,14 +11,41 @@ import (
 type Communication struct {
 	PackageCounter        *atomic.Value
 	HandleBootstrap       chan string
+	HandleControlAgent    chan string
 	HandleStream          chan string
-	HandleMotion          chan int64
+	HandleSubStream       chan string
+	HandleMotion          chan MotionDataPartial
 	HandleUpload          chan string
+	HandleRetention       chan string
 	HandleHeartBeat       chan string
 	HandleLiveSD          chan int64
 	HandleLiveHDKeepalive chan string
 	HandleLiveHDHandshake chan SDPPayload
 	HandleLiveHDPeers     chan string
 	HandleONVIF           chan OnvifAction
+	HandleONVIFActions    chan string
 	IsConfiguring         *abool.AtomicBool
 }
+
+// SendMotion sends a motion event to the recorder without blocking, it returns false
+// if the recorder is busy. The channel lives as long as the camera, so this is safe
+// while the agent restarts.
+func (c *Communication) SendMotion(motion MotionDataPartial) bool {
+	select {
+	case c.HandleMotion <- motion:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendONVIFAction sends an action to the ONVIF handler without blocking, it returns
+// false if the handler is busy.
+func (c *Communication) SendONVIFAction(action OnvifAction) bool {
+	select {
+	case c.HandleONVIF <- action:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,9 +1,12 @@
 package models
 
 // A struct which contains the global, local and merged config.
+// Camera is the identifier of the camera, when multiple cameras are
+// configured, otherwise it's empty.
 type Configuration struct {
 	Name         string
 	Port         string
+	Camera       string
 	Config       Config
 	CustomConfig Config
 	GlobalConfig Config
@@ -20,9 +23,11 @@ type Config struct {
 	Capture       Capture      `json:"capture"`
 	Timetable     []*Timetable `json:"timetable"`
 	Region        *Region      `json:"region"`
+	Cameras       []*Camera    `json:"cameras,omitempty" bson:"cameras,omitempty"`
 	Cloud         string       `json:"cloud,omitempty" bson:"cloud,omitempty"`
 	S3            *S3          `json:"s3,omitempty" bson:"s3,omitempty"`
 	KStorage      *KStorage    `json:"kstorage,omitempty" bson:"kstorage,omitempty"`
+	Retention     *Retention   `json:"retention,omitempty" bson:"retention,omitempty"`
 	MQTTURI       string       `json:"mqtturi,omitempty" bson:"mqtturi,omitempty"`
 	MQTTUsername  string       `json:"mqtt_username,omitempty" bson:"mqtt_username"`
 	MQTTPassword  string       `json:"mqtt_password,omitempty" bson:"mqtt_password"`
@@ -36,31 +41,56 @@ type Config struct {
 	HubPrivateKey string       `json:"hub_private_key,omitempty" bson:"hub_private_key"`
 	HubSite       string       `json:"hub_site,omitempty" bson:"hub_site"`
 	ConditionURI  string       `json:"condition_uri,omitempty" bson:"condition_uri"`
+	WebhookURI    string       `json:"webhook_uri,omitempty" bson:"webhook_uri"`
+}
+
+// Camera is one of the cameras of an agent which runs multiple cameras. A camera has
+// its own capture settings, region and timetable, all other settings are shared
+// with the agent. When no cameras are defined, a single camera is running using
+// the capture settings of the agent.
+type Camera struct {
+	ID        string       `json:"id" bson:"id"`
+	Name      string       `json:"name" bson:"name"`
+	Key       string       `json:"key,omitempty" bson:"key,omitempty"`
+	Capture   Capture      `json:"capture" bson:"capture"`
+	Timetable []*Timetable `json:"timetable,omitempty" bson:"timetable,omitempty"`
+	Region    *Region      `json:"region,omitempty" bson:"region,omitempty"`
 }
 
 // Capture defines which camera type (Id) you are using (IP, USB or Raspberry Pi camera),
 // and also contains recording specific parameters.
 type Capture struct {
-	Name                  string      `json:"name"`
-	IPCamera              IPCamera    `json:"ipcamera"`
-	USBCamera             USBCamera   `json:"usbcamera"`
-	RaspiCamera           RaspiCamera `json:"raspicamera"`
-	Continuous            string      `json:"continuous,omitempty"`
-	PostRecording         int64       `json:"postrecording"`
-	PreRecording          int         `json:"prerecording"`
-	MaxLengthRecording    int64       `json:"maxlengthrecording"`
-	TranscodingWebRTC     string      `json:"transcodingwebrtc"`
-	TranscodingResolution int64       `json:"transcodingresolution"`
-	ForwardWebRTC         string      `json:"forwardwebrtc"`
-	Fragmented            string      `json:"fragmented,omitempty" bson:"fragmented,omitempty"`
-	FragmentedDuration    int64       `json:"fragmentedduration,omitempty" bson:"fragmentedduration,omitempty"`
-	PixelChangeThreshold  int         `json:"pixelChangeThreshold,omitempty"`
+	ID                    string           `json:"id"`
+	Name                  string           `json:"name"`
+	IPCamera              IPCamera         `json:"ipcamera"`
+	USBCamera             USBCamera        `json:"usbcamera"`
+	RaspiCamera           RaspiCamera      `json:"raspicamera"`
+	Continuous            string           `json:"continuous,omitempty"`
+	PostRecording         int64            `json:"postrecording"`
+	PreRecording          int              `json:"prerecording"`
+	MaxLengthRecording    int64            `json:"maxlengthrecording"`
+	TranscodingWebRTC     string           `json:"transcodingwebrtc"`
+	TranscodingResolution int64            `json:"transcodingresolution"`
+	ForwardWebRTC         string           `json:"forwardwebrtc"`
+	Fragmented            string           `json:"fragmented,omitempty" bson:"fragmented,omitempty"`
+	FragmentedDuration    int64            `json:"fragmentedduration,omitempty" bson:"fragmentedduration,omitempty"`
+	PixelChangeThreshold  int              `json:"pixelChangeThreshold,omitempty"`
+	MotionFPS             int              `json:"motionfps,omitempty" bson:"motionfps,omitempty"`
+	MinObjectSize         int              `json:"minobjectsize,omitempty" bson:"minobjectsize,omitempty"`
+	MaxObjectSize         int              `json:"maxobjectsize,omitempty" bson:"maxobjectsize,omitempty"`
+	MotionDetector        string           `json:"motiondetector,omitempty" bson:"motiondetector,omitempty"`
+	LearningRate          float64          `json:"learningrate,omitempty" bson:"learningrate,omitempty"`
+	SceneChangeThreshold  int              `json:"scenechangethreshold,omitempty" bson:"scenechangethreshold,omitempty"`
+	Tamper                *Tamper          `json:"tamper,omitempty" bson:"tamper,omitempty"`
+	ObjectDetection       *ObjectDetection `json:"objectdetection,omitempty" bson:"objectdetection,omitempty"`
 }
 
 // IPCamera configuration, such as the RTSP url of the IPCamera and the FPS.
-// Also includes ONVIF integration
+// Also includes ONVIF integration. The optional SubRTSP is a low resolution stream
+// of the camera, which is used for motion detection and the SD livestream.
 type IPCamera struct {
 	RTSP          string `json:"rtsp"`
+	SubRTSP       string `json:"sub_rtsp,omitempty" bson:"sub_rtsp,omitempty"`
 	FPS           string `json:"fps"`
 	ONVIF         bool   `json:"onvif,omitempty" bson:"onvif"`
 	ONVIFXAddr    string `json:"onvif_xaddr,omitempty" bson:"onvif_xaddr"`
@@ -68,22 +98,36 @@ type IPCamera struct {
 	ONVIFPassword string `json:"onvif_password,omitempty" bson:"onvif_password"`
 }
 
-// USBCamera configuration, such as the device path (/dev/video*)
+// USBCamera configuration, such as the device path (/dev/video*). The resolution
+// and FPS are optional, the defaults of the device are used when not set.
 type USBCamera struct {
 	Device string `json:"device"`
+	FPS    string `json:"fps,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
 }
 
-// RaspiCamera configuration, such as the device path (/dev/video*)
+// RaspiCamera configuration, such as the device path (/dev/video*). The camera
+// is accessed through V4L2 (bcm2835-v4l2), similar to an USB camera.
 type RaspiCamera struct {
 	Device string `json:"device"`
+	FPS    string `json:"fps,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
 }
 
 // Region specifies the type (Id) of Region Of Interest (ROI), you
-// would like to use.
+// would like to use. The exclusions are subtracted from every polygon,
+// e.g. to ignore trees, a road or the timestamp overlay of the camera.
+// The tripwires and dwells are rules for the objects which are tracked
+// in the polygons.
 type Region struct {
-	Name      string    `json:"name"`
-	Rectangle Rectangle `json:"rectangle"`
-	Polygon   []Polygon `json:"polygon"`
+	Name       string     `json:"name"`
+	Rectangle  Rectangle  `json:"rectangle"`
+	Polygon    []Polygon  `json:"polygon"`
+	Exclusions []Polygon  `json:"exclusions,omitempty" bson:"exclusions,omitempty"`
+	Tripwires  []Tripwire `json:"tripwires,omitempty" bson:"tripwires,omitempty"`
+	Dwells     []Dwell    `json:"dwells,omitempty" bson:"dwells,omitempty"`
 }
 
 // Rectangle is defined by a starting point, left top (x1,y1) and end point (x2,y2).
@@ -95,10 +139,15 @@ type Rectangle struct {
 }
 
 // Polygon is a sequence of coordinates (x,y). The ID specifies an unique identifier,
-// as multiple polygons can be defined.
+// as multiple polygons can be defined. Every polygon is a zone in which motion is
+// detected independently, with its own sensitivity (1-100), number of pixels which
+// should change and timetable. When not set, the settings of the camera are used.
 type Polygon struct {
-	ID          string       `json:"id"`
-	Coordinates []Coordinate `json:"coordinates"`
+	ID                   string       `json:"id"`
+	Coordinates          []Coordinate `json:"coordinates"`
+	Sensitivity          int          `json:"sensitivity,omitempty" bson:"sensitivity,omitempty"`
+	PixelChangeThreshold int          `json:"pixelChangeThreshold,omitempty" bson:"pixelChangeThreshold,omitempty"`
+	Timetable            []*Timetable `json:"timetable,omitempty" bson:"timetable,omitempty"`
 }
 
 // Coordinate belongs to a Polygon.
@@ -138,3 +187,13 @@ type KStorage struct {
 	Provider        string `json:"provider,omitempty" bson:"provider,omitempty"`
 	Directory       string `json:"directory,omitempty" bson:"directory,omitempty"`
 }
+
+// Retention defines when recordings are removed from disk. Recordings are removed oldest
+// first, if they are older than the maximum age (hours), if all recordings together exceed
+// the maximum size (MB) or if the free disk space drops below the minimum (MB).
+// A value of 0 disables the policy.
+type Retention struct {
+	MaxAge      int64 `json:"maxage,omitempty" bson:"maxage,omitempty"`
+	MaxSize     int64 `json:"maxsize,omitempty" bson:"maxsize,omitempty"`
+	MinFreeDisk int64 `json:"minfreedisk,omitempty" bson:"minfreedisk,omitempty"`
+}
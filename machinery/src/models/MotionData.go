@@ -0,0 +1,25 @@
+package models
+
+// MotionDataPartial is send by the motion detection to the recorder, and contains
+// the metadata of a motion event which is encoded in the recording name. Zones are the
+// IDs of the polygons in which motion was detected, and blobs the moving objects. The
+// objects (and their labels) are detected by the object detection, if enabled.
+type MotionDataPartial struct {
+	Timestamp       int64     `json:"timestamp" bson:"timestamp"`
+	Microseconds    int64     `json:"microseconds" bson:"microseconds"`
+	NumberOfChanges int       `json:"numberOfChanges" bson:"numberOfChanges"`
+	Rectangle       Rectangle `json:"rectangle" bson:"rectangle"`
+	Trigger         string    `json:"trigger,omitempty" bson:"trigger,omitempty"`
+	Zones           []string  `json:"zones,omitempty" bson:"zones,omitempty"`
+	Blobs           []Blob    `json:"blobs,omitempty" bson:"blobs,omitempty"`
+	Objects         []Object  `json:"objects,omitempty" bson:"objects,omitempty"`
+	Labels          []string  `json:"labels,omitempty" bson:"labels,omitempty"`
+}
+
+// Blob is an area of connected pixels which changed, expressed in pixels of the
+// (main) stream. The centroid is the center of mass of its contour.
+type Blob struct {
+	Rectangle Rectangle  `json:"rectangle" bson:"rectangle"`
+	Area      int        `json:"area" bson:"area"`
+	Centroid  Coordinate `json:"centroid" bson:"centroid"`
+}
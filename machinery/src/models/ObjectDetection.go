@@ -0,0 +1,25 @@
+package models
+
+// ObjectDetection configures the object detection of a camera, which runs on the frames
+// in which motion is detected. The model is a local file (e.g. an ONNX model, or the
+// weights of a Darknet model with its config), the labels file contains a label per line.
+// When classes are set, motion is only reported if one of these objects (e.g. person or
+// car) is detected in the area of the motion.
+type ObjectDetection struct {
+	Enabled      string   `json:"enabled,omitempty" bson:"enabled,omitempty"`
+	Backend      string   `json:"backend,omitempty" bson:"backend,omitempty"`
+	Model        string   `json:"model,omitempty" bson:"model,omitempty"`
+	Config       string   `json:"config,omitempty" bson:"config,omitempty"`
+	Labels       string   `json:"labels,omitempty" bson:"labels,omitempty"`
+	InputSize    int      `json:"inputsize,omitempty" bson:"inputsize,omitempty"`
+	Confidence   float64  `json:"confidence,omitempty" bson:"confidence,omitempty"`
+	NMSThreshold float64  `json:"nmsthreshold,omitempty" bson:"nmsthreshold,omitempty"`
+	Classes      []string `json:"classes,omitempty" bson:"classes,omitempty"`
+}
+
+// Object is an object which was detected, with its label and bounding box.
+type Object struct {
+	Label      string    `json:"label" bson:"label"`
+	Confidence float64   `json:"confidence" bson:"confidence"`
+	Rectangle  Rectangle `json:"rectangle" bson:"rectangle"`
+}
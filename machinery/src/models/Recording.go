@@ -0,0 +1,48 @@
+package models
+
+// The trigger of a recording.
+const (
+	TriggerMotion     = "motion"
+	TriggerContinuous = "continuous"
+	TriggerManual     = "manual"
+	TriggerTamper     = "tamper"
+)
+
+// The upload status of a recording, for a specific destination (e.g. s3 or kstorage).
+const (
+	UploadPending  = "pending"
+	UploadFinished = "uploaded"
+	UploadFailed   = "failed"
+)
+
+// Recording is an entry of the recording catalog, it describes a single recording
+// which was written to ./data/recordings. Times are expressed in milliseconds.
+type Recording struct {
+	Name            string            `json:"name" bson:"name"`
+	Camera          string            `json:"camera,omitempty" bson:"camera,omitempty"`
+	Start           int64             `json:"start" bson:"start"`
+	End             int64             `json:"end" bson:"end"`
+	Duration        int64             `json:"duration" bson:"duration"`
+	Size            int64             `json:"size" bson:"size"`
+	Trigger         string            `json:"trigger" bson:"trigger"`
+	Region          Rectangle         `json:"region" bson:"region"`
+	NumberOfChanges int               `json:"numberOfChanges" bson:"numberOfChanges"`
+	Zones           []string          `json:"zones,omitempty" bson:"zones,omitempty"`
+	Blobs           []Blob            `json:"blobs,omitempty" bson:"blobs,omitempty"`
+	Labels          []string          `json:"labels,omitempty" bson:"labels,omitempty"`
+	Uploads         map[string]string `json:"uploads" bson:"uploads"`
+	Thumbnail       string            `json:"thumbnail" bson:"thumbnail"`
+	Local           bool              `json:"local" bson:"local"`
+}
+
+// RecordingQuery filters the recordings of the catalog. From and To are unix timestamps
+// in milliseconds, and are ignored when 0.
+type RecordingQuery struct {
+	From    int64  `json:"from" form:"from"`
+	To      int64  `json:"to" form:"to"`
+	Camera  string `json:"camera" form:"camera"`
+	Trigger string `json:"trigger" form:"trigger"`
+	Offset  int    `json:"offset" form:"offset"`
+	Limit   int    `json:"limit" form:"limit"`
+	Newest  bool   `json:"newest" form:"newest"`
+}
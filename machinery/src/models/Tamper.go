@@ -0,0 +1,35 @@
+package models
+
+// The types of tampering which are detected.
+const (
+	TamperCovered   = "covered"   // the brightness collapsed, e.g. a blocked or sprayed lens
+	TamperDefocused = "defocused" // the edges disappeared, e.g. a blurred or covered lens
+	TamperMoved     = "moved"     // the scene changed persistently, e.g. the camera was turned away
+)
+
+// Tamper configures the tamper detection of a camera. A measurement of the current frame
+// is compared with the reference frame, which is refreshed every interval (seconds). The
+// thresholds are percentages of the reference frame: the brightness and edges which should
+// remain, and the pixels which may change. A tamper event is sent when the tampering
+// lasts for the duration (seconds), and triggers a recording if record is "true".
+type Tamper struct {
+	Enabled              string `json:"enabled,omitempty" bson:"enabled,omitempty"`
+	Record               string `json:"record,omitempty" bson:"record,omitempty"`
+	Interval             int    `json:"interval,omitempty" bson:"interval,omitempty"`
+	Duration             int    `json:"duration,omitempty" bson:"duration,omitempty"`
+	BrightnessThreshold  int    `json:"brightnessthreshold,omitempty" bson:"brightnessthreshold,omitempty"`
+	EdgeThreshold        int    `json:"edgethreshold,omitempty" bson:"edgethreshold,omitempty"`
+	SceneChangeThreshold int    `json:"scenechangethreshold,omitempty" bson:"scenechangethreshold,omitempty"`
+}
+
+// TamperEvent is sent over MQTT and to the webhook when tampering is detected. The value
+// and reference are the brightness or edges of the current and the reference frame, for
+// a moved camera the percentage of the scene which changed and the threshold.
+type TamperEvent struct {
+	Event     string  `json:"event" bson:"event"`
+	Camera    string  `json:"camera,omitempty" bson:"camera,omitempty"`
+	Type      string  `json:"type" bson:"type"`
+	Timestamp int64   `json:"timestamp" bson:"timestamp"`
+	Value     float64 `json:"value" bson:"value"`
+	Reference float64 `json:"reference" bson:"reference"`
+}
@@ -1,9 +1,71 @@
 package models
 
+// The roles of a user, every role has the permissions of the roles below it.
+// Viewers can watch live video and recordings, operators can also use PTZ and
+// trigger recordings, admins can change the configuration and manage users.
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleViewer   = "viewer"
+)
+
+// RoleLevel returns the level of a role, 0 means the role is unknown.
+func RoleLevel(role string) int {
+	switch role {
+	case RoleAdmin:
+		return 3
+	case RoleOperator:
+		return 2
+	case RoleViewer:
+		return 1
+	}
+	return 0
+}
+
+// User is an account of the Kerberos Agent. The password is only used to login,
+// change or set a password, the user store only contains the (bcrypt) hash.
 type User struct {
-	Installed bool   `json:"installed" bson:"installed"`
+	Installed bool   `json:"installed,omitempty" bson:"installed"`
 	Username  string `json:"username" bson:"username"`
-	Password  string `json:"password" bson:"password"`
+	Password  string `json:"password,omitempty" bson:"password"`
+	Hash      string `json:"hash,omitempty" bson:"hash"`
 	Role      string `json:"role" bson:"role"`
-	Language  string `json:"language" bson:"language"`
+	Language  string `json:"language,omitempty" bson:"language"`
+}
+
+// UserConfig is the user store, which is persisted in ./data/config/user.json.
+// Installed is false until the first admin user has been created.
+type UserConfig struct {
+	Installed bool     `json:"installed" bson:"installed"`
+	Language  string   `json:"language" bson:"language"`
+	Users     []User   `json:"users" bson:"users"`
+	APIKeys   []APIKey `json:"apikeys" bson:"apikeys"`
+}
+
+// APIKey is used by other systems (e.g. a VMS or scripts) to access the API, using the
+// "Authorization: ApiKey <key>" header. The key is scoped to a role, and only the SHA-256
+// hash of the key is stored. Times are unix timestamps in seconds.
+type APIKey struct {
+	ID       string `json:"id" bson:"id"`
+	Name     string `json:"name" bson:"name"`
+	Role     string `json:"role" bson:"role"`
+	Hash     string `json:"hash,omitempty" bson:"hash"`
+	Key      string `json:"key,omitempty" bson:"-"`
+	Created  int64  `json:"created" bson:"created"`
+	LastUsed int64  `json:"lastused" bson:"lastused"`
+}
+
+// Install is used to create the first admin user, the token is printed in the logs
+// of the agent when it starts.
+type Install struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Language string `json:"language,omitempty"`
+	Token    string `json:"token" binding:"required"`
+}
+
+// UserPassword is used to change the password of the logged in user.
+type UserPassword struct {
+	Password    string `json:"password" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required"`
 }
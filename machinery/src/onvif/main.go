@@ -20,7 +20,17 @@ func HandleONVIFActions(configuration *models.Configuration, communication *mode
 	log.Log.Debug("HandleONVIFActions: started")
 
 	config := configuration.Config
-	for onvifAction := range communication.HandleONVIF {
+loop:
+	for {
+		// This will check if we need to stop the thread,
+		// because of a reconfiguration.
+		var onvifAction models.OnvifAction
+		select {
+		case <-communication.HandleONVIFActions:
+			break loop
+		case onvifAction = <-communication.HandleONVIF:
+		}
+
 		var ptzAction models.OnvifActionPTZ
 		b, _ := json.Marshal(onvifAction.Payload)
 		json.Unmarshal(b, &ptzAction)
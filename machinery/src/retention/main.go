@@ -0,0 +1,193 @@
+// Removing recordings from disk, so the disk doesn't fill up when recordings are not uploaded.
+package retention
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/catalog"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/shirou/gopsutil/disk"
+)
+
+const recordingsDirectory = "./data/recordings/"
+const cloudDirectory = "./data/cloud/"
+
+// Status contains the outcome of the retention, which is reported in the heartbeat.
+type Status struct {
+	NumberOfFiles  int   `json:"numberoffiles"`
+	TotalSize      int64 `json:"totalsize"`
+	DeletedFiles   int64 `json:"deletedfiles"`
+	DeletedSize    int64 `json:"deletedsize"`
+	LastRun        int64 `json:"lastrun"`
+	QueuedForCloud int   `json:"queuedforcloud"`
+}
+
+var (
+	statusMutex sync.Mutex
+	status      Status
+)
+
+// GetStatus returns the status of the last retention run.
+func GetStatus() Status {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	return status
+}
+
+func HandleRetention(configuration *models.Configuration, communication *models.Communication) {
+
+	log.Log.Debug("HandleRetention: started")
+
+	config := configuration.Config
+	if config.Retention == nil {
+		log.Log.Info("HandleRetention: no retention configured, recordings are only removed after upload.")
+	}
+
+loop:
+	for {
+		// This will check if we need to stop the thread,
+		// because of a reconfiguration.
+		select {
+		case <-communication.HandleRetention:
+			break loop
+		default:
+		}
+
+		ApplyRetention(config.Retention, config.Cloud)
+
+		select {
+		case <-communication.HandleRetention:
+			break loop
+		case <-time.After(60 * time.Second):
+		}
+	}
+
+	log.Log.Debug("HandleRetention: finished")
+}
+
+// ApplyRetention removes the oldest recordings until all retention policies are met.
+// The recordings are read from the catalog, which only contains finished recordings.
+// Recordings which are still queued for upload in ./data/cloud are never removed, unless
+// no cloud is configured: then nothing uploads them, and they would never be removed.
+func ApplyRetention(retention *models.Retention, cloud string) {
+
+	// Oldest recordings first.
+	recordings, _, err := catalog.List(models.RecordingQuery{})
+	if err != nil {
+		log.Log.Error("ApplyRetention: could not read catalog, " + err.Error())
+		return
+	}
+
+	now := time.Now()
+	var totalSize int64
+	var deletable []models.Recording
+	var expired []models.Recording
+	numberOfFiles := 0
+	queued := 0
+	for _, recording := range recordings {
+		if !recording.Local {
+			// The recording was uploaded and removed from disk, we only
+			// keep the entry in the catalog as long as the maximum age.
+			expired = append(expired, recording)
+			continue
+		}
+		numberOfFiles++
+		totalSize += recording.Size
+		if cloud != "" {
+			if _, err := os.Stat(cloudDirectory + recording.Name); err == nil {
+				queued++
+				continue
+			}
+		}
+		deletable = append(deletable, recording)
+	}
+
+	var deletedFiles int64
+	var deletedSize int64
+
+	if retention != nil {
+
+		var freeDisk int64 = -1
+		if retention.MinFreeDisk > 0 {
+			usage, err := disk.Usage(recordingsDirectory)
+			if err == nil {
+				freeDisk = int64(usage.Free)
+			} else {
+				log.Log.Error("ApplyRetention: could not read disk usage, " + err.Error())
+			}
+		}
+
+		maxAge := int64(retention.MaxAge) * 60 * 60 * 1000
+		maxSize := retention.MaxSize * 1024 * 1024
+		minFreeDisk := retention.MinFreeDisk * 1024 * 1024
+		nowInMs := now.UnixNano() / int64(time.Millisecond)
+
+		for _, recording := range deletable {
+			reason := ""
+			if retention.MaxAge > 0 && nowInMs-recording.End > maxAge {
+				reason = "maximum age of " + strconv.FormatInt(retention.MaxAge, 10) + " hours"
+			} else if retention.MaxSize > 0 && totalSize > maxSize {
+				reason = "maximum size of " + strconv.FormatInt(retention.MaxSize, 10) + " MB"
+			} else if freeDisk >= 0 && freeDisk < minFreeDisk {
+				reason = "minimum free disk of " + strconv.FormatInt(retention.MinFreeDisk, 10) + " MB"
+			} else {
+				// Recordings are sorted, so all other recordings are newer and
+				// don't need to be removed either.
+				break
+			}
+
+			if err := os.Remove(recordingsDirectory + recording.Name); err != nil && !os.IsNotExist(err) {
+				log.Log.Error("ApplyRetention: could not remove " + recording.Name + ", " + err.Error())
+				continue
+			}
+			if recording.Thumbnail != "" {
+				os.Remove(recording.Thumbnail)
+			}
+			os.Remove(cloudDirectory + recording.Name)
+			catalog.Remove(recording.Name)
+			log.Log.Info("ApplyRetention: removed " + recording.Name + " (" + strconv.FormatInt(recording.Size, 10) + " bytes), " + reason + " exceeded.")
+
+			totalSize -= recording.Size
+			if freeDisk >= 0 {
+				freeDisk += recording.Size
+			}
+			numberOfFiles--
+			deletedFiles++
+			deletedSize += recording.Size
+		}
+
+		if retention.MaxAge > 0 {
+			for _, recording := range expired {
+				if nowInMs-recording.End > maxAge {
+					if recording.Thumbnail != "" {
+						os.Remove(recording.Thumbnail)
+					}
+					catalog.Remove(recording.Name)
+				}
+			}
+		}
+
+		if deletedFiles > 0 {
+			log.Log.Info("ApplyRetention: removed " + strconv.FormatInt(deletedFiles, 10) + " recordings, " + strconv.FormatInt(deletedSize, 10) + " bytes freed.")
+		}
+		if retention.MaxSize > 0 && totalSize > maxSize {
+			log.Log.Warning("ApplyRetention: recordings still exceed the maximum size, " + strconv.Itoa(queued) + " recordings are queued for upload.")
+		}
+		if freeDisk >= 0 && freeDisk < minFreeDisk {
+			log.Log.Warning("ApplyRetention: free disk space is still below the minimum, " + strconv.Itoa(queued) + " recordings are queued for upload.")
+		}
+	}
+
+	statusMutex.Lock()
+	status.NumberOfFiles = numberOfFiles
+	status.TotalSize = totalSize
+	status.DeletedFiles += deletedFiles
+	status.DeletedSize += deletedSize
+	status.LastRun = now.Unix()
+	status.QueuedForCloud = queued
+	statusMutex.Unlock()
+}
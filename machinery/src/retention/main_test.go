@@ -0,0 +1,104 @@
+package retention
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kerberos-io/agent/machinery/src/catalog"
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// setup creates the data directories in a temporary working directory, and opens the catalog.
+func setup(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for _, directory := range []string{recordingsDirectory, cloudDirectory} {
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := catalog.Open(filepath.Join(dir, "catalog.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(catalog.Close)
+}
+
+// addRecording writes a recording of size bytes, which is queued for upload if queued is true.
+func addRecording(t *testing.T, name string, start int64, size int64, queued bool) {
+	t.Helper()
+	if err := ioutil.WriteFile(recordingsDirectory+name, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if queued {
+		if err := ioutil.WriteFile(cloudDirectory+name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := catalog.Add(models.Recording{
+		Name:  name,
+		Start: start,
+		End:   start + 1000,
+		Size:  size,
+		Local: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestApplyRetention(t *testing.T) {
+	const megabyte = 1024 * 1024
+	tests := []struct {
+		name          string
+		cloud         string
+		queued        bool
+		expectRemoved []bool
+		expectQueued  int
+	}{
+		// Without a cloud the markers are never consumed, so they are ignored.
+		{name: "no cloud", cloud: "", queued: true, expectRemoved: []bool{true, false}, expectQueued: 0},
+		{name: "no cloud, no markers", cloud: "", queued: false, expectRemoved: []bool{true, false}, expectQueued: 0},
+		// Recordings which are queued for upload are kept.
+		{name: "cloud, queued", cloud: "s3", queued: true, expectRemoved: []bool{false, false}, expectQueued: 2},
+		{name: "cloud, uploaded", cloud: "s3", queued: false, expectRemoved: []bool{true, false}, expectQueued: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setup(t)
+			names := []string{"1000_6-967003_camera_200-200-400-400_24_769.mp4", "2000_6-967003_camera_200-200-400-400_24_769.mp4"}
+			for i, name := range names {
+				addRecording(t, name, int64(i+1)*1000, megabyte, test.queued)
+			}
+
+			ApplyRetention(&models.Retention{MaxSize: 1}, test.cloud)
+
+			for i, name := range names {
+				if removed := !exists(recordingsDirectory + name); removed != test.expectRemoved[i] {
+					t.Errorf("%s: removed %v, expected %v", name, removed, test.expectRemoved[i])
+				}
+				if _, err := catalog.Get(name); (err == catalog.ErrNotFound) != test.expectRemoved[i] {
+					t.Errorf("%s: catalog entry is not consistent with the file, %v", name, err)
+				}
+			}
+			if status := GetStatus(); status.QueuedForCloud != test.expectQueued {
+				t.Errorf("queued for cloud %d, expected %d", status.QueuedForCloud, test.expectQueued)
+			}
+		})
+	}
+}
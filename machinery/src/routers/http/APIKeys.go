@@ -0,0 +1,69 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/kerberos-io/agent/machinery/src/components"
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// GetAPIKeys returns all API keys, with their role and last use.
+func GetAPIKeys(c *gin.Context) {
+	apiKeys, err := components.GetAPIKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": apiKeys,
+	})
+}
+
+// CreateAPIKey creates an API key with a name and role, the key is only returned once.
+func CreateAPIKey(c *gin.Context) {
+	var request models.APIKey
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	apiKey, err := components.CreateAPIKey(request.Name, request.Role)
+	if err == components.ErrInvalidName || err == components.ErrInvalidRole {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": apiKey,
+	})
+}
+
+// RevokeAPIKey removes an API key.
+func RevokeAPIKey(c *gin.Context) {
+	err := components.RevokeAPIKey(c.Param("id"))
+	if err == components.ErrAPIKeyNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"revoked": true,
+	})
+}
@@ -0,0 +1,62 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+
+	"github.com/kerberos-io/agent/machinery/src/components"
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// Authenticate accepts either an API key ("Authorization: ApiKey <key>") or a JWT token.
+// For an API key, the identity is a user with the role of the key.
+func Authenticate(authMiddleware *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	jwtMiddleware := authMiddleware.MiddlewareFunc()
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if !strings.HasPrefix(header, "ApiKey ") {
+			jwtMiddleware(c)
+			return
+		}
+		apiKey, err := components.AuthenticateAPIKey(strings.TrimSpace(strings.TrimPrefix(header, "ApiKey ")))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"code":    http.StatusUnauthorized,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.Set("id", &models.User{
+			Username: "apikey:" + apiKey.Name,
+			Role:     apiKey.Role,
+		})
+		c.Next()
+	}
+}
+
+// Authorize only allows users which have at least the given role, it should be used
+// after the JWT middleware which sets the identity of the user.
+func Authorize(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, _ := c.Get("id")
+		user, ok := identity.(*models.User)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"code":    http.StatusUnauthorized,
+				"message": "Not logged in.",
+			})
+			return
+		}
+		if models.RoleLevel(user.Role) < models.RoleLevel(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"code":    http.StatusForbidden,
+				"message": "This action requires the " + role + " role.",
+			})
+			return
+		}
+		c.Next()
+	}
+}
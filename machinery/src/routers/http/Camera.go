@@ -0,0 +1,130 @@
+package http
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/kerberos-io/agent/machinery/src/components"
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// getCamera returns the camera of the request, or the first camera when no camera
+// is specified (e.g. when running a single camera).
+func getCamera(c *gin.Context) *components.Camera {
+	camera := components.GetCamera(c.Param("camera"))
+	if camera == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "Camera not found.",
+		})
+	}
+	return camera
+}
+
+// GetCameras returns the cameras which are running in this agent.
+func GetCameras(c *gin.Context) {
+	cameras := []gin.H{}
+	for _, camera := range components.GetCameras() {
+		config := camera.Configuration.Config
+		cameras = append(cameras, gin.H{
+			"id":         camera.ID,
+			"name":       camera.Name,
+			"key":        config.Key,
+			"continuous": config.Capture.Continuous == "true",
+			"onvif":      config.Capture.IPCamera.ONVIF,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": cameras,
+	})
+}
+
+// GetCameraSnapshot returns a recent snapshot of a camera, encoded as base64.
+func GetCameraSnapshot(c *gin.Context) {
+	camera := getCamera(c)
+	if camera == nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"snapshot": components.GetSnapshot(camera.Configuration.Camera),
+	})
+}
+
+// RestartCamera restarts the pipeline of a single camera.
+func RestartCamera(c *gin.Context) {
+	camera := getCamera(c)
+	if camera == nil {
+		return
+	}
+	select {
+	case camera.Communication.HandleBootstrap <- "restart":
+	default:
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"restarted": true,
+	})
+}
+
+// TriggerRecording starts a manual recording, as if motion was detected.
+func TriggerRecording(c *gin.Context) {
+	camera := getCamera(c)
+	if camera == nil {
+		return
+	}
+	if camera.Configuration.Config.Capture.Continuous == "true" {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "The camera is recording continuously.",
+		})
+		return
+	}
+	now := time.Now()
+	motion := models.MotionDataPartial{
+		Timestamp:    now.Unix(),
+		Microseconds: int64(now.Nanosecond() / 1000),
+		Trigger:      models.TriggerManual,
+	}
+	if !camera.Communication.SendMotion(motion) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"message": "The recorder is not ready, try again later.",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"triggered": true,
+	})
+}
+
+// ControlPTZ moves the camera (left, right, up, down or center) through ONVIF.
+func ControlPTZ(c *gin.Context) {
+	camera := getCamera(c)
+	if camera == nil {
+		return
+	}
+	if !camera.Configuration.Config.Capture.IPCamera.ONVIF {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "ONVIF is not enabled for this camera.",
+		})
+		return
+	}
+	var ptz models.OnvifActionPTZ
+	if err := c.ShouldBindJSON(&ptz); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	action := models.OnvifAction{
+		Action:  "ptz",
+		Payload: ptz,
+	}
+	if !camera.Communication.SendONVIFAction(action) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"message": "The camera is busy, try again later.",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"moved": true,
+	})
+}
@@ -7,17 +7,18 @@ import (
 	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
 	jwtgo "github.com/golang-jwt/jwt/v4"
+	"github.com/kerberos-io/agent/machinery/src/components"
 	"github.com/kerberos-io/agent/machinery/src/models"
 )
 
 func JWTMiddleWare() jwt.GinJWTMiddleware {
 
 	identityKey := "id"
-	myKey := "TOBECHANGED"
+	myKey := components.GetJWTKey()
 
 	m := jwt.GinJWTMiddleware{
 		Realm:       "kerberosio",
-		Key:         []byte(myKey),
+		Key:         myKey,
 		Timeout:     time.Hour * 24,
 		MaxRefresh:  time.Hour * 24 * 7,
 		IdentityKey: identityKey,
@@ -42,24 +43,16 @@ func JWTMiddleWare() jwt.GinJWTMiddleware {
 			if err := c.ShouldBind(&loginVals); err != nil {
 				return "", jwt.ErrMissingLoginValues
 			}
-			username := loginVals.Username
-			password := loginVals.Password
-
-			usernameENV := "root"
-			passwordENV := "root"
-			if username == usernameENV && password == passwordENV {
-				return &models.User{
-					Username: username,
-					Role:     "admin",
-				}, nil
-			} else {
+			user, err := components.Authenticate(loginVals.Username, loginVals.Password)
+			if err != nil {
 				return nil, jwt.ErrFailedAuthentication
 			}
+			return &user, nil
 		},
 		LoginResponse: func(c *gin.Context, code int, token string, expire time.Time) {
 
 			// Decrypt the token
-			hmacSecret := []byte(myKey) // todo in config file
+			hmacSecret := myKey
 			t, _ := jwtgo.Parse(token, func(token *jwtgo.Token) (interface{}, error) {
 				return hmacSecret, nil
 			})
@@ -77,7 +70,14 @@ func JWTMiddleWare() jwt.GinJWTMiddleware {
 			})
 		},
 		Authorizator: func(data interface{}, c *gin.Context) bool {
-			if _, ok := data.(*models.User); ok { //&& v.Username == "admin" {
+			// The user should still exist, and we use its current role so
+			// changes are applied immediately and not when the token expires.
+			if v, ok := data.(*models.User); ok {
+				user, err := components.GetUser(v.Username)
+				if err != nil || models.RoleLevel(user.Role) == 0 {
+					return false
+				}
+				v.Role = user.Role
 				return true
 			}
 			return false
@@ -0,0 +1,186 @@
+package http
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/kerberos-io/agent/machinery/src/catalog"
+	"github.com/kerberos-io/agent/machinery/src/components"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+const recordingsDirectory = "./data/recordings/"
+const cloudDirectory = "./data/cloud/"
+
+// validRecordingName makes sure the name doesn't point outside the recordings directory.
+func validRecordingName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+// GetRecordings returns the recordings of the catalog, filtered by the query parameters
+// from and to (unix timestamps in milliseconds), trigger, offset and limit. By default
+// the newest recordings are returned first.
+func GetRecordings(c *gin.Context) {
+	var query models.RecordingQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid query: " + err.Error(),
+		})
+		return
+	}
+	if c.Query("newest") == "" {
+		query.Newest = true
+	}
+	// Recordings of a single camera agent are not linked to a camera.
+	if query.Camera == components.DefaultCamera {
+		query.Camera = ""
+	}
+
+	recordings, total, err := catalog.List(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":   recordings,
+		"total":  total,
+		"offset": query.Offset,
+		"limit":  query.Limit,
+	})
+}
+
+// GetRecording returns the catalog entry of a single recording.
+func GetRecording(c *gin.Context) {
+	name := c.Param("name")
+	if !validRecordingName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid recording name.",
+		})
+		return
+	}
+	recording, err := catalog.Get(name)
+	if err == catalog.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "Recording not found.",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": recording,
+	})
+}
+
+// serveRecording writes the recording to the response, http.ServeContent takes care
+// of Range requests so the recording can be seeked in the browser.
+func serveRecording(c *gin.Context, attachment bool) {
+	name := c.Param("name")
+	if !validRecordingName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid recording name.",
+		})
+		return
+	}
+	file, err := os.Open(recordingsDirectory + name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "Recording not found.",
+		})
+		return
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil || fileInfo.IsDir() {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "Recording not found.",
+		})
+		return
+	}
+
+	c.Header("Content-Type", "video/mp4")
+	if attachment {
+		c.Header("Content-Disposition", "attachment; filename=\""+name+"\"")
+	}
+	http.ServeContent(c.Writer, c.Request, name, fileInfo.ModTime(), file)
+}
+
+// StreamRecording streams a recording, Range requests are supported.
+func StreamRecording(c *gin.Context) {
+	serveRecording(c, false)
+}
+
+// DownloadRecording returns a recording as an attachment.
+func DownloadRecording(c *gin.Context) {
+	serveRecording(c, true)
+}
+
+// GetRecordingThumbnail returns the thumbnail of a recording, if one was created.
+func GetRecordingThumbnail(c *gin.Context) {
+	name := c.Param("name")
+	if !validRecordingName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid recording name.",
+		})
+		return
+	}
+	recording, err := catalog.Get(name)
+	if err != nil || recording.Thumbnail == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "Thumbnail not found.",
+		})
+		return
+	}
+	c.File(recording.Thumbnail)
+}
+
+// DeleteRecording removes a recording from disk, together with its thumbnail,
+// the upload marker in ./data/cloud and its catalog entry.
+func DeleteRecording(c *gin.Context) {
+	name := c.Param("name")
+	if !validRecordingName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid recording name.",
+		})
+		return
+	}
+
+	recording, catalogErr := catalog.Get(name)
+	err := os.Remove(recordingsDirectory + name)
+	if err != nil && !os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	if os.IsNotExist(err) && catalogErr != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "Recording not found.",
+		})
+		return
+	}
+
+	// Make sure the recording is no longer uploaded.
+	os.Remove(cloudDirectory + name)
+	if catalogErr == nil {
+		if recording.Thumbnail != "" {
+			os.Remove(recording.Thumbnail)
+		}
+		catalog.Remove(name)
+	}
+
+	log.Log.Info("DeleteRecording: removed " + name)
+	c.JSON(http.StatusOK, gin.H{
+		"deleted": true,
+	})
+}
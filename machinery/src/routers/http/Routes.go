@@ -16,24 +16,33 @@ import (
 
 func AddRoutes(r *gin.Engine, authMiddleware *jwt.GinJWTMiddleware, configuration *models.Configuration, communication *models.Communication) *gin.RouterGroup {
 
-	r.GET("/config", func(c *gin.Context) {
+	// Secrets are never returned, they are replaced by a placeholder. When the configuration
+	// is saved with the placeholder, the current secret is kept.
+	getConfig := func(c *gin.Context) {
+		snapshot := ""
+		if camera := components.GetCamera(""); camera != nil {
+			snapshot = components.GetSnapshot(camera.Configuration.Camera)
+		}
 		c.JSON(200, gin.H{
-			"config":   configuration.Config,
-			"custom":   configuration.CustomConfig,
-			"global":   configuration.GlobalConfig,
-			"snapshot": components.GetSnapshot(),
+			"config":   components.RedactConfig(configuration.Config),
+			"custom":   components.RedactConfig(configuration.CustomConfig),
+			"global":   components.RedactConfig(configuration.GlobalConfig),
+			"snapshot": snapshot,
 		})
-	})
+	}
 
-	r.POST("/config", func(c *gin.Context) {
+	saveConfig := func(c *gin.Context) {
 		if !communication.IsConfiguring.IsSet() {
 			communication.IsConfiguring.Set()
+			defer communication.IsConfiguring.UnSet()
 
 			// Save into file
 			var conf models.Config
 			c.BindJSON(&conf)
 
 			if os.Getenv("DEPLOYMENT") == "factory" || os.Getenv("MACHINERY_ENVIRONMENT") == "kubernetes" {
+				components.RestoreSecrets(&conf, configuration.CustomConfig)
+
 				// Write to mongodb
 				session := database.New().Copy()
 				defer session.Close()
@@ -45,6 +54,8 @@ func AddRoutes(r *gin.Engine, authMiddleware *jwt.GinJWTMiddleware, configuratio
 					"name": os.Getenv("DEPLOYMENT_NAME"),
 				}, &conf)
 			} else if os.Getenv("DEPLOYMENT") == "" || os.Getenv("DEPLOYMENT") == "agent" {
+				components.RestoreSecrets(&conf, configuration.Config)
+
 				res, _ := json.MarshalIndent(conf, "", "\t")
 				ioutil.WriteFile("./data/config/config.json", res, 0644)
 			}
@@ -54,8 +65,6 @@ func AddRoutes(r *gin.Engine, authMiddleware *jwt.GinJWTMiddleware, configuratio
 			default:
 			}
 
-			communication.IsConfiguring.UnSet()
-
 			c.JSON(200, gin.H{
 				"data": "☄ Reconfiguring",
 			})
@@ -64,39 +73,69 @@ func AddRoutes(r *gin.Engine, authMiddleware *jwt.GinJWTMiddleware, configuratio
 				"data": "☄ Already reconfiguring",
 			})
 		}
-	})
+	}
+
+	// Kept for backwards compatibility, but secured as well.
+	r.GET("/config", Authenticate(authMiddleware), Authorize(models.RoleAdmin), getConfig)
+	r.POST("/config", Authenticate(authMiddleware), Authorize(models.RoleAdmin), saveConfig)
 
 	api := r.Group("/api")
 	{
 		api.POST("/login", authMiddleware.LoginHandler)
+		api.GET("/installed", GetInstalled)
+		api.POST("/install", Install)
 
-		api.GET("/config", func(c *gin.Context) {
-			c.JSON(200, gin.H{
-				"config":   configuration.Config,
-				"custom":   configuration.CustomConfig,
-				"global":   configuration.GlobalConfig,
-				"snapshot": components.GetSnapshot(),
-			})
-		})
+		api.Use(Authenticate(authMiddleware))
+		{
+			// Secured endpoints..
 
-		api.GET("/restart", func(c *gin.Context) {
-			communication.HandleBootstrap <- "restart"
-			c.JSON(200, gin.H{
-				"restarted": true,
+			// Viewers can watch recordings and change their own password.
+			viewer := api.Group("", Authorize(models.RoleViewer))
+			viewer.POST("/user/password", ChangePassword)
+			viewer.GET("/recordings", GetRecordings)
+			viewer.GET("/recordings/:name", GetRecording)
+			viewer.GET("/recordings/:name/stream", StreamRecording)
+			viewer.GET("/recordings/:name/download", DownloadRecording)
+			viewer.GET("/recordings/:name/thumbnail", GetRecordingThumbnail)
+			viewer.GET("/cameras", GetCameras)
+			viewer.GET("/cameras/:camera/snapshot", GetCameraSnapshot)
+
+			// Operators can also control the camera and trigger recordings.
+			operator := api.Group("", Authorize(models.RoleOperator))
+			operator.POST("/record", TriggerRecording)
+			operator.POST("/onvif/ptz", ControlPTZ)
+			operator.POST("/cameras/:camera/record", TriggerRecording)
+			operator.POST("/cameras/:camera/onvif/ptz", ControlPTZ)
+
+			// Admins can change the configuration, manage users and recordings.
+			admin := api.Group("", Authorize(models.RoleAdmin))
+			admin.GET("/config", getConfig)
+			admin.POST("/config", saveConfig)
+
+			admin.GET("/restart", func(c *gin.Context) {
+				communication.HandleBootstrap <- "restart"
+				c.JSON(200, gin.H{
+					"restarted": true,
+				})
 			})
-		})
 
-		api.GET("/stop", func(c *gin.Context) {
-			communication.HandleBootstrap <- "stop"
-			c.JSON(200, gin.H{
-				"stopped": true,
+			admin.GET("/stop", func(c *gin.Context) {
+				communication.HandleBootstrap <- "stop"
+				c.JSON(200, gin.H{
+					"stopped": true,
+				})
 			})
-		})
 
-		api.Use(authMiddleware.MiddlewareFunc())
-		{
-			// Secured endpoints..
+			admin.GET("/cameras/:camera/restart", RestartCamera)
+			admin.DELETE("/recordings/:name", DeleteRecording)
+
+			admin.GET("/users", GetUsers)
+			admin.POST("/users", AddUser)
+			admin.DELETE("/users/:username", DeleteUser)
 
+			admin.GET("/apikeys", GetAPIKeys)
+			admin.POST("/apikeys", CreateAPIKey)
+			admin.DELETE("/apikeys/:id", RevokeAPIKey)
 		}
 	}
 	return api
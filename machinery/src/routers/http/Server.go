@@ -10,6 +10,7 @@ import (
 	"log"
 
 	_ "github.com/kerberos-io/agent/machinery/docs"
+	"github.com/kerberos-io/agent/machinery/src/components"
 	"github.com/kerberos-io/agent/machinery/src/models"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
@@ -54,6 +55,9 @@ func StartServer(configuration *models.Configuration, communication *models.Comm
 		log.Fatal("JWT Error:" + err.Error())
 	}
 
+	// A token is needed to install the agent, which is printed in the logs.
+	components.CreateSetupToken()
+
 	// Add all routes
 	AddRoutes(r, authMiddleware, configuration, communication)
 
@@ -0,0 +1,155 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/kerberos-io/agent/machinery/src/components"
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// GetInstalled returns true when the first admin user has been created.
+func GetInstalled(c *gin.Context) {
+	c.JSON(http.StatusOK, components.IsInstalled())
+}
+
+// Install creates the first admin user, after that this endpoint is disabled. The setup
+// token from the logs is required, so only who can access the agent itself can install it.
+func Install(c *gin.Context) {
+	var install models.Install
+	if err := c.ShouldBindJSON(&install); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	err := components.Install(install.Username, install.Password, install.Language, install.Token)
+	if err == components.ErrAlreadyInstalled || err == components.ErrInvalidSetupToken {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": err.Error(),
+		})
+		return
+	} else if err == components.ErrPasswordTooShort || err == components.ErrInvalidUsername {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"installed": true,
+	})
+}
+
+// ChangePassword changes the password of the logged in user.
+func ChangePassword(c *gin.Context) {
+	var passwords models.UserPassword
+	if err := c.ShouldBindJSON(&passwords); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	identity, _ := c.Get("id")
+	user, ok := identity.(*models.User)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "Not logged in.",
+		})
+		return
+	}
+	err := components.ChangePassword(user.Username, passwords.Password, passwords.NewPassword)
+	if err == components.ErrInvalidCredentials {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": err.Error(),
+		})
+		return
+	} else if err == components.ErrPasswordTooShort {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"changed": true,
+	})
+}
+
+// GetUsers returns all users with their role.
+func GetUsers(c *gin.Context) {
+	users, err := components.GetUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": users,
+	})
+}
+
+// AddUser creates a user with a username, password and role (admin, operator or viewer).
+func AddUser(c *gin.Context) {
+	var user models.User
+	if err := c.ShouldBindJSON(&user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	err := components.AddUser(user)
+	if err == components.ErrUserExists {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": err.Error(),
+		})
+		return
+	} else if err == components.ErrInvalidUsername || err == components.ErrInvalidRole || err == components.ErrPasswordTooShort {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"created": true,
+	})
+}
+
+// DeleteUser removes a user, the last admin cannot be removed.
+func DeleteUser(c *gin.Context) {
+	err := components.DeleteUser(c.Param("username"))
+	if err == components.ErrUserNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": err.Error(),
+		})
+		return
+	} else if err == components.ErrLastAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"deleted": true,
+	})
+}
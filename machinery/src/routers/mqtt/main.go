@@ -71,7 +71,6 @@ func ConfigureMQTT(configuration *models.Configuration, communication *models.Co
 		opts.SetClientID(mqttClientID)
 		log.Log.Info("ConfigureMQTT: Set ClientID " + mqttClientID)
 		rand.Seed(time.Now().UnixNano())
-		webrtc.CandidateArrays = make(map[string](chan string))
 
 		opts.OnConnect = func(c mqtt.Client) {
 
@@ -181,8 +180,11 @@ func MQTTListenerHandleONVIF(mqttClient mqtt.Client, hubKey string, configuratio
 	mqttClient.Subscribe(topicOnvif, 0, func(c mqtt.Client, msg mqtt.Message) {
 		var onvifAction models.OnvifAction
 		json.Unmarshal(msg.Payload(), &onvifAction)
-		communication.HandleONVIF <- onvifAction
-		log.Log.Info("MQTTListenerHandleONVIF: Received an action - " + onvifAction.Action)
+		if communication.SendONVIFAction(onvifAction) {
+			log.Log.Info("MQTTListenerHandleONVIF: Received an action - " + onvifAction.Action)
+		} else {
+			log.Log.Info("MQTTListenerHandleONVIF: busy, action ignored - " + onvifAction.Action)
+		}
 	})
 }
 
@@ -1,13 +1,9 @@
 package utils
 
 import (
-	"bytes"
-	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
-	"os/exec"
-	"strconv"
 
 	"github.com/kerberos-io/agent/machinery/src/log"
 )
@@ -39,24 +35,11 @@ func RandStringBytesRmndr(n int) string {
 	return string(b)
 }
 
-func CreateFragmentedMP4(fullName string, fragmentedDuration int64) {
-	path, _ := os.Getwd()
-	duration := fragmentedDuration * 1000
-	cmd := exec.Command("mp4fragment", "--fragment-duration", strconv.FormatInt(duration, 10), fullName, fullName+"f.mp4")
-	cmd.Dir = path
-	log.Log.Info(cmd.String())
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		log.Log.Error(fmt.Sprint(err) + ": " + stderr.String())
-	} else {
-		log.Log.Info("Created Fragmented: " + out.String())
+// SnapshotsDirectory returns the directory in which the snapshots of a camera
+// are stored, every camera has its own directory when multiple cameras are running.
+func SnapshotsDirectory(camera string) string {
+	if camera == "" {
+		return "./data/snapshots/"
 	}
-
-	// We will swap the files.
-	os.Remove(fullName)
-	os.Rename(fullName+"f.mp4", fullName)
+	return "./data/snapshots/" + camera + "/"
 }
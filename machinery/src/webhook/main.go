@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+)
+
+// Time we wait for the webhook to respond.
+const timeout = 5 * time.Second
+
+// Send posts an event as JSON to the webhook, when no webhook is configured nothing is sent.
+func Send(uri string, event interface{}) error {
+	if uri == "" {
+		return nil
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Log.Error("Send: could not send the event to the webhook, " + err.Error())
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err = errors.New("Send: the webhook responded with " + strconv.Itoa(resp.StatusCode))
+		log.Log.Error(err.Error())
+		return err
+	}
+	log.Log.Info("Send: event sent to the webhook.")
+	return nil
+}
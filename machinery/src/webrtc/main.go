@@ -12,6 +12,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/kerberos-io/agent/machinery/src/capture"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
 	"github.com/kerberos-io/joy4/av/pubsub"
@@ -20,18 +21,43 @@ import (
 	av "github.com/kerberos-io/joy4/av"
 	"github.com/kerberos-io/joy4/cgo/ffmpeg"
 	h264parser "github.com/kerberos-io/joy4/codec/h264parser"
+	h265parser "github.com/kerberos-io/joy4/codec/h265parser"
 	pionWebRTC "github.com/pion/webrtc/v3"
 	pionMedia "github.com/pion/webrtc/v3/pkg/media"
 )
 
 var (
-	CandidatesMutex     sync.Mutex
-	CandidateArrays     map[string](chan string)
+	CandidatesMutex sync.Mutex
+	CandidateArrays = make(map[string](chan string))
+)
+
+// Connections are the peer connections of a camera, and the encoder which is used
+// to transcode the stream of the camera. Every camera (key) has its own connections.
+type Connections struct {
 	peerConnectionCount int64
 	peerConnections     map[string]*pionWebRTC.PeerConnection
 	encoder             *ffmpeg.VideoEncoder
+}
+
+var (
+	connectionsMutex sync.Mutex
+	connections      = make(map[string]*Connections)
 )
 
+// GetConnections returns the connections of a camera.
+func GetConnections(key string) *Connections {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	c, ok := connections[key]
+	if !ok {
+		c = &Connections{
+			peerConnections: make(map[string]*pionWebRTC.PeerConnection),
+		}
+		connections[key] = c
+	}
+	return c
+}
+
 type WebRTC struct {
 	Name                  string
 	StunServers           []string
@@ -42,21 +68,20 @@ type WebRTC struct {
 	PacketsCount          chan int
 }
 
-func init() {
-	// Encoder is created for once and for all.
-	var err error
-	encoder, err = ffmpeg.NewVideoEncoderByCodecType(av.H264)
+// NewEncoder creates the encoder which is used to transcode the stream.
+func NewEncoder() (*ffmpeg.VideoEncoder, error) {
+	encoder, err := ffmpeg.NewVideoEncoderByCodecType(av.H264)
 	if err != nil {
-		return
+		return nil, err
 	}
 	if encoder == nil {
-		err = fmt.Errorf("Video encoder not found")
-		return
+		return nil, fmt.Errorf("Video encoder not found")
 	}
 	encoder.SetFramerate(30, 1)
 	encoder.SetPixelFormat(av.I420)
 	encoder.SetBitrate(1000000) // 1MB
 	encoder.SetGopSize(30 / 1)  // 1s
+	return encoder, nil
 }
 
 func CreateWebRTC(name string, stunServers []string, turnServers []string, turnServersUsername string, turnServersCredential string) *WebRTC {
@@ -88,9 +113,10 @@ func (w WebRTC) CreateOffer(sd []byte) pionWebRTC.SessionDescription {
 	return offer
 }
 
-func InitializeWebRTCConnection(configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, track *pionWebRTC.TrackLocalStaticSample, handshake models.SDPPayload, candidates chan string) {
+func InitializeWebRTCConnection(configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, track *pionWebRTC.TrackLocalStaticSample, audioTrack *pionWebRTC.TrackLocalStaticSample, handshake models.SDPPayload, candidates chan string) {
 
 	config := configuration.Config
+	c := GetConnections(config.Key)
 
 	name := config.Key
 	stunServers := []string{config.STUNURI}
@@ -141,10 +167,17 @@ func InitializeWebRTCConnection(configuration *models.Configuration, communicati
 			panic(err)
 		}
 
+		// The camera might not have a microphone.
+		if audioTrack != nil {
+			if _, err = peerConnection.AddTrack(audioTrack); err != nil {
+				log.Log.Error("InitializeWebRTCConnection: could not add audio track, " + err.Error())
+			}
+		}
+
 		peerConnection.OnICEConnectionStateChange(func(connectionState pionWebRTC.ICEConnectionState) {
 			if connectionState == pionWebRTC.ICEConnectionStateDisconnected {
-				atomic.AddInt64(&peerConnectionCount, -1)
-				peerConnections[handshake.Cuuid] = nil
+				atomic.AddInt64(&c.peerConnectionCount, -1)
+				c.peerConnections[handshake.Cuuid] = nil
 				close(candidates)
 				close(w.PacketsCount)
 				if err := peerConnection.Close(); err != nil {
@@ -153,7 +186,7 @@ func InitializeWebRTCConnection(configuration *models.Configuration, communicati
 				runtime.GC()
 				debug.FreeOSMemory()
 			} else if connectionState == pionWebRTC.ICEConnectionStateConnected {
-				atomic.AddInt64(&peerConnectionCount, 1)
+				atomic.AddInt64(&c.peerConnectionCount, 1)
 			} else if connectionState == pionWebRTC.ICEConnectionStateChecking {
 				for candidate := range candidates {
 					log.Log.Info("InitializeWebRTCConnection: Received candidate.")
@@ -162,7 +195,7 @@ func InitializeWebRTCConnection(configuration *models.Configuration, communicati
 				}
 			}
 			log.Log.Info("InitializeWebRTCConnection: connection state changed to: " + connectionState.String())
-			log.Log.Info("InitializeWebRTCConnection: Number of peers connected (" + strconv.FormatInt(peerConnectionCount, 10) + ")")
+			log.Log.Info("InitializeWebRTCConnection: Number of peers connected (" + strconv.FormatInt(atomic.LoadInt64(&c.peerConnectionCount), 10) + ")")
 		})
 
 		offer := w.CreateOffer(sd)
@@ -203,7 +236,7 @@ func InitializeWebRTCConnection(configuration *models.Configuration, communicati
 			}
 		})
 
-		peerConnections[handshake.Cuuid] = peerConnection
+		c.peerConnections[handshake.Cuuid] = peerConnection
 
 		if err == nil {
 			topic := fmt.Sprintf("%s/%s/answer", name, handshake.Cuuid)
@@ -218,12 +251,42 @@ func NewVideoTrack() *pionWebRTC.TrackLocalStaticSample {
 	return outboundVideoTrack
 }
 
-func WriteToTrack(livestreamCursor *pubsub.QueueCursor, configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, track *pionWebRTC.TrackLocalStaticSample, codecs []av.CodecData, decoder *ffmpeg.VideoDecoder, decoderMutex *sync.Mutex) {
+// NewAudioTrack creates an audio track for the audio stream of the camera, G.711 is
+// supported by WebRTC. Other codecs (AAC) are transcoded to Opus. If the camera has
+// no audio, nil is returned.
+func NewAudioTrack(codecs []av.CodecData) *pionWebRTC.TrackLocalStaticSample {
+	var capability pionWebRTC.RTPCodecCapability
+	for _, codec := range codecs {
+		switch codec.Type() {
+		case av.PCM_MULAW:
+			capability = pionWebRTC.RTPCodecCapability{MimeType: pionWebRTC.MimeTypePCMU, ClockRate: 8000}
+		case av.PCM_ALAW:
+			capability = pionWebRTC.RTPCodecCapability{MimeType: pionWebRTC.MimeTypePCMA, ClockRate: 8000}
+		case av.AAC:
+			capability = pionWebRTC.RTPCodecCapability{MimeType: pionWebRTC.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+		default:
+			continue
+		}
+		break
+	}
+	if capability.MimeType == "" {
+		return nil
+	}
+	outboundAudioTrack, err := pionWebRTC.NewTrackLocalStaticSample(capability, "audio", "pion124")
+	if err != nil {
+		log.Log.Error("NewAudioTrack: " + err.Error())
+		return nil
+	}
+	return outboundAudioTrack
+}
+
+func WriteToTrack(livestreamCursor *pubsub.QueueCursor, configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, track *pionWebRTC.TrackLocalStaticSample, audioTrack *pionWebRTC.TrackLocalStaticSample, codecs []av.CodecData, decoder *capture.VideoDecoder, decoderMutex *sync.Mutex) {
 
 	config := configuration.Config
+	c := GetConnections(config.Key)
 
 	// Make peerconnection map
-	peerConnections = make(map[string]*pionWebRTC.PeerConnection)
+	c.peerConnections = make(map[string]*pionWebRTC.PeerConnection)
 
 	// Set the indexes for the video & audio streams
 	// Later when we read a packet we need to figure out which track to send it to.
@@ -233,9 +296,9 @@ func WriteToTrack(livestreamCursor *pubsub.QueueCursor, configuration *models.Co
 	for i, codec := range codecs {
 		log.Log.Info("WriteToTrack: codec - " + codec.Type().String() + " found.")
 		log.Log.Info(codec.Type().String())
-		if codec.Type().String() == "H264" && videoIdx < 0 {
+		if (codec.Type().String() == "H264" || codec.Type().String() == "H265") && videoIdx < 0 {
 			videoIdx = i
-		} else if codec.Type().String() == "PCM_MULAW" && audioIdx < 0 {
+		} else if (codec.Type() == av.PCM_MULAW || codec.Type() == av.PCM_ALAW || codec.Type() == av.AAC) && audioIdx < 0 {
 			audioIdx = i
 		}
 	}
@@ -245,8 +308,85 @@ func WriteToTrack(livestreamCursor *pubsub.QueueCursor, configuration *models.Co
 	} else {
 		annexbNALUStartCode := func() []byte { return []byte{0x00, 0x00, 0x00, 0x01} }
 
-		if config.Capture.TranscodingWebRTC == "true" {
-			if videoIdx > -1 {
+		// Send a sample to the peers, or forward it to the remote broker.
+		sendSample := func(sample pionMedia.Sample) {
+			if config.Capture.ForwardWebRTC == "true" {
+				samplePacket, err := json.Marshal(sample)
+				if err == nil {
+					// Write packets
+					topic := fmt.Sprintf("kerberos/webrtc/packets/%s", config.Key)
+					mqttClient.Publish(topic, 0, false, samplePacket)
+				} else {
+					log.Log.Info("WriteToTrack: Error marshalling frame, " + err.Error())
+				}
+			} else {
+				if err := track.WriteSample(sample); err != nil && err != io.ErrClosedPipe {
+					fmt.Println("WriteToTrack: something went wrong while writing sample: " + err.Error())
+				}
+			}
+		}
+
+		sendKeepAlive := func() {
+			if config.Capture.ForwardWebRTC == "true" {
+				log.Log.Info("WriteToTrack: Sending keep a live to remote broker.")
+				topic := fmt.Sprintf("kerberos/webrtc/keepalive/%s", config.Key)
+				mqttClient.Publish(topic, 2, false, "1")
+			}
+		}
+
+		// Most browsers can't play H265, so it's transcoded to H264. The transcoded
+		// frames are read from the transcoder and sent to the peers.
+		var transcoder *capture.Transcoder
+		if capture.IsH265(codecs[videoIdx]) {
+			var err error
+			transcoder, err = capture.NewTranscoder(codecs[videoIdx].(h265parser.CodecData), int(config.Capture.TranscodingResolution))
+			if err != nil {
+				log.Log.Error("WriteToTrack: could not create a H265 transcoder, " + err.Error())
+			} else {
+				log.Log.Info("WriteToTrack: transcoding H265 to H264.")
+				defer transcoder.Close()
+				go func() {
+					previous := time.Now()
+					for {
+						nalus, err := transcoder.ReadAccessUnit()
+						if err != nil {
+							break
+						}
+						var data []byte
+						for _, nalu := range nalus {
+							data = append(data, annexbNALUStartCode()...)
+							data = append(data, nalu...)
+						}
+						now := time.Now()
+						sendSample(pionMedia.Sample{Data: data, Duration: now.Sub(previous)})
+						previous = now
+					}
+				}()
+			}
+		}
+
+		// G.711 is sent as it is, AAC is transcoded to Opus.
+		var audioTranscoder *capture.AudioTranscoder
+		if audioTrack != nil && audioIdx > -1 && codecs[audioIdx].Type() == av.AAC {
+			var err error
+			audioTranscoder, err = capture.NewAudioTranscoder(codecs[audioIdx].(av.AudioCodecData))
+			if err != nil {
+				log.Log.Error("WriteToTrack: could not create an audio transcoder, " + err.Error())
+				audioTrack = nil
+			} else {
+				defer audioTranscoder.Close()
+			}
+		}
+
+		if config.Capture.TranscodingWebRTC == "true" && transcoder == nil {
+			if c.encoder == nil {
+				encoder, err := NewEncoder()
+				if err != nil {
+					log.Log.Error("WriteToTrack: could not create a transcoder, " + err.Error())
+				}
+				c.encoder = encoder
+			}
+			if videoIdx > -1 && c.encoder != nil {
 				log.Log.Info("WriteToTrack: successfully using a transcoder.")
 			} else {
 			}
@@ -267,10 +407,13 @@ func WriteToTrack(livestreamCursor *pubsub.QueueCursor, configuration *models.Co
 		for cursorError == nil {
 
 			pkt, cursorError = livestreamCursor.ReadPacket()
-			bufferDuration := pkt.Time - previousTime
-			previousTime = pkt.Time
+			var bufferDuration time.Duration
+			if int(pkt.Idx) == videoIdx {
+				bufferDuration = pkt.Time - previousTime
+				previousTime = pkt.Time
+			}
 
-			if config.Capture.ForwardWebRTC != "true" && peerConnectionCount == 0 {
+			if config.Capture.ForwardWebRTC != "true" && atomic.LoadInt64(&c.peerConnectionCount) == 0 {
 				start = false
 				receivedKeyFrame = false
 				continue
@@ -310,22 +453,37 @@ func WriteToTrack(livestreamCursor *pubsub.QueueCursor, configuration *models.Co
 				}
 			}
 
-			if config.Capture.TranscodingWebRTC == "true" {
+			if int(pkt.Idx) == videoIdx && capture.IsH265(codecData) {
+				if transcoder != nil {
+					if pkt.IsKeyFrame {
+						start = true
+						sendKeepAlive()
+					}
+					if start {
+						if err := transcoder.WritePacket(pkt); err != nil {
+							log.Log.Error("WriteToTrack: could not transcode packet, " + err.Error())
+						}
+					}
+				}
+				continue
+			}
+
+			if config.Capture.TranscodingWebRTC == "true" && c.encoder != nil && int(pkt.Idx) == videoIdx {
 				decoderMutex.Lock()
 				decoder.SetFramerate(30, 1)
-				frame, err := decoder.Decode(pkt.Data)
+				frame, err := decoder.Decode(pkt)
 				decoderMutex.Unlock()
-				if err == nil && frame != nil && frame.Width() > 0 && frame.Height() > 0 {
+				if err == nil && frame != nil && frame.Width() > 0 && frame.Height() > 0 && frame.VideoFrame() != nil {
 					var _outpkts []av.Packet
 					transcodingResolution := config.Capture.TranscodingResolution
 					newWidth := frame.Width() * int(transcodingResolution) / 100
 					newHeight := frame.Height() * int(transcodingResolution) / 100
-					encoder.SetResolution(newWidth, newHeight)
-					if _outpkts, err = encoder.Encode(frame); err != nil {
+					c.encoder.SetResolution(newWidth, newHeight)
+					if _outpkts, err = c.encoder.Encode(frame.VideoFrame()); err != nil {
 					}
 					if len(_outpkts) > 0 {
 						pkt = _outpkts[0]
-						codecData, _ = encoder.CodecData()
+						codecData, _ = c.encoder.CodecData()
 					}
 				}
 				if frame != nil {
@@ -345,42 +503,42 @@ func WriteToTrack(livestreamCursor *pubsub.QueueCursor, configuration *models.Co
 					pkt.Data = append(codecData.(h264parser.CodecData).SPS(), pkt.Data...)
 					pkt.Data = append(annexbNALUStartCode(), pkt.Data...)
 					log.Log.Info("WriteToTrack: Sending keyframe")
-
-					if config.Capture.ForwardWebRTC == "true" {
-						log.Log.Info("WriteToTrack: Sending keep a live to remote broker.")
-						topic := fmt.Sprintf("kerberos/webrtc/keepalive/%s", config.Key)
-						mqttClient.Publish(topic, 2, false, "1")
-					}
+					sendKeepAlive()
 				}
 
 				if start {
-
-					sample := pionMedia.Sample{Data: pkt.Data, Duration: bufferDuration}
-					if config.Capture.ForwardWebRTC == "true" {
-						samplePacket, err := json.Marshal(sample)
-						if err == nil {
-							// Write packets
-							topic := fmt.Sprintf("kerberos/webrtc/packets/%s", config.Key)
-							mqttClient.Publish(topic, 0, false, samplePacket)
-						} else {
-							log.Log.Info("WriteToTrack: Error marshalling frame, " + err.Error())
-						}
-					} else {
-						if err := track.WriteSample(sample); err != nil && err != io.ErrClosedPipe {
-							fmt.Println("WriteToTrack: something went wrong while writing sample: " + err.Error())
+					sendSample(pionMedia.Sample{Data: pkt.Data, Duration: bufferDuration})
+				}
+			case audioIdx:
+				// Audio is only sent to the peers directly, not forwarded.
+				if !start || audioTrack == nil || config.Capture.ForwardWebRTC == "true" {
+					continue
+				}
+				if audioTranscoder != nil {
+					packets, duration, err := audioTranscoder.Transcode(pkt.Data)
+					if err != nil {
+						log.Log.Error("WriteToTrack: could not transcode audio, " + err.Error())
+					}
+					for _, packet := range packets {
+						if err := audioTrack.WriteSample(pionMedia.Sample{Data: packet, Duration: duration}); err != nil && err != io.ErrClosedPipe {
+							log.Log.Error("WriteToTrack: something went wrong while writing audio sample: " + err.Error())
 						}
 					}
+				} else {
+					// G.711 has a sample rate of 8000Hz, and a sample is a single byte.
+					sample := pionMedia.Sample{Data: pkt.Data, Duration: time.Duration(len(pkt.Data)) * time.Second / 8000}
+					if err := audioTrack.WriteSample(sample); err != nil && err != io.ErrClosedPipe {
+						log.Log.Error("WriteToTrack: something went wrong while writing audio sample: " + err.Error())
+					}
 				}
-			case audioIdx:
-				//log.Log.Info("WriteToTrack: not writing audio for the moment.")
 			}
 		}
 	}
-	for _, p := range peerConnections {
+	for _, p := range c.peerConnections {
 		if p != nil {
 			p.Close()
 		}
 	}
-	peerConnectionCount = 0
+	atomic.StoreInt64(&c.peerConnectionCount, 0)
 	log.Log.Info("WriteToTrack: stop writing to track.")
 }
@@ -457,6 +457,20 @@ class Settings extends React.Component {
                     }
                   />
 
+                  <Input
+                    label="Sub RTSP URL"
+                    value={custom.capture.ipcamera.sub_rtsp}
+                    placeholder="A low resolution stream, used for motion detection (optional)"
+                    onChange={(value) =>
+                      this.onUpdateField(
+                        'capture.ipcamera',
+                        'sub_rtsp',
+                        value,
+                        custom.capture.ipcamera
+                      )
+                    }
+                  />
+
                   <Input
                     label="onvif xaddr"
                     value={custom.capture.ipcamera.onvif_xaddr}